@@ -0,0 +1,368 @@
+// Package encode 实现加密端口使用的认证通道, 启动器通过 Dial 或 Client 与代理通信.
+//
+// 连接建立后客户端先发送握手, 双方使用安装时生成的共享密钥互相认证:
+//
+//	client -> server: Version(1) | client nonce(16)
+//	server -> client: Version(1) | server nonce(16) | HMAC-SHA256(key, "tracksocks server" | client nonce | server nonce)
+//	client -> server: HMAC-SHA256(key, "tracksocks client" | client nonce | server nonce)
+//
+// 之后每个方向使用由 HMAC-SHA256(key, "tracksocks c2s"/"tracksocks s2c" | client nonce | server nonce)
+// 派生的 AES-256-GCM 密钥加密, 每个数据帧为 length(2, 大端) | ciphertext, length 为密文长度,
+// 附加数据为 Version | length, nonce 为 4 字节 0 与 8 字节大端帧序号.
+package encode
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Version      = 0x01 // 协议版本, 同时作为连接的第一个字节与旧协议区分
+	KeySize      = 32   // 共享密钥长度
+	NonceSize    = 16   // 握手随机数长度
+	MACSize      = sha256.Size
+	MaxFrameSize = 0x4000 // 单个数据帧的最大明文长度
+
+	frameHeaderSize  = 2
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrorVersion        = errors.New("encode: unsupported protocol version")
+	ErrorAuthentication = errors.New("encode: authentication failed")
+	ErrorKeySize        = errors.New("encode: invalid key size")
+	ErrorFrameSize      = errors.New("encode: invalid frame size")
+)
+
+// GenerateKey 生成新的共享密钥
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); nil != err {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ReadKey 读取以十六进制保存的共享密钥
+func ReadKey(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if nil != err {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if nil != err {
+		return nil, err
+	}
+
+	if KeySize != len(key) {
+		return nil, ErrorKeySize
+	}
+
+	return key, nil
+}
+
+// LoadKey 读取共享密钥, 文件不存在时生成新密钥并只允许当前用户读取
+func LoadKey(fileName string) ([]byte, error) {
+	key, err := ReadKey(fileName)
+	if false == os.IsNotExist(err) {
+		return key, err
+	}
+
+	if key, err = GenerateKey(); nil != err {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); nil != err {
+		return nil, err
+	}
+
+	return key, ioutil.WriteFile(fileName, []byte(hex.EncodeToString(key)), 0600)
+}
+
+// Conn 为认证通道上的连接, 第一次读写时自动完成握手
+type Conn struct {
+	net.Conn
+	key      []byte
+	isClient bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+
+	readAEAD  cipher.AEAD
+	readSeq   uint64
+	readBuf   []byte // 已解密但未被读取的数据
+	readFrame []byte
+
+	writeMutex sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeSeq   uint64
+	writeFrame []byte
+}
+
+func Client(conn net.Conn, key []byte) *Conn {
+	return &Conn{Conn: conn, key: key, isClient: true}
+}
+
+func Server(conn net.Conn, key []byte) *Conn {
+	return &Conn{Conn: conn, key: key}
+}
+
+// Dial 连接加密端口并完成握手
+func Dial(network string, addr string, key []byte) (*Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if nil != err {
+		return nil, err
+	}
+
+	client := Client(conn, key)
+	if err = client.Handshake(); nil != err {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (c *Conn) Handshake() error {
+	c.handshakeOnce.Do(func() {
+		if KeySize != len(c.key) {
+			c.handshakeErr = ErrorKeySize
+			return
+		}
+
+		c.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer c.Conn.SetDeadline(time.Time{})
+
+		if c.isClient {
+			c.handshakeErr = c.clientHandshake()
+		} else {
+			c.handshakeErr = c.serverHandshake()
+		}
+	})
+
+	return c.handshakeErr
+}
+
+func (c *Conn) mac(label string, clientNonce []byte, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte("tracksocks " + label))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+
+	return mac.Sum(nil)
+}
+
+func (c *Conn) clientHandshake() error {
+	hello := make([]byte, 1+NonceSize)
+	hello[0] = Version
+	if _, err := io.ReadFull(rand.Reader, hello[1:]); nil != err {
+		return err
+	}
+
+	if _, err := c.Conn.Write(hello); nil != err {
+		return err
+	}
+
+	reply := make([]byte, 1+NonceSize+MACSize)
+	if _, err := io.ReadFull(c.Conn, reply); nil != err {
+		return err
+	}
+
+	if Version != reply[0] {
+		return ErrorVersion
+	}
+
+	clientNonce, serverNonce := hello[1:], reply[1:1+NonceSize]
+	if false == hmac.Equal(reply[1+NonceSize:], c.mac("server", clientNonce, serverNonce)) {
+		c.Conn.Write(c.mac("client", clientNonce, serverNonce)) // 服务端同样得到认证失败, 而不是连接被关闭
+		return ErrorAuthentication
+	}
+
+	if _, err := c.Conn.Write(c.mac("client", clientNonce, serverNonce)); nil != err {
+		return err
+	}
+
+	return c.establish(clientNonce, serverNonce)
+}
+
+func (c *Conn) serverHandshake() error {
+	hello := make([]byte, 1+NonceSize)
+	if _, err := io.ReadFull(c.Conn, hello); nil != err {
+		return err
+	}
+
+	if Version != hello[0] {
+		return ErrorVersion
+	}
+
+	reply := make([]byte, 1+NonceSize, 1+NonceSize+MACSize)
+	reply[0] = Version
+	if _, err := io.ReadFull(rand.Reader, reply[1:]); nil != err {
+		return err
+	}
+
+	clientNonce, serverNonce := hello[1:], reply[1:]
+	if _, err := c.Conn.Write(append(reply, c.mac("server", clientNonce, serverNonce)...)); nil != err {
+		return err
+	}
+
+	mac := make([]byte, MACSize)
+	if _, err := io.ReadFull(c.Conn, mac); nil != err {
+		return err
+	}
+
+	if false == hmac.Equal(mac, c.mac("client", clientNonce, serverNonce)) {
+		return ErrorAuthentication
+	}
+
+	return c.establish(clientNonce, serverNonce)
+}
+
+func (c *Conn) establish(clientNonce []byte, serverNonce []byte) (err error) {
+	var c2s, s2c cipher.AEAD
+	if c2s, err = newAEAD(c.mac("c2s", clientNonce, serverNonce)); nil != err {
+		return err
+	}
+	if s2c, err = newAEAD(c.mac("s2c", clientNonce, serverNonce)); nil != err {
+		return err
+	}
+
+	if c.isClient {
+		c.readAEAD, c.writeAEAD = s2c, c2s
+	} else {
+		c.readAEAD, c.writeAEAD = c2s, s2c
+	}
+
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func frameNonce(nonce []byte, seq uint64) []byte {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func frameAdditional(header []byte) []byte {
+	return []byte{Version, header[0], header[1]}
+}
+
+func (c *Conn) Read(data []byte) (int, error) {
+	if err := c.Handshake(); nil != err {
+		return 0, err
+	}
+
+	for 0 == len(c.readBuf) { // 跳过空帧, 不返回 (0, nil)
+		if err := c.readNextFrame(); nil != err {
+			return 0, err
+		}
+	}
+
+	n := copy(data, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+func (c *Conn) readNextFrame() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); nil != err {
+		return err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size < c.readAEAD.Overhead() || size > MaxFrameSize+c.readAEAD.Overhead() {
+		return ErrorFrameSize
+	}
+
+	if cap(c.readFrame) < size {
+		c.readFrame = make([]byte, MaxFrameSize+c.readAEAD.Overhead())
+	}
+
+	frame := c.readFrame[:size]
+	if _, err := io.ReadFull(c.Conn, frame); nil != err {
+		if io.EOF == err {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	nonce := frameNonce(make([]byte, c.readAEAD.NonceSize()), c.readSeq)
+	plain, err := c.readAEAD.Open(frame[:0], nonce, frame, frameAdditional(header[:]))
+	if nil != err {
+		return ErrorAuthentication
+	}
+
+	c.readSeq++
+	c.readBuf = plain
+
+	return nil
+}
+
+func (c *Conn) Write(data []byte) (n int, err error) {
+	if err = c.Handshake(); nil != err {
+		return 0, err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	overhead := c.writeAEAD.Overhead()
+	if nil == c.writeFrame {
+		c.writeFrame = make([]byte, frameHeaderSize+MaxFrameSize+overhead)
+	}
+
+	nonce := make([]byte, c.writeAEAD.NonceSize())
+	for 0 < len(data) {
+		size := len(data)
+		if size > MaxFrameSize {
+			size = MaxFrameSize
+		}
+
+		header := c.writeFrame[:frameHeaderSize]
+		binary.BigEndian.PutUint16(header, uint16(size+overhead))
+
+		frame := c.writeAEAD.Seal(c.writeFrame[frameHeaderSize:frameHeaderSize], frameNonce(nonce, c.writeSeq), data[:size], frameAdditional(header))
+		if _, err = c.Conn.Write(c.writeFrame[:frameHeaderSize+len(frame)]); nil != err {
+			return n, err
+		}
+
+		c.writeSeq++
+		n += size
+		data = data[size:]
+	}
+
+	return n, nil
+}
+
+// CloseWrite 关闭底层连接的写入方向, 用于转发结束时通知对方
+func (c *Conn) CloseWrite() error {
+	if tcp, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcp.CloseWrite()
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package encode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// bufferConn 用内存数据替换握手后的底层连接, 方便构造被篡改的数据帧
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (b bufferConn) Read(data []byte) (int, error)  { return b.buf.Read(data) }
+func (b bufferConn) Write(data []byte) (int, error) { return b.buf.Write(data) }
+
+func testKey(t *testing.T) []byte {
+	key, err := GenerateKey()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func handshakePair(t *testing.T, clientKey []byte, serverKey []byte) (*Conn, *Conn, error, error) {
+	clientConn, serverConn := net.Pipe()
+	client, server := Client(clientConn, clientKey), Server(serverConn, serverKey)
+
+	clientErr := make(chan error, 1)
+	go func() { clientErr <- client.Handshake() }()
+
+	serverErr := server.Handshake()
+	return client, server, <-clientErr, serverErr
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	key := testKey(t)
+	client, server, clientErr, serverErr := handshakePair(t, key, key)
+	if nil != clientErr || nil != serverErr {
+		t.Fatalf("handshake: client = %v, server = %v", clientErr, serverErr)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	for _, size := range []int{1, MaxFrameSize - 1, MaxFrameSize, MaxFrameSize + 1, 3*MaxFrameSize + 5} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		for _, pair := range [][2]*Conn{{client, server}, {server, client}} {
+			writer, reader := pair[0], pair[1]
+
+			writeErr := make(chan error, 1)
+			go func() {
+				_, err := writer.Write(data)
+				writeErr <- err
+			}()
+
+			recv := make([]byte, size)
+			if _, err := io.ReadFull(reader, recv); nil != err {
+				t.Fatalf("size %d: read err = %v", size, err)
+			}
+
+			if err := <-writeErr; nil != err {
+				t.Fatalf("size %d: write err = %v", size, err)
+			}
+
+			if false == bytes.Equal(data, recv) {
+				t.Fatalf("size %d: data mismatch", size)
+			}
+		}
+	}
+}
+
+func TestConnWrongKey(t *testing.T) {
+	client, server, clientErr, serverErr := handshakePair(t, testKey(t), testKey(t))
+	defer client.Close()
+	defer server.Close()
+
+	if ErrorAuthentication != clientErr || ErrorAuthentication != serverErr {
+		t.Fatalf("client = %v, server = %v", clientErr, serverErr)
+	}
+}
+
+func TestConnVersion(t *testing.T) {
+	key := testKey(t)
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		hello := make([]byte, 1+NonceSize)
+		hello[0] = Version + 1
+		clientConn.Write(hello)
+	}()
+
+	if err := Server(serverConn, key).Handshake(); ErrorVersion != err {
+		t.Fatalf("server err = %v", err)
+	}
+	clientConn.Close()
+	serverConn.Close()
+
+	clientConn, serverConn = net.Pipe()
+	go func() {
+		io.ReadFull(serverConn, make([]byte, 1+NonceSize))
+
+		reply := make([]byte, 1+NonceSize+MACSize)
+		reply[0] = Version + 1
+		serverConn.Write(reply)
+	}()
+
+	if err := Client(clientConn, key).Handshake(); ErrorVersion != err {
+		t.Fatalf("client err = %v", err)
+	}
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestConnTamper(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(stream []byte, first int) []byte
+		err    error
+	}{
+		{"valid", func(stream []byte, first int) []byte { return stream }, nil},
+		{"ciphertext", func(stream []byte, first int) []byte {
+			stream[frameHeaderSize+1] ^= 0x01
+			return stream
+		}, ErrorAuthentication},
+		{"length", func(stream []byte, first int) []byte {
+			binary.BigEndian.PutUint16(stream, uint16(first-frameHeaderSize-1))
+			return stream
+		}, ErrorAuthentication},
+		{"sequence", func(stream []byte, first int) []byte {
+			return append(append([]byte{}, stream[first:]...), stream[:first]...) // 交换两个数据帧的顺序
+		}, ErrorAuthentication},
+	}
+
+	key := testKey(t)
+	for _, c := range cases {
+		client, server, clientErr, serverErr := handshakePair(t, key, key)
+		if nil != clientErr || nil != serverErr {
+			t.Fatalf("%s: handshake: client = %v, server = %v", c.name, clientErr, serverErr)
+		}
+		client.Close()
+
+		record := &bytes.Buffer{}
+		client.Conn = bufferConn{buf: record}
+		client.Write([]byte("first"))
+		first := record.Len()
+		client.Write([]byte("second"))
+
+		server.Conn = bufferConn{buf: bytes.NewBuffer(c.modify(record.Bytes(), first))}
+
+		data := make([]byte, 16)
+		n, err := server.Read(data)
+		if c.err != err {
+			t.Fatalf("%s: err = %v, want %v", c.name, err, c.err)
+		}
+
+		if nil == c.err {
+			if "first" != string(data[:n]) {
+				t.Fatalf("%s: first = %q", c.name, data[:n])
+			}
+
+			if n, err = server.Read(data); nil != err || "second" != string(data[:n]) {
+				t.Fatalf("%s: second = %q, err = %v", c.name, data[:n], err)
+			}
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "conf", "encode.key")
+
+	key, err := LoadKey(fileName)
+	if nil != err || KeySize != len(key) {
+		t.Fatalf("key = %x, err = %v", key, err)
+	}
+
+	info, err := os.Stat(fileName)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "windows" != runtime.GOOS && 0600 != info.Mode().Perm() {
+		t.Fatalf("mode = %v", info.Mode())
+	}
+
+	if again, err := LoadKey(fileName); nil != err || false == bytes.Equal(key, again) {
+		t.Fatalf("reload key = %x, err = %v", again, err)
+	}
+
+	os.WriteFile(fileName, []byte("0011"), 0600)
+	if _, err := LoadKey(fileName); ErrorKeySize != err {
+		t.Fatalf("short key err = %v", err)
+	}
+
+	os.WriteFile(fileName, []byte("not hex"), 0600)
+	if _, err := LoadKey(fileName); nil == err {
+		t.Fatal("expect error for invalid key")
+	}
+}
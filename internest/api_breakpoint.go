@@ -0,0 +1,105 @@
+package internest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+func queryID(request *http.Request) (uint64, error) {
+	return strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
+}
+
+// BreakpointsAPI 查询、添加及删除断点
+type BreakpointsAPI struct{}
+
+func NewBreakpointsAPI() *BreakpointsAPI {
+	return &BreakpointsAPI{}
+}
+
+func (api BreakpointsAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, map[string]interface{}{
+		"breakpoints": proxy.Breakpoints.List(),
+		"paused":      proxy.Breakpoints.Paused(),
+	})
+}
+
+func (api BreakpointsAPI) Post(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	var breakpoint proxy.Breakpoint
+	if err := json.NewDecoder(request.Body).Decode(&breakpoint); nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	breakpoint, err := proxy.Breakpoints.Add(breakpoint)
+	if nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	return jsonResponse(http.StatusOK, breakpoint)
+}
+
+func (api BreakpointsAPI) Delete(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	id, err := queryID(request)
+	if nil != err {
+		return http.StatusBadRequest, []byte("invalid breakpoint id"), nil
+	}
+
+	if err = proxy.Breakpoints.Remove(id); nil != err {
+		return http.StatusNotFound, []byte(err.Error()), nil
+	}
+
+	return http.StatusOK, []byte{}, nil
+}
+
+// BreakpointPausedAPI 查询暂停内容的详细信息
+type BreakpointPausedAPI struct{}
+
+func NewBreakpointPausedAPI() *BreakpointPausedAPI {
+	return &BreakpointPausedAPI{}
+}
+
+func (api BreakpointPausedAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	id, err := queryID(request)
+	if nil != err {
+		return http.StatusBadRequest, []byte("invalid pause id"), nil
+	}
+
+	exchange, exist := proxy.Breakpoints.PausedExchange(id)
+	if false == exist {
+		return http.StatusNotFound, []byte("pause not found"), nil
+	}
+
+	return jsonResponse(http.StatusOK, exchange)
+}
+
+// BreakpointResumeAPI 释放暂停的内容, 请求体为空时不做修改
+type BreakpointResumeAPI struct{}
+
+func NewBreakpointResumeAPI() *BreakpointResumeAPI {
+	return &BreakpointResumeAPI{}
+}
+
+func (api BreakpointResumeAPI) Post(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	id, err := queryID(request)
+	if nil != err {
+		return http.StatusBadRequest, []byte("invalid pause id"), nil
+	}
+
+	var edit proxy.BreakpointEdit
+	if data, _ := ioutil.ReadAll(request.Body); 0 != len(data) {
+		if err = json.Unmarshal(data, &edit); nil != err {
+			return http.StatusBadRequest, []byte(err.Error()), nil
+		}
+	}
+
+	if err = proxy.Breakpoints.Resume(id, edit); nil != err {
+		return http.StatusNotFound, []byte(err.Error()), nil
+	}
+
+	return http.StatusOK, []byte{}, nil
+}
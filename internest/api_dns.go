@@ -0,0 +1,29 @@
+package internest
+
+import (
+	"net/http"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+// DNSAPI 查看 DNS 服务器、全局 hosts 覆盖及解析缓存, DELETE 清空缓存
+type DNSAPI struct{}
+
+func NewDNSAPI() *DNSAPI {
+	return &DNSAPI{}
+}
+
+func (api DNSAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, map[string]interface{}{
+		"servers": proxy.Resolver.Servers(),
+		"hosts":   proxy.Resolver.Hosts(),
+		"cache":   proxy.Resolver.CacheStates(),
+	})
+}
+
+func (api DNSAPI) Delete(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	proxy.Resolver.FlushCache()
+	return api.Get(values, request)
+}
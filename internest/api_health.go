@@ -0,0 +1,43 @@
+package internest
+
+import (
+	"net/http"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+// HealthAPI 检查 HTTP 及 HTTPS 代理端口是否正常监听, 异常时返回 503
+type HealthAPI struct{}
+
+func NewHealthAPI() *HealthAPI {
+	return &HealthAPI{}
+}
+
+// healthStatus HTTP 及 HTTPS 端口都在监听时返回正常, 其他监听端口不影响结果
+func healthStatus(states []proxy.ListenerState) (string, int, map[string]proxy.ListenerState) {
+	status, code := "ok", http.StatusOK
+
+	listeners := make(map[string]proxy.ListenerState)
+	for _, state := range states {
+		listeners[state.Name] = state
+	}
+
+	for _, name := range []string{"http", "https"} {
+		if state, exist := listeners[name]; false == exist || false == state.Up {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	return status, code, listeners
+}
+
+func (api HealthAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	status, code, listeners := healthStatus(proxy.Listeners.States())
+
+	return jsonResponse(code, map[string]interface{}{
+		"status":    status,
+		"listeners": listeners,
+	})
+}
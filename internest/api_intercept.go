@@ -0,0 +1,46 @@
+package internest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+// InterceptAPI 查询及修改不解密列表, 修改只在本次运行中有效
+type InterceptAPI struct{}
+
+func NewInterceptAPI() *InterceptAPI {
+	return &InterceptAPI{}
+}
+
+func (api InterceptAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, map[string]interface{}{"never": proxy.Interception.NeverIntercept()})
+}
+
+// Post 请求体为 {"host":"bank.example.com"}, 以 . 开头的 host 为模糊匹配
+func (api InterceptAPI) Post(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	var body struct {
+		Host string `json:"host"`
+	}
+
+	if err := json.NewDecoder(request.Body).Decode(&body); nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	if err := proxy.Interception.AddNeverIntercept(body.Host); nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	return api.Get(values, request)
+}
+
+func (api InterceptAPI) Delete(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	if false == proxy.Interception.RemoveNeverIntercept(request.URL.Query().Get("host")) {
+		return http.StatusNotFound, []byte("host not found"), nil
+	}
+
+	return api.Get(values, request)
+}
@@ -1,14 +1,45 @@
 package internest
 
 import (
+	"bufio"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ssoor/webapi"
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 )
 
+const (
+	DefaultLogLimit = 1000
+	MaxLogLimit     = 10000
+	MaxLogScanSize  = 4 << 20
+)
+
+// 日志级别由低到高排列
+var logLevels = []string{"debug", "info", "warning", "error"}
+
+type LogLine struct {
+	Offset int64  `json:"offset"`
+	Level  string `json:"level,omitempty"`
+	Text   string `json:"text"`
+}
+
+type LogPage struct {
+	File  string    `json:"file"`
+	Size  int64     `json:"size"`
+	Since int64     `json:"since"`
+	Next  int64     `json:"next"` // 下次请求使用的 since
+	More  bool      `json:"more"` // 是否还有未返回的日志
+	Reset bool      `json:"reset,omitempty"`
+	Lines []LogLine `json:"lines"`
+}
+
 type LogAPI struct {
 	url string
 }
@@ -17,9 +48,197 @@ func NewLogAPI() *LogAPI {
 	return &LogAPI{}
 }
 
+func logLevelIndex(level string) int {
+	level = strings.ToLower(level)
+	if "warn" == level {
+		level = "warning"
+	}
+
+	for i, name := range logLevels {
+		if name == level {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// parseLogLevel 优先读取 JSON 日志行的 level 字段, 否则在行首查找日志级别, 找不到时返回空
+func parseLogLevel(line string) string {
+	if strings.HasPrefix(line, "{") {
+		var record struct {
+			Level string `json:"level"`
+		}
+
+		if err := json.Unmarshal([]byte(line), &record); nil == err && 0 <= logLevelIndex(record.Level) {
+			return strings.ToLower(record.Level)
+		}
+	}
+
+	prefix := line
+	if len(prefix) > 64 {
+		prefix = prefix[:64]
+	}
+	prefix = strings.ToUpper(prefix)
+
+	switch {
+	case strings.Contains(prefix, "ERROR"):
+		return "error"
+	case strings.Contains(prefix, "WARN"):
+		return "warning"
+	case strings.Contains(prefix, "INFO"):
+		return "info"
+	case strings.Contains(prefix, "DEBUG"):
+		return "debug"
+	}
+
+	return ""
+}
+
+func isJSONLogRequest(request *http.Request) bool {
+	query := request.URL.Query()
+	for _, name := range []string{"since", "level", "tail", "limit"} {
+		if _, exist := query[name]; exist {
+			return true
+		}
+	}
+
+	return strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+// readLogLines 从 offset 开始读取完整的日志行, 不完整的最后一行留到下次读取
+func readLogLines(file *os.File, offset int64, maxSize int64) (lines []LogLine, next int64, more bool) {
+	next = offset
+	reader := bufio.NewReader(io.LimitReader(file, maxSize))
+
+	level := ""
+	for {
+		text, err := reader.ReadString('\n')
+		if nil != err { // 读取到文件末尾或者达到读取上限
+			more = next-offset+int64(len(text)) >= maxSize
+			break
+		}
+
+		if lineLevel := parseLogLevel(text); "" != lineLevel {
+			level = lineLevel
+		}
+
+		lines = append(lines, LogLine{Offset: next, Level: level, Text: strings.TrimRight(text, "\r\n")})
+		next += int64(len(text))
+	}
+
+	return lines, next, more
+}
+
+func filterLogLines(lines []LogLine, minLevel int) []LogLine {
+	if 0 >= minLevel {
+		return lines
+	}
+
+	filtered := make([]LogLine, 0, len(lines))
+	for _, line := range lines {
+		if logLevelIndex(line.Level) >= minLevel {
+			filtered = append(filtered, line)
+		}
+	}
+
+	return filtered
+}
+
+// getJSON 按 since、limit、tail 及 level 分页读取日志文件
+func (api LogAPI) getJSON(fileName string, query url.Values) (int, interface{}, http.Header) {
+	logFile, err := os.Open(fileName)
+	if nil != err {
+		return http.StatusNotFound, []byte(err.Error()), nil
+	}
+	defer logFile.Close()
+
+	info, err := logFile.Stat()
+	if nil != err {
+		return http.StatusInternalServerError, []byte(err.Error()), nil
+	}
+
+	page := LogPage{File: fileName, Size: info.Size(), Lines: make([]LogLine, 0)}
+
+	minLevel := 0
+	if level := query.Get("level"); "" != level {
+		if minLevel = logLevelIndex(level); 0 > minLevel {
+			return http.StatusBadRequest, []byte("unknown log level: " + level), nil
+		}
+	}
+
+	limit := DefaultLogLimit
+	if value := query.Get("limit"); "" != value {
+		if limit, err = strconv.Atoi(value); nil != err || 0 >= limit {
+			return http.StatusBadRequest, []byte("invalid limit"), nil
+		}
+	}
+	if limit > MaxLogLimit {
+		limit = MaxLogLimit
+	}
+
+	if value := query.Get("tail"); "" != value { // 返回最后 tail 行
+		tail, err := strconv.Atoi(value)
+		if nil != err || 0 >= tail {
+			return http.StatusBadRequest, []byte("invalid tail"), nil
+		}
+		if tail > MaxLogLimit {
+			tail = MaxLogLimit
+		}
+
+		page.Since = page.Size - MaxLogScanSize
+		if 0 > page.Since {
+			page.Since = 0
+		}
+
+		logFile.Seek(page.Since, io.SeekStart)
+		lines, next, _ := readLogLines(logFile, page.Since, MaxLogScanSize)
+		if 0 != page.Since && 0 != len(lines) { // 第一行可能不完整
+			lines = lines[1:]
+		}
+
+		lines = filterLogLines(lines, minLevel)
+		if len(lines) > tail {
+			lines = lines[len(lines)-tail:]
+		}
+
+		page.Lines, page.Next = lines, next
+		return jsonResponse(http.StatusOK, page)
+	}
+
+	if value := query.Get("since"); "" != value {
+		if page.Since, err = strconv.ParseInt(value, 10, 64); nil != err || 0 > page.Since {
+			return http.StatusBadRequest, []byte("invalid since"), nil
+		}
+	}
+
+	if page.Since > page.Size { // 日志文件已被截断或轮换
+		page.Since, page.Reset = 0, true
+	}
+
+	logFile.Seek(page.Since, io.SeekStart)
+	lines, next, more := readLogLines(logFile, page.Since, MaxLogScanSize)
+
+	page.Next, page.More = next, more
+	for _, line := range filterLogLines(lines, minLevel) {
+		if len(page.Lines) >= limit {
+			page.Next, page.More = line.Offset, true
+			break
+		}
+
+		page.Lines = append(page.Lines, line)
+	}
+
+	return jsonResponse(http.StatusOK, page)
+}
+
 func (api LogAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
 	var outstring string
 
+	if isJSONLogRequest(request) {
+		return api.getJSON(log.GetFileName(), request.URL.Query())
+	}
+
 	if logFile, err := os.OpenFile(log.GetFileName(), os.O_RDONLY, 0); nil == err {
 		outstring = "<!DOCTYPE html><html><head><title>程序运行日志[" + log.GetFileName() + "]</title></head><style>html,body,textarea{height:99%;}</style><body><xmp>"
 
@@ -32,3 +251,40 @@ func (api LogAPI) Get(values webapi.Values, request *http.Request) (int, interfa
 
 	return http.StatusOK, []byte(outstring), nil
 }
+
+// LogLevelAPI 查询及修改运行时日志级别
+type LogLevelAPI struct{}
+
+func NewLogLevelAPI() *LogLevelAPI {
+	return &LogLevelAPI{}
+}
+
+func (api LogLevelAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, map[string]string{"level": log.GetLevel().String()})
+}
+
+// Post 请求体为 {"level":"debug"}, 也可以使用 ?level=debug
+func (api LogLevelAPI) Post(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	name := request.URL.Query().Get("level")
+	if "" == name {
+		var body struct {
+			Level string `json:"level"`
+		}
+
+		if err := json.NewDecoder(request.Body).Decode(&body); nil != err {
+			return http.StatusBadRequest, []byte(err.Error()), nil
+		}
+		name = body.Level
+	}
+
+	level, err := log.ParseLevel(name)
+	if nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	previous := log.GetLevel()
+	log.SetLevel(level)
+	log.WithFields(log.Fields{"from": previous.String(), "to": level.String()}).Warning("Log level changed through internest")
+
+	return jsonResponse(http.StatusOK, map[string]string{"level": level.String()})
+}
@@ -0,0 +1,122 @@
+package internest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+func TestLogPage(t *testing.T) {
+	lines := []string{
+		"2024/01/02 INFO start\n",
+		"  continued line\n", // 没有级别的行沿用上一行的级别
+		`{"level":"warning","msg":"slow"}` + "\n",
+		"ERROR failed\n",
+		"DEBUG detail\n",
+	}
+
+	offsets := make([]int64, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = offsets[i] + int64(len(line))
+	}
+
+	fileName := filepath.Join(t.TempDir(), "test.log")
+	os.WriteFile(fileName, []byte(strings.Join(lines, "")+"partial"), 0600) // 不完整的最后一行留到下次读取
+
+	cases := []struct {
+		query  string
+		status int
+		lines  []int
+		levels []string
+		next   int64
+		more   bool
+		reset  bool
+	}{
+		{"", http.StatusOK, []int{0, 1, 2, 3, 4}, []string{"info", "info", "warning", "error", "debug"}, offsets[5], false, false},
+		{"limit=2", http.StatusOK, []int{0, 1}, nil, offsets[2], true, false},
+		{"since=" + strconv.FormatInt(offsets[2], 10) + "&limit=2", http.StatusOK, []int{2, 3}, nil, offsets[4], true, false},
+		{"since=" + strconv.FormatInt(offsets[5], 10), http.StatusOK, []int{}, nil, offsets[5], false, false},
+		{"since=100000", http.StatusOK, []int{0, 1, 2, 3, 4}, nil, offsets[5], false, true}, // 日志已被轮换
+		{"level=warn", http.StatusOK, []int{2, 3}, nil, offsets[5], false, false},
+		{"level=ERROR", http.StatusOK, []int{3}, nil, offsets[5], false, false},
+		{"level=info&limit=3", http.StatusOK, []int{0, 1, 2}, nil, offsets[3], true, false},
+		{"tail=2", http.StatusOK, []int{3, 4}, nil, offsets[5], false, false},
+		{"tail=2&level=info", http.StatusOK, []int{2, 3}, nil, offsets[5], false, false},
+		{"level=trace", http.StatusBadRequest, nil, nil, 0, false, false},
+		{"limit=0", http.StatusBadRequest, nil, nil, 0, false, false},
+		{"since=-1", http.StatusBadRequest, nil, nil, 0, false, false},
+		{"tail=x", http.StatusBadRequest, nil, nil, 0, false, false},
+	}
+
+	api := NewLogAPI()
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		status, body, _ := api.getJSON(fileName, query)
+		if c.status != status {
+			t.Fatalf("%q: status = %d, body = %s", c.query, status, body)
+		}
+
+		if http.StatusOK != status {
+			continue
+		}
+
+		var page LogPage
+		if err := json.Unmarshal(body.([]byte), &page); nil != err {
+			t.Fatal(err)
+		}
+
+		texts, levels := make([]int, 0, len(page.Lines)), make([]string, 0, len(page.Lines))
+		for _, line := range page.Lines {
+			index := -1
+			for i := range lines {
+				if offsets[i] == line.Offset && strings.TrimRight(lines[i], "\n") == line.Text {
+					index = i
+				}
+			}
+
+			texts, levels = append(texts, index), append(levels, line.Level)
+		}
+
+		if false == reflect.DeepEqual(c.lines, texts) || c.next != page.Next || c.more != page.More || c.reset != page.Reset {
+			t.Fatalf("%q: lines = %v, next = %d, more = %v, reset = %v", c.query, texts, page.Next, page.More, page.Reset)
+		}
+
+		if nil != c.levels && false == reflect.DeepEqual(c.levels, levels) {
+			t.Fatalf("%q: levels = %v", c.query, levels)
+		}
+	}
+
+	if status, _, _ := api.getJSON(filepath.Join(t.TempDir(), "missing.log"), url.Values{}); http.StatusNotFound != status {
+		t.Fatalf("missing file status = %d", status)
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		states []proxy.ListenerState
+		status string
+		code   int
+	}{
+		{"all up", []proxy.ListenerState{{Name: "http", Up: true}, {Name: "https", Up: true}}, "ok", http.StatusOK},
+		{"other down", []proxy.ListenerState{{Name: "http", Up: true}, {Name: "https", Up: true}, {Name: "socks", Up: false}}, "ok", http.StatusOK},
+		{"https down", []proxy.ListenerState{{Name: "http", Up: true}, {Name: "https", Up: false}}, "unavailable", http.StatusServiceUnavailable},
+		{"http missing", []proxy.ListenerState{{Name: "https", Up: true}, {Name: "forward", Up: true}}, "unavailable", http.StatusServiceUnavailable},
+		{"not started", nil, "unavailable", http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		status, code, listeners := healthStatus(c.states)
+		if c.status != status || c.code != code || len(c.states) != len(listeners) {
+			t.Fatalf("%s: status = %s, code = %d, listeners = %v", c.name, status, code, listeners)
+		}
+	}
+}
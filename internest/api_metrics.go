@@ -0,0 +1,66 @@
+package internest
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/log"
+	"github.com/ssoor/tracksocks/redirect/proxy"
+	"github.com/ssoor/tracksocks/settings"
+)
+
+type MetricsAPI struct{}
+
+func NewMetricsAPI() *MetricsAPI {
+	return &MetricsAPI{}
+}
+
+func (api MetricsAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	var out bytes.Buffer
+	proxy.Metrics.WriteText(&out)
+
+	return http.StatusOK, out.Bytes(), http.Header{"Content-Type": []string{proxy.MetricsContentType}}
+}
+
+// metricsHandler 为独立监听地址上的 /metrics, 供远程 Prometheus 采集, token 不为空时校验 Bearer 令牌
+type metricsHandler struct {
+	token string
+}
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if "/metrics" != r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if "" != h.token && false == secureEqual(r.Header.Get("Authorization"), "Bearer "+h.token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", proxy.MetricsContentType)
+	proxy.Metrics.WriteText(w)
+}
+
+func startMetricsServer(setting settings.Metrics) error {
+	listener, err := net.Listen("tcp", setting.Listen)
+	if nil != err {
+		return err
+	}
+
+	if "" == setting.Token {
+		log.Warning("Metrics at", listener.Addr(), "are served without token")
+	}
+
+	go func() {
+		err := http.Serve(listener, metricsHandler{token: setting.Token})
+		log.Error("Metrics service at", listener.Addr(), "stopped, err:", err)
+	}()
+
+	log.Info("Serving metrics at", listener.Addr())
+	return nil
+}
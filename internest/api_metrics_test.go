@@ -0,0 +1,53 @@
+package internest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	cases := []struct {
+		name   string
+		token  string
+		path   string
+		auth   string
+		status int
+	}{
+		{"no token", "", "/metrics", "", http.StatusOK},
+		{"bearer token", "scrape", "/metrics", "Bearer scrape", http.StatusOK},
+		{"missing token", "scrape", "/metrics", "", http.StatusUnauthorized},
+		{"wrong token", "scrape", "/metrics", "Bearer other", http.StatusUnauthorized},
+		{"raw token", "scrape", "/metrics", "scrape", http.StatusUnauthorized},
+		{"other path", "", "/stats", "", http.StatusNotFound}, // 只提供指标, 不暴露其他接口
+	}
+
+	for _, c := range cases {
+		server := httptest.NewServer(metricsHandler{token: c.token})
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+c.path, nil)
+		if "" != c.auth {
+			req.Header.Set("Authorization", c.auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		if c.status != resp.StatusCode {
+			t.Fatalf("%s: status = %d", c.name, resp.StatusCode)
+		}
+
+		if http.StatusOK == c.status && (proxy.MetricsContentType != resp.Header.Get("Content-Type") || false == strings.Contains(string(body), "# TYPE tracksocks_requests_total counter\n")) {
+			t.Fatalf("%s: content type = %s, body = %s", c.name, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package internest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+// NetworkAPI 查看可用的网络状况及切换全局使用的网络状况, 修改只在本次运行中有效
+type NetworkAPI struct{}
+
+func NewNetworkAPI() *NetworkAPI {
+	return &NetworkAPI{}
+}
+
+func (api NetworkAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, map[string]interface{}{"profile": proxy.Networks.Global(), "profiles": proxy.Networks.Profiles()})
+}
+
+// Post 请求体为 {"profile":"3g"}, profile 为空时停止模拟
+func (api NetworkAPI) Post(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	var body struct {
+		Profile string `json:"profile"`
+	}
+
+	if err := json.NewDecoder(request.Body).Decode(&body); nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	if err := proxy.Networks.SetGlobal(body.Profile); nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	return api.Get(values, request)
+}
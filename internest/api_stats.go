@@ -6,6 +6,8 @@ import (
 
 	"github.com/ssoor/webapi"
 	"github.com/ssoor/fundadore/youniverse"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
 )
 
 type StatsAPI struct {
@@ -26,6 +28,37 @@ func (api StatsAPI) Get(values webapi.Values, request *http.Request) (int, inter
 	outstring += fmt.Sprint("\tPEER : ", youniverse.Resource.Stats.PeerLoads.String(), "\tERROR: ", youniverse.Resource.Stats.PeerErrors.String(), "</br>")
 	outstring += fmt.Sprint("\tLOCAL: ", youniverse.Resource.Stats.LocalLoads.String(), "\tERROR: ", youniverse.Resource.Stats.LocalLoadErrs.String(), "</br>")
 
+	if faults := proxy.Faults.States(); 0 != len(faults) {
+		outstring += fmt.Sprint("Fault injection stats info:</br>")
+		for _, fault := range faults {
+			outstring += fmt.Sprint("\t", fault.Name, " (", fault.Type, ") MATCHED: ", fault.Matched, "\tINJECTED: ", fault.Injected, "</br>")
+		}
+	}
+
 	outstring += "</body></html>"
 	return http.StatusOK, []byte(outstring), nil
 }
+
+type StatsJSONAPI struct{}
+
+func NewStatsJSONAPI() *StatsJSONAPI {
+	return &StatsJSONAPI{}
+}
+
+func (api StatsJSONAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	stats := youniverse.Resource.Stats
+
+	return jsonResponse(http.StatusOK, map[string]interface{}{
+		"youniverse": map[string]int64{
+			"gets":            stats.Gets.Get(),
+			"loads":           stats.Loads.Get(),
+			"cache_hits":      stats.CacheHits.Get(),
+			"peer_loads":      stats.PeerLoads.Get(),
+			"peer_errors":     stats.PeerErrors.Get(),
+			"local_loads":     stats.LocalLoads.Get(),
+			"local_load_errs": stats.LocalLoadErrs.Get(),
+		},
+		"listeners": proxy.Listeners.States(),
+		"faults":    proxy.Faults.States(),
+	})
+}
@@ -0,0 +1,198 @@
+package internest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+var jsonHeader = http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+
+func jsonResponse(status int, v interface{}) (int, interface{}, http.Header) {
+	data, err := json.Marshal(v)
+	if nil != err {
+		return http.StatusInternalServerError, []byte(err.Error()), nil
+	}
+
+	return status, data, jsonHeader
+}
+
+type TrafficAPI struct{}
+
+func NewTrafficAPI() *TrafficAPI {
+	return &TrafficAPI{}
+}
+
+func (api TrafficAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return http.StatusOK, []byte(trafficHTML), http.Header{"Content-Type": []string{"text/html; charset=utf-8"}}
+}
+
+type TrafficRecordsAPI struct{}
+
+func NewTrafficRecordsAPI() *TrafficRecordsAPI {
+	return &TrafficRecordsAPI{}
+}
+
+func (api TrafficRecordsAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, proxy.Inspector.Records(request.URL.Query().Get("host")))
+}
+
+type TrafficRecordAPI struct{}
+
+func NewTrafficRecordAPI() *TrafficRecordAPI {
+	return &TrafficRecordAPI{}
+}
+
+func (api TrafficRecordAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	id, err := strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
+	if nil != err {
+		return http.StatusBadRequest, []byte("invalid record id"), nil
+	}
+
+	record, exist := proxy.Inspector.Record(id)
+	if false == exist {
+		return http.StatusNotFound, []byte("record not found"), nil
+	}
+
+	return jsonResponse(http.StatusOK, record)
+}
+
+// TrafficReplayAPI 重新发送记录中的请求或者构造新请求
+type TrafficReplayAPI struct{}
+
+func NewTrafficReplayAPI() *TrafficReplayAPI {
+	return &TrafficReplayAPI{}
+}
+
+func (api TrafficReplayAPI) Post(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	var replay proxy.ReplayRequest
+	if data, _ := ioutil.ReadAll(request.Body); 0 != len(data) {
+		if err := json.Unmarshal(data, &replay); nil != err {
+			return http.StatusBadRequest, []byte(err.Error()), nil
+		}
+	}
+
+	if id, err := queryID(request); nil == err {
+		replay.ID = id
+	}
+
+	if 0 == replay.ID && "" == replay.URL {
+		return http.StatusBadRequest, []byte("record id or url is required"), nil
+	}
+
+	summary, err := proxy.Replay.Replay(replay)
+	if nil != err {
+		return http.StatusBadRequest, []byte(err.Error()), nil
+	}
+
+	return jsonResponse(http.StatusOK, summary)
+}
+
+// TrafficEventsHandler 以 Server-Sent Events 推送新的请求记录
+func TrafficEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if false == ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+
+	events := proxy.Inspector.Subscribe()
+	defer proxy.Inspector.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case record := <-events:
+			if false == record.MatchHost(host) {
+				continue
+			}
+
+			data, err := json.Marshal(record)
+			if nil != err {
+				continue
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: record\ndata: %s\n\n", record.ID, data)
+		}
+
+		flusher.Flush()
+	}
+}
+
+const trafficHTML = `<!DOCTYPE html><html><head><meta charset="utf-8"/><title>实时请求查看</title>
+<style>
+body{font:12px monospace;margin:0;display:flex;flex-direction:column;height:100vh}
+#bar{padding:6px;border-bottom:1px solid #ccc}
+#main{flex:1;display:flex;min-height:0}
+#list{flex:3;overflow:auto}#detail{flex:2;overflow:auto;border-left:1px solid #ccc;padding:6px;white-space:pre-wrap;word-break:break-all}
+table{border-collapse:collapse;width:100%}td,th{padding:2px 6px;text-align:left;white-space:nowrap}
+tr.row:hover{background:#eef}tr.sel{background:#dde}.err{color:#c00}.url{max-width:600px;overflow:hidden;text-overflow:ellipsis}
+</style></head><body>
+<div id="bar">Host: <input id="host" placeholder="example.com"/> <button id="apply">过滤</button> <button id="clear">清空</button> <button id="replay" disabled>重新发送</button> <span id="state"></span></div>
+<div id="main"><div id="list"><table><thead><tr><th>#</th><th>Method</th><th>URL</th><th>Status</th><th>Size</th><th>Time(ms)</th><th>Rules</th><th>Transport</th><th>Upstream</th></tr></thead><tbody id="rows"></tbody></table></div>
+<div id="detail">选择一条请求查看详情</div></div>
+<script>
+var rows = document.getElementById("rows"), source = null;
+function text(v){return v === undefined || v === null ? "" : String(v);}
+function render(r){
+	var tr = document.getElementById("r" + r.id);
+	if (!tr) { tr = document.createElement("tr"); tr.id = "r" + r.id; tr.className = "row"; tr.onclick = function(){ show(r.id, tr); }; rows.insertBefore(tr, rows.firstChild); }
+	var cells = [r.id, r.method, r.rewrite_url ? r.url + " -> " + r.rewrite_url : r.url, r.status || "...", r.finished ? r.size : "...", Math.round(r.duration), (r.rules || []).join(","), r.transport, r.upstream];
+	tr.innerHTML = "";
+	cells.forEach(function(v, i){ var td = document.createElement("td"); td.textContent = text(v); if (i == 2) { td.className = "url"; td.title = text(v); } tr.appendChild(td); });
+	if (r.error) { tr.className += " err"; }
+}
+function body(text, encoding){ return encoding == "base64" ? "[base64] " + text : text || ""; }
+function headers(h){ var s = ""; for (var k in h || {}) { h[k].forEach(function(v){ s += k + ": " + v + "\n"; }); } return s; }
+function show(id, tr){
+	Array.prototype.forEach.call(document.querySelectorAll("tr.sel"), function(e){ e.classList.remove("sel"); });
+	tr.classList.add("sel");
+	fetch("/traffic/record?id=" + id).then(function(r){ return r.json(); }).then(function(r){
+		document.getElementById("detail").textContent = r.method + " " + r.url + "\n" + (r.rewrite_url ? "=> " + r.rewrite_url + "\n" : "") + (r.error ? "error: " + r.error + "\n" : "") +
+			"\n--- Request headers ---\n" + headers(r.request_header) + "\n--- Request body ---\n" + body(r.request_body, r.request_body_encoding) +
+			"\n\n--- Response headers (" + r.status + ") ---\n" + headers(r.response_header) + "\n--- Response body ---\n" + body(r.response_body, r.response_body_encoding);
+		document.getElementById("replay").disabled = false;
+		document.getElementById("replay").onclick = function(){ replay(r.id); };
+	});
+}
+function replay(id){
+	var repeat = parseInt(prompt("重复次数", "1"), 10) || 1;
+	var csrf = (document.cookie.match(/(?:^|; )internest_csrf=([^;]*)/) || [])[1] || "";
+	fetch("/traffic/replay?id=" + id, {method: "POST", headers: {"X-CSRF-Token": csrf}, body: JSON.stringify({repeat: repeat, concurrency: Math.min(repeat, 10)})}).then(function(r){ return r.text(); }).then(function(t){
+		document.getElementById("detail").textContent = t;
+	});
+}
+function connect(){
+	var host = encodeURIComponent(document.getElementById("host").value);
+	if (source) { source.close(); }
+	rows.innerHTML = "";
+	fetch("/traffic/records?host=" + host).then(function(r){ return r.json(); }).then(function(list){ list.forEach(render); });
+	source = new EventSource("/traffic/events?host=" + host);
+	source.addEventListener("record", function(e){ render(JSON.parse(e.data)); });
+	source.onopen = function(){ document.getElementById("state").textContent = "已连接"; };
+	source.onerror = function(){ document.getElementById("state").textContent = "连接断开, 正在重连..."; };
+}
+document.getElementById("apply").onclick = connect;
+document.getElementById("clear").onclick = function(){ rows.innerHTML = ""; };
+connect();
+</script></body></html>`
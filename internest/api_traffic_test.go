@@ -0,0 +1,123 @@
+package internest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+func inspectRequest(url string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Cookie", "session=1")
+
+	req, exchange := proxy.Inspector.Begin(req)
+	resp := exchange.Finish(req, &http.Response{StatusCode: http.StatusTeapot, Header: http.Header{"Content-Type": {"text/plain"}}, Body: ioutil.NopCloser(strings.NewReader("teapot"))}, nil)
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestTrafficRecordAPI(t *testing.T) {
+	proxy.Inspector.Configure(proxy.DefaultInspectorRecords, proxy.DefaultInspectorBodySize)
+	inspectRequest("http://record.example.com/detail")
+
+	records := proxy.Inspector.Records("record.example.com")
+	if 0 == len(records) {
+		t.Fatal("expect record")
+	}
+	id := strconv.FormatUint(records[len(records)-1].ID, 10)
+
+	cases := []struct {
+		query  string
+		status int
+	}{
+		{"id=" + id, http.StatusOK},
+		{"id=abc", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+		{"id=999999", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		status, body, _ := NewTrafficRecordAPI().Get(nil, httptest.NewRequest(http.MethodGet, "/traffic/record?"+c.query, nil))
+		if c.status != status {
+			t.Fatalf("%s: status = %d, body = %s", c.query, status, body)
+		}
+
+		if http.StatusOK != status {
+			continue
+		}
+
+		var record proxy.TrafficRecord
+		if err := json.Unmarshal(body.([]byte), &record); nil != err {
+			t.Fatal(err)
+		}
+
+		if "session=1" != record.RequestHeader.Get("Cookie") || "teapot" != record.ResponseBody || http.StatusTeapot != record.Status || false == record.Finished {
+			t.Fatalf("record = %+v", record)
+		}
+	}
+}
+
+func TestTrafficEvents(t *testing.T) {
+	proxy.Inspector.Configure(proxy.DefaultInspectorRecords, proxy.DefaultInspectorBodySize)
+
+	server := httptest.NewServer(http.HandlerFunc(TrafficEventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/traffic/events?host=events.example.com")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if "text/event-stream" != resp.Header.Get("Content-Type") {
+		t.Fatalf("content type = %s", resp.Header.Get("Content-Type"))
+	}
+
+	inspectRequest("http://other.example.com/") // 不符合过滤条件
+	inspectRequest("http://www.events.example.com/")
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() map[string]string {
+		event := make(map[string]string)
+		for {
+			line, err := reader.ReadString('\n')
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if line = strings.TrimSuffix(line, "\n"); "" == line {
+				return event
+			}
+
+			if parts := strings.SplitN(line, ": ", 2); 2 == len(parts) {
+				event[parts[0]] = parts[1]
+			}
+		}
+	}
+
+	for _, finished := range []bool{false, true} { // 收到响应头及响应内容读取完毕两次推送
+		event := readEvent()
+
+		var record proxy.TrafficRecord
+		if err := json.Unmarshal([]byte(event["data"]), &record); nil != err {
+			t.Fatal(err)
+		}
+
+		if "record" != event["event"] || strconv.FormatUint(record.ID, 10) != event["id"] {
+			t.Fatalf("event = %+v", event)
+		}
+
+		if "www.events.example.com" != record.Host || finished != record.Finished || nil != record.RequestHeader {
+			t.Fatalf("record = %+v", record)
+		}
+	}
+}
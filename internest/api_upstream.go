@@ -0,0 +1,20 @@
+package internest
+
+import (
+	"net/http"
+
+	"github.com/ssoor/webapi"
+
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+// UpstreamAPI 查看上游代理的熔断状态、连接耗时及失败原因
+type UpstreamAPI struct{}
+
+func NewUpstreamAPI() *UpstreamAPI {
+	return &UpstreamAPI{}
+}
+
+func (api UpstreamAPI) Get(values webapi.Values, request *http.Request) (int, interface{}, http.Header) {
+	return jsonResponse(http.StatusOK, map[string]interface{}{"upstreams": proxy.Upstreams.States()})
+}
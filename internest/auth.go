@@ -0,0 +1,185 @@
+package internest
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	TokenHeader = "X-Internest-Token"
+	CSRFHeader  = "X-CSRF-Token"
+
+	tokenCookie = "internest_token"
+	csrfCookie  = "internest_csrf"
+)
+
+// DefaultTokenFile 返回 internest 访问令牌的默认保存位置
+func DefaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if nil != err {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "SSOOR", "internest.token")
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); nil != err {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// writeTokenFile 生成新的访问令牌并写入仅当前用户可读写的文件
+func writeTokenFile(fileName string) (string, error) {
+	token, err := randomToken()
+	if nil != err {
+		return "", err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); nil != err {
+		return "", err
+	}
+
+	os.Remove(fileName)
+	if err = ioutil.WriteFile(fileName, []byte(token), 0600); nil != err {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func ReadTokenFile(fileName string) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	return strings.TrimSpace(string(data)), err
+}
+
+// authHandler 校验 Host、Origin 及访问令牌, 防止 DNS rebinding 及跨站请求
+type authHandler struct {
+	next   http.Handler
+	token  string
+	csrf   string
+	hosts  map[string]bool
+	public map[string]bool // 无需令牌即可访问的路径
+}
+
+func newAuthHandler(next http.Handler, port int, token string, publicPaths []string) (*authHandler, error) {
+	csrf, err := randomToken()
+	if nil != err {
+		return nil, err
+	}
+
+	handler := &authHandler{
+		next:   next,
+		token:  token,
+		csrf:   csrf,
+		hosts:  make(map[string]bool),
+		public: make(map[string]bool),
+	}
+
+	for _, host := range []string{"127.0.0.1", "localhost", "[::1]"} {
+		handler.hosts[host+":"+strconv.Itoa(port)] = true
+	}
+
+	for _, path := range publicPaths {
+		handler.public[path] = true
+	}
+
+	return handler, nil
+}
+
+func secureEqual(a string, b string) bool {
+	return 1 == subtle.ConstantTimeCompare([]byte(a), []byte(b))
+}
+
+func (a *authHandler) originAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if nil != err {
+		return false
+	}
+
+	return "http" == u.Scheme && a.hosts[strings.ToLower(u.Host)]
+}
+
+func (a *authHandler) headerToken(r *http.Request) string {
+	if token := r.Header.Get(TokenHeader); "" != token {
+		return token
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return ""
+}
+
+func isSafeMethod(method string) bool {
+	return http.MethodGet == method || http.MethodHead == method || http.MethodOptions == method
+}
+
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if false == a.hosts[strings.ToLower(r.Host)] {
+		http.Error(w, "invalid host", http.StatusForbidden)
+		return
+	}
+
+	if origin := r.Header.Get("Origin"); "" != origin && false == a.originAllowed(origin) {
+		http.Error(w, "invalid origin", http.StatusForbidden)
+		return
+	}
+
+	if a.public[r.URL.Path] {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+
+	if token := a.headerToken(r); "" != token { // 请求头无法被其他站点伪造, 不需要 CSRF 校验
+		if false == secureEqual(token, a.token) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		a.next.ServeHTTP(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	if token := query.Get("token"); "" != token && isSafeMethod(r.Method) { // 浏览器首次访问, 令牌转存到 cookie
+		if false == secureEqual(token, a.token) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: a.token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: a.csrf, Path: "/", SameSite: http.SameSiteStrictMode})
+
+		query.Del("token")
+		location := *r.URL
+		location.RawQuery = query.Encode()
+		http.Redirect(w, r, location.RequestURI(), http.StatusSeeOther)
+		return
+	}
+
+	cookie, err := r.Cookie(tokenCookie)
+	if nil != err || false == secureEqual(cookie.Value, a.token) {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	if false == isSafeMethod(r.Method) && false == secureEqual(r.Header.Get(CSRFHeader), a.csrf) {
+		http.Error(w, "invalid csrf token", http.StatusForbidden)
+		return
+	}
+
+	a.next.ServeHTTP(w, r)
+}
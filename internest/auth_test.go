@@ -0,0 +1,109 @@
+package internest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret-token"
+
+func newTestAuthHandler(t *testing.T) *authHandler {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	handler, err := newAuthHandler(next, 8080, testToken, []string{"/nested/html", "/nested/url"})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return handler
+}
+
+func TestAuthHandler(t *testing.T) {
+	handler := newTestAuthHandler(t)
+
+	tokenCookies := []*http.Cookie{{Name: tokenCookie, Value: testToken}}
+	cases := []struct {
+		name    string
+		method  string
+		target  string
+		host    string
+		header  map[string]string
+		cookies []*http.Cookie
+		status  int
+	}{
+		{"rebinding host", http.MethodGet, "/stats", "attacker.example.com:8080", map[string]string{TokenHeader: testToken}, nil, http.StatusForbidden},
+		{"other port", http.MethodGet, "/stats", "127.0.0.1:9090", map[string]string{TokenHeader: testToken}, nil, http.StatusForbidden},
+		{"foreign origin", http.MethodGet, "/stats", "127.0.0.1:8080", map[string]string{TokenHeader: testToken, "Origin": "http://attacker.example.com"}, nil, http.StatusForbidden},
+		{"local origin", http.MethodGet, "/stats", "localhost:8080", map[string]string{TokenHeader: testToken, "Origin": "http://localhost:8080"}, nil, http.StatusOK},
+		{"missing token", http.MethodGet, "/stats", "127.0.0.1:8080", nil, nil, http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/stats", "127.0.0.1:8080", map[string]string{TokenHeader: "wrong"}, nil, http.StatusUnauthorized},
+		{"wrong bearer", http.MethodGet, "/stats", "127.0.0.1:8080", map[string]string{"Authorization": "Bearer wrong"}, nil, http.StatusUnauthorized},
+		{"bearer token", http.MethodPost, "/stats", "127.0.0.1:8080", map[string]string{"Authorization": "Bearer " + testToken}, nil, http.StatusOK},
+		{"wrong query token", http.MethodGet, "/stats?token=wrong", "127.0.0.1:8080", nil, nil, http.StatusUnauthorized},
+		{"wrong cookie", http.MethodGet, "/stats", "127.0.0.1:8080", nil, []*http.Cookie{{Name: tokenCookie, Value: "wrong"}}, http.StatusUnauthorized},
+		{"cookie get", http.MethodGet, "/stats", "127.0.0.1:8080", nil, tokenCookies, http.StatusOK},
+		{"cookie post without csrf", http.MethodPost, "/stats", "127.0.0.1:8080", nil, tokenCookies, http.StatusForbidden},
+		{"cookie post wrong csrf", http.MethodPost, "/stats", "127.0.0.1:8080", map[string]string{CSRFHeader: "wrong"}, tokenCookies, http.StatusForbidden},
+		{"cookie post with csrf", http.MethodPost, "/stats", "127.0.0.1:8080", map[string]string{CSRFHeader: handler.csrf}, tokenCookies, http.StatusOK},
+		{"public html nested", http.MethodGet, "/nested/html", "127.0.0.1:8080", nil, nil, http.StatusOK},
+		{"public url nested", http.MethodGet, "/nested/url", "[::1]:8080", nil, nil, http.StatusOK},
+		{"public path rebinding host", http.MethodGet, "/nested/html", "attacker.example.com:8080", nil, nil, http.StatusForbidden},
+		{"public path prefix", http.MethodGet, "/nested/html/other", "127.0.0.1:8080", nil, nil, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "http://"+c.host+c.target, nil)
+		for key, value := range c.header {
+			req.Header.Set(key, value)
+		}
+		for _, cookie := range c.cookies {
+			req.AddCookie(cookie)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if c.status != recorder.Code {
+			t.Fatalf("%s: status = %d, want %d", c.name, recorder.Code, c.status)
+		}
+	}
+}
+
+func TestAuthHandlerQueryToken(t *testing.T) {
+	handler := newTestAuthHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/traffic?token="+testToken+"&limit=10", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if http.StatusSeeOther != recorder.Code {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusSeeOther)
+	}
+
+	if location := recorder.Header().Get("Location"); "/traffic?limit=10" != location {
+		t.Fatalf("location = %s", location)
+	}
+
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range recorder.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	if cookie := cookies[tokenCookie]; nil == cookie || testToken != cookie.Value || false == cookie.HttpOnly || http.SameSiteStrictMode != cookie.SameSite {
+		t.Fatalf("token cookie = %+v", cookie)
+	}
+
+	if cookie := cookies[csrfCookie]; nil == cookie || handler.csrf != cookie.Value || cookie.HttpOnly {
+		t.Fatalf("csrf cookie = %+v", cookie)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8080/traffic?token="+testToken, strings.NewReader(""))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if http.StatusUnauthorized != recorder.Code { // 修改请求不接受 URL 中的令牌
+		t.Fatalf("post with query token: status = %d", recorder.Code)
+	}
+}
@@ -1,33 +1,70 @@
 package internest
 
 import (
+	"net"
+	"net/http"
+	"strconv"
+
 	"github.com/ssoor/webapi"
 
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 	"github.com/ssoor/fundadore/common"
-	"github.com/ssoor/fundadore/config"
-	"github.com/ssoor/fundadore/assistant"
+
+	"github.com/ssoor/tracksocks/platform"
+	"github.com/ssoor/tracksocks/settings"
 )
 
-func StartInternest(account string, guid string, setting config.Internest) (bool, error) {
+// Options 为本地启动参数, 不由远程配置下发
+type Options struct {
+	TokenFile string // 访问令牌保存位置, 为空时使用 DefaultTokenFile()
+}
+
+func StartInternest(account string, guid string, setting settings.Internest, options Options) (bool, error) {
+	var publicPaths []string // 嵌套页面由浏览器直接访问, 不校验令牌
 
 	service := webapi.NewByteAPI()
 
 	logAPI := NewLogAPI() // 程序运行日志
 	service.AddResource(logAPI, "/log")
+	service.AddResource(NewLogLevelAPI(), "/log/level") // 运行时日志级别
 
 	statsAPI := NewStatsAPI() // 程序运行状态
 	service.AddResource(statsAPI, "/stats")
+	service.AddResource(NewStatsJSONAPI(), "/stats.json")
+
+	service.AddResource(NewHealthAPI(), "/health") // 代理端口监听状态
+
+	service.AddResource(NewMetricsAPI(), "/metrics") // Prometheus 运行指标, 远程采集使用 setting.Metrics.Listen
+
+	service.AddResource(NewTrafficAPI(), "/traffic") // 实时请求查看
+	service.AddResource(NewTrafficRecordsAPI(), "/traffic/records")
+	service.AddResource(NewTrafficRecordAPI(), "/traffic/record")
+	service.AddResource(NewTrafficReplayAPI(), "/traffic/replay")
+	service.Mux().HandleFunc("/traffic/events", TrafficEventsHandler)
+
+	service.AddResource(NewInterceptAPI(), "/intercept") // 不解密列表
+
+	service.AddResource(NewUpstreamAPI(), "/upstreams") // 上游代理状态
+
+	service.AddResource(NewDNSAPI(), "/dns") // 域名解析缓存
+
+	service.AddResource(NewNetworkAPI(), "/network") // 网络状况模拟
+
+	service.AddResource(NewBreakpointsAPI(), "/breakpoints") // 断点调试
+	service.AddResource(NewBreakpointPausedAPI(), "/breakpoints/paused")
+	service.AddResource(NewBreakpointResumeAPI(), "/breakpoints/resume")
 
 	for _, htmlNested := range setting.HtmlNested {
 		htmlNestedAPI := NewHtmlNestedAPI(htmlNested.Status, []byte(htmlNested.Data), htmlNested.Header)
 		service.AddResource(htmlNestedAPI, htmlNested.Path)
+		publicPaths = append(publicPaths, htmlNested.Path)
 		log.Info("Sign resource html nested:", htmlNested.Path, ", status code is", htmlNested.Status, ", http header:", htmlNested.Header)
 	}
 
 	for _, urlNested := range setting.URLNested {
 		urlnestedAPI := NewURLNestedAPI(URLNestedType(urlNested.Type), urlNested.Title, urlNested.URL, urlNested.ScriptURL)
 		service.AddResource(urlnestedAPI, urlNested.Path)
+		publicPaths = append(publicPaths, urlNested.Path)
 		log.Info("Sign resource url nested", urlNested.Type, ":<", urlNested.Title, ">", urlNested.Path, ", url is", urlNested.URL, ", script is:", urlNested.ScriptURL)
 	}
 
@@ -40,10 +77,39 @@ func StartInternest(account string, guid string, setting config.Internest) (bool
 		setting.APIPort = int(selectPort)
 	}
 
-	go service.Start(setting.APIPort)
+	if "" == options.TokenFile {
+		options.TokenFile = DefaultTokenFile()
+	}
+
+	token, err := writeTokenFile(options.TokenFile)
+	if nil != err {
+		return false, err
+	}
+	log.Info("Internest access token is saved to", options.TokenFile)
+
+	handler, err := newAuthHandler(service.Mux(), setting.APIPort, token, publicPaths)
+	if nil != err {
+		return false, err
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(setting.APIPort))) // 只允许本机访问
+	if nil != err {
+		return false, err
+	}
+
+	go func() {
+		err := http.Serve(listener, handler)
+		log.Error("Internest service at", listener.Addr(), "stopped, err:", err)
+	}()
+
+	if "" != setting.Metrics.Listen { // internest 端口只允许本机访问, 远程采集指标使用单独的地址
+		if err = startMetricsServer(setting.Metrics); nil != err {
+			return false, err
+		}
+	}
 
-	handle, err := assistant.SetAPIPort2(setting.APIPort)
-	log.Info("Setting internest", setting.APIPort, ", data share handle:", handle, ", err:", err)
+	err = platform.Current.ShareAPIPort(setting.APIPort)
+	log.Info("Setting internest", setting.APIPort, ", data share err:", err)
 
 	return true, nil
 }
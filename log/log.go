@@ -0,0 +1,325 @@
+// Package log 为进程统一使用的日志模块, 每行输出一个 JSON 对象, 并支持日志级别及文件轮换.
+// 调用方式与 fundadore/log 保持一致, fundadore 内部输出的日志同样转存到当前日志文件.
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	legacy "github.com/ssoor/fundadore/log"
+)
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if 0 > l || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if "warn" == name {
+		name = "warning"
+	}
+
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return Level(i), nil
+		}
+	}
+
+	return InfoLevel, errors.New("unknown log level: " + name)
+}
+
+// Fields 为日志行附带的结构化字段
+type Fields map[string]interface{}
+
+// Setting 为日志文件设置, 零值字段使用默认值
+type Setting struct {
+	File       string        // 日志文件位置, 为空时使用 DefaultFile()
+	Level      string        // 最低输出级别
+	MaxSize    int64         // 单个文件最大字节数
+	MaxAge     time.Duration // 单个文件最长写入时间
+	MaxBackups int           // 最多保留的轮换文件数量
+	Retention  time.Duration // 轮换文件最长保留时间
+}
+
+var (
+	level  = int32(InfoLevel)
+	mutex  sync.Mutex
+	output io.Writer = os.Stderr
+	file   *RotateFile
+)
+
+// Warn 提供给 http.Server 等只接受标准库 logger 的地方使用
+var Warn = stdlog.New(levelWriter(WarningLevel), "", 0)
+
+// DefaultFile 返回日志文件的默认位置, Windows 下为 %APPDATA%\SSOOR\shadowsocks.log
+func DefaultFile() string {
+	dir, err := os.UserConfigDir()
+	if nil != err {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "SSOOR", "shadowsocks.log")
+}
+
+// Setup 打开日志文件并将 fundadore 的日志转存到该文件
+func Setup(setting Setting) error {
+	if "" == setting.File {
+		setting.File = DefaultFile()
+	}
+
+	if "" != setting.Level {
+		lvl, err := ParseLevel(setting.Level)
+		if nil != err {
+			return err
+		}
+
+		SetLevel(lvl)
+	}
+
+	rotate, err := OpenRotateFile(setting.File, setting.MaxSize, setting.MaxAge, setting.MaxBackups, setting.Retention)
+	if nil != err {
+		return err
+	}
+
+	mutex.Lock()
+	if nil != file {
+		file.Close()
+	}
+	file, output = rotate, rotate
+	mutex.Unlock()
+
+	return captureLegacy()
+}
+
+// captureLegacy 通过管道接收 fundadore/log 的输出, 逐行转为 JSON 日志
+func captureLegacy() error {
+	reader, writer, err := os.Pipe()
+	if nil != err {
+		return err
+	}
+
+	legacy.SetOutputFile(writer)
+
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			text := strings.TrimSpace(scanner.Text())
+			if "" == text {
+				continue
+			}
+
+			write(legacyLevel(text), text, Fields{"source": "fundadore"})
+		}
+	}()
+
+	return nil
+}
+
+func legacyLevel(text string) Level {
+	prefix := text
+	if len(prefix) > 64 {
+		prefix = prefix[:64]
+	}
+	prefix = strings.ToUpper(prefix)
+
+	switch {
+	case strings.Contains(prefix, "ERROR"):
+		return ErrorLevel
+	case strings.Contains(prefix, "WARN"):
+		return WarningLevel
+	case strings.Contains(prefix, "DEBUG"):
+		return DebugLevel
+	}
+
+	return InfoLevel
+}
+
+func Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if nil == file {
+		return nil
+	}
+
+	err := file.Close()
+	file, output = nil, os.Stderr
+
+	return err
+}
+
+func GetFileName() string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if nil == file {
+		return ""
+	}
+
+	return file.Name()
+}
+
+func SetLevel(lvl Level) {
+	atomic.StoreInt32(&level, int32(lvl))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+func Enabled(lvl Level) bool {
+	return lvl >= GetLevel()
+}
+
+// sprint 与 fmt.Sprintln 一样在参数间添加空格
+func sprint(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+func write(lvl Level, msg string, fields Fields) {
+	if false == Enabled(lvl) {
+		return
+	}
+
+	record := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if err, ok := value.(error); ok && nil != err {
+			value = err.Error()
+		}
+		record[key] = value
+	}
+
+	head, _ := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), lvl.String(), msg})
+
+	data := head
+	if 0 != len(record) { // 固定字段在前, 附带字段按名称排序在后
+		extra, err := json.Marshal(record)
+		if nil != err {
+			extra, _ = json.Marshal(map[string]string{"fields_error": err.Error()})
+		}
+
+		data = append(append(head[:len(head)-1], ','), extra[1:]...)
+	}
+
+	mutex.Lock()
+	output.Write(append(data, '\n'))
+	mutex.Unlock()
+}
+
+// Entry 为附带结构化字段的日志记录器
+type Entry struct {
+	fields Fields
+}
+
+func WithFields(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+func With(key string, value interface{}) *Entry {
+	return &Entry{fields: Fields{key: value}}
+}
+
+// WithFields 返回包含原有字段及新字段的记录器, 原记录器不受影响
+func (e *Entry) WithFields(fields Fields) *Entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return &Entry{fields: merged}
+}
+
+func (e *Entry) With(key string, value interface{}) *Entry {
+	return e.WithFields(Fields{key: value})
+}
+
+func (e *Entry) Debug(v ...interface{}) {
+	write(DebugLevel, sprint(v...), e.fields)
+}
+
+func (e *Entry) Debugf(format string, v ...interface{}) {
+	write(DebugLevel, fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e *Entry) Info(v ...interface{}) {
+	write(InfoLevel, sprint(v...), e.fields)
+}
+
+func (e *Entry) Infof(format string, v ...interface{}) {
+	write(InfoLevel, fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e *Entry) Warning(v ...interface{}) {
+	write(WarningLevel, sprint(v...), e.fields)
+}
+
+func (e *Entry) Warningf(format string, v ...interface{}) {
+	write(WarningLevel, fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e *Entry) Error(v ...interface{}) {
+	write(ErrorLevel, sprint(v...), e.fields)
+}
+
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	write(ErrorLevel, fmt.Sprintf(format, v...), e.fields)
+}
+
+// std 为不带附加字段的默认记录器
+var std = &Entry{}
+
+func Debug(v ...interface{})                   { std.Debug(v...) }
+func Debugf(format string, v ...interface{})   { std.Debugf(format, v...) }
+func Info(v ...interface{})                    { std.Info(v...) }
+func Infof(format string, v ...interface{})    { std.Infof(format, v...) }
+func Warning(v ...interface{})                 { std.Warning(v...) }
+func Warningf(format string, v ...interface{}) { std.Warningf(format, v...) }
+func Error(v ...interface{})                   { std.Error(v...) }
+func Errorf(format string, v ...interface{})   { std.Errorf(format, v...) }
+
+// Fatal 输出错误日志后退出进程
+func Fatal(v ...interface{}) {
+	write(ErrorLevel, sprint(v...), nil)
+	Close()
+	os.Exit(1)
+}
+
+type levelWriter Level
+
+func (w levelWriter) Write(data []byte) (int, error) {
+	write(Level(w), strings.TrimRight(string(data), "\r\n"), Fields{"source": "stdlog"})
+	return len(data), nil
+}
@@ -0,0 +1,141 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSize    = 20 << 20
+	DefaultMaxBackups = 5
+)
+
+// RotateFile 为按大小及时间轮换的日志文件, 轮换后的文件名为 <path>.<时间>
+type RotateFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration // 单个文件最长写入时间, 为 0 时不按时间轮换
+	maxBackups int
+	retention  time.Duration // 轮换文件保留时间, 为 0 时只按数量清理
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func OpenRotateFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, retention time.Duration) (*RotateFile, error) {
+	if 0 >= maxSize {
+		maxSize = DefaultMaxSize
+	}
+	if 0 >= maxBackups {
+		maxBackups = DefaultMaxBackups
+	}
+
+	rotate := &RotateFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		retention:  retention,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+		return nil, err
+	}
+
+	return rotate, rotate.open()
+}
+
+// open 调用方需持有 mutex
+func (r *RotateFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if nil != err {
+		return err
+	}
+
+	r.file = file
+	r.size, r.created = 0, time.Now()
+	if info, err := file.Stat(); nil == err {
+		r.size, r.created = info.Size(), info.ModTime()
+		if 0 == r.size {
+			r.created = time.Now()
+		}
+	}
+
+	return nil
+}
+
+// rotate 调用方需持有 mutex
+func (r *RotateFile) rotate() error {
+	r.file.Close()
+
+	backup := r.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.path, backup); nil != err && false == os.IsNotExist(err) {
+		if nil == r.open() { // 文件可能被其他程序占用(Windows), 继续写入原文件, 下次写入时重试
+			return nil
+		}
+
+		return err
+	}
+
+	r.cleanup()
+	return r.open()
+}
+
+// cleanup 删除超出数量或者超过保留时间的轮换文件
+func (r *RotateFile) cleanup() {
+	backups, err := filepath.Glob(r.path + ".*")
+	if nil != err {
+		return
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(backups))) // 新文件在前
+	for i, backup := range backups {
+		if strings.HasSuffix(backup, ".tmp") {
+			continue
+		}
+
+		expired := false
+		if 0 != r.retention {
+			if info, err := os.Stat(backup); nil == err && time.Since(info.ModTime()) > r.retention {
+				expired = true
+			}
+		}
+
+		if i >= r.maxBackups || expired {
+			os.Remove(backup)
+		}
+	}
+}
+
+func (r *RotateFile) Write(data []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.size+int64(len(data)) > r.maxSize || (0 != r.maxAge && time.Since(r.created) > r.maxAge) {
+		if err := r.rotate(); nil != err {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *RotateFile) Name() string {
+	return r.path
+}
+
+func (r *RotateFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.file.Close()
+}
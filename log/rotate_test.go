@@ -0,0 +1,79 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rotateBackups(t *testing.T, path string) []string {
+	backups, err := filepath.Glob(path + ".*")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return backups
+}
+
+func TestRotateFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "proxy.log")
+	file, err := OpenRotateFile(path, 16, 0, 2, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := file.Write([]byte("0123456789\n")); nil != err {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond) // 轮换文件名精确到毫秒
+	}
+
+	if data, err := os.ReadFile(path); nil != err || "0123456789\n" != string(data) {
+		t.Fatalf("current = %q, err = %v", data, err)
+	}
+
+	backups := rotateBackups(t, path)
+	if 2 != len(backups) { // 4 次轮换, 只保留最新的 2 个
+		t.Fatalf("backups = %v", backups)
+	}
+
+	for _, backup := range backups {
+		if data, _ := os.ReadFile(backup); "0123456789\n" != string(data) {
+			t.Fatalf("%s = %q", backup, data)
+		}
+	}
+}
+
+func TestRotateFileRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+
+	expired := path + ".20000101-000000.000"
+	if err := os.WriteFile(expired, []byte("old\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(expired, old, old)
+
+	file, err := OpenRotateFile(path, 1024, time.Millisecond, 10, 24*time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	file.Write([]byte("first\n"))
+	time.Sleep(5 * time.Millisecond)
+	file.Write([]byte("second\n")) // 超过 maxAge 时轮换并清理过期文件
+
+	backups := rotateBackups(t, path)
+	if 1 != len(backups) || strings.HasSuffix(backups[0], ".20000101-000000.000") {
+		t.Fatalf("backups = %v", backups)
+	}
+
+	if data, _ := os.ReadFile(backups[0]); "first\n" != string(data) {
+		t.Fatalf("backup = %q", data)
+	}
+}
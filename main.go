@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/ssoor/fundadore/assistant"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,12 +13,15 @@ import (
 
 	"os/signal"
 
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 	"github.com/ssoor/fundadore/common"
 	"github.com/ssoor/fundadore/config"
 	
 	"github.com/ssoor/tracksocks/redirect"
+	"github.com/ssoor/tracksocks/redirect/proxy"
 	"github.com/ssoor/tracksocks/internest"
+	"github.com/ssoor/tracksocks/platform"
+	"github.com/ssoor/tracksocks/settings"
 )
 
 const (
@@ -143,7 +145,7 @@ func startSignalNotify(level uint) {
 	http.Serve(listen, nil)
 }
 
-func goRun(debug bool, account string, guid string) {
+func goRun(debug bool, account string, guid string, configFile string, options redirect.Options, internestOptions internest.Options) {
 	buildVer := "20171225"
 	log.Info("[MAIN] Shadowsocks version:", buildVer)
 	log.Info("[MAIN] Shadowsocks account name:", account)
@@ -159,35 +161,50 @@ func goRun(debug bool, account string, guid string) {
 		}
 	}()
 	
-	var isFirst bool
-	if isFirst, err = assistant.IsFirstRuning("Global\\UNIQUE_PROCESS_SHADOWSOCKS"); !isFirst {
-		if nil == err {
-			err = errors.New("already process running")
-		}
+	if err = platform.Current.Lock("UNIQUE_PROCESS_SHADOWSOCKS"); nil != err {
 		return
 	}
 
-	log.Info("[MAIN] Get the program initialization parameters...")
-	config, err := config.GetSettings(buildVer, account, guid)
-	if err != nil {
-		return
+	setting := settings.RemoteOnly()
+	if "" != configFile {
+		log.Info("[MAIN] Load local config file:", configFile)
+		if setting, err = settings.Load(configFile); nil != err {
+			return
+		}
+	}
+
+	if setting.Remote.Enable {
+		if "" != setting.Remote.Account {
+			account = setting.Remote.Account
+		}
+		if "" != setting.Remote.GUID {
+			guid = setting.Remote.GUID
+		}
+
+		log.Info("[MAIN] Get the program initialization parameters...")
+		var remote *config.Settings
+		if remote, err = config.GetSettings(buildVer, account, guid); err != nil {
+			return
+		}
+
+		setting.Merge(remote)
 	}
 
 	if debug {
-		config.Redirect.Encode = false
+		setting.Redirect.Encode = false
 		log.Info("[MAIN] Current starting to debug...")
 	}
 
 	// 由于其内部需要调用一个下发组建,所以需要在下发系统工作完成后执行.
 	log.Info("[MAIN] Start internest module:")
-	succ, err = internest.StartInternest(account, guid, config.Internest)
+	succ, err = internest.StartInternest(account, guid, setting.Internest, internestOptions)
 	log.Info("[MAIN] Internest start stats:", succ, ", error:", err)
 	if false == succ {
 		return
 	}
 
 	log.Info("[MAIN] Start homelock module:")
-	succ, err = redirect.StartRedirect(account, guid, config.Redirect)
+	succ, err = redirect.StartRedirect(account, guid, setting.Redirect, options)
 	log.Info("[MAIN] Homelock start stats:", succ, ", error:", err)
 	if false == succ {
 		return
@@ -197,41 +214,50 @@ func goRun(debug bool, account string, guid string) {
 	succ = true
 }
 
-func initLogger(logPath string, logFileName string) (*os.File, error) {
-	logFileDir := os.ExpandEnv(logPath)
-
-	os.MkdirAll(logFileDir, 0777)
-	logFilePath := logFileDir + "\\" + logFileName
-
-	os.Remove(logFilePath)
-	file, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_TRUNC, 0777)
-	if err != nil {
-		return nil, err
-	}
-
-	log.SetOutputFile(file)
-	return file, err
-}
-
 func main() {
 	var debug bool
 	var guid, account string
+	var configFile string
+	var options redirect.Options
+	var internestOptions internest.Options
+	var logSetting log.Setting
+	var logMaxSize int64
+
+	if 1 < len(os.Args) && "replay" == os.Args[1] {
+		os.Exit(runReplay(os.Args[2:]))
+	}
 
 	signal.Notify(common.ChanSignalExit, os.Interrupt, os.Kill)
 
 	flag.BoolVar(&debug, "debug", false, "Whether to start the debug mode")
 	flag.StringVar(&guid, "guid", "", "unique identifier, used to obtain user configuration")
 	flag.StringVar(&account, "k", "everyone", "user name, used to obtain user configuration")
+	flag.StringVar(&configFile, "config", "", "local config file (.json, .yaml or .toml), remote settings are merged on top when enabled")
+	flag.StringVar(&options.CaptureFile, "capture", "", "traffic capture setting file, captured traffic is saved as HAR files")
+	flag.StringVar(&internestOptions.TokenFile, "token-file", "", "where to save the internest access token (default user config dir)")
+	flag.StringVar(&options.RequestIDHeader, "request-id-header", "", "echo the request id in this response header, e.g. "+proxy.DefaultRequestIDHeader)
+	flag.BoolVar(&options.SystemProxy, "system-proxy", false, "point the system proxy settings at the generated proxy.pac")
+	flag.StringVar(&options.EncodeKeyFile, "encode-key", "", "shared key file for the encode listeners, created on first start (default user config dir)")
+	flag.BoolVar(&options.EncodeLegacy, "encode-legacy", false, "also accept the legacy xor framing on the encode listeners")
+	flag.IntVar(&options.InspectorRecords, "inspector-records", proxy.DefaultInspectorRecords, "how many recent requests the traffic inspector keeps, 0 disables it")
+	flag.Int64Var(&options.InspectorBodySize, "inspector-body-size", proxy.DefaultInspectorBodySize, "how many bytes of each request and response body the traffic inspector keeps, 0 keeps none")
+	flag.DurationVar(&options.BreakpointTimeout, "breakpoint-timeout", 0, "how long a breakpoint holds a request before resuming it automatically")
+	flag.StringVar(&logSetting.File, "log-file", log.DefaultFile(), "log file path, rotated files are kept next to it")
+	flag.StringVar(&logSetting.Level, "log-level", "info", "minimum log level: debug, info, warning or error")
+	flag.Int64Var(&logMaxSize, "log-max-size", 20, "rotate the log file when it grows beyond this many megabytes")
+	flag.DurationVar(&logSetting.MaxAge, "log-max-age", 24*time.Hour, "rotate the log file after writing to it for this long, 0 disables")
+	flag.IntVar(&logSetting.MaxBackups, "log-max-backups", log.DefaultMaxBackups, "how many rotated log files to keep")
+	flag.DurationVar(&logSetting.Retention, "log-retention", 7*24*time.Hour, "delete rotated log files older than this, 0 keeps them")
 
 	flag.Parse()
-	logFile, err := initLogger("${APPDATA}\\SSOOR", "shadowsocks.log")
-	if nil != err {
+	logSetting.MaxSize = logMaxSize << 20
+	if err := log.Setup(logSetting); nil != err {
 		log.Warning("open log file error:", err.Error())
 	}
 
-	defer logFile.Close()
+	defer log.Close()
 	defer log.Info("[EXIT] The shadowsocks has finished running, exiting...")
 
-	go goRun(debug, account, guid)
+	go goRun(debug, account, guid, configFile, options, internestOptions)
 	<-common.ChanSignalExit
 }
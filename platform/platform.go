@@ -0,0 +1,48 @@
+// Package platform 封装与操作系统相关的功能, Windows 与其他系统分别由带编译标签的文件实现.
+package platform
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const (
+	StoreRoot = "Root" // 根证书
+	StoreCA   = "CA"   // 中间证书
+)
+
+const (
+	ShareHTTP    = 1
+	ShareHTTPS   = 2
+	ShareForward = 3 // 正向代理, 只在 Windows 以外的系统共享
+)
+
+var ErrorAlreadyRunning = errors.New("already process running")
+
+type Platform interface {
+	// Lock 获取单实例锁, 已有进程运行时返回 ErrorAlreadyRunning
+	Lock(name string) error
+
+	// InstallCertificate 将 PEM 证书安装到系统证书库, 无法自动安装时返回操作说明
+	InstallCertificate(store string, cert string) error
+
+	// SetPACProxy 将系统代理设置为自动配置脚本地址
+	SetPACProxy(autoConfigURL string) error
+
+	// ShareAPIPort 与 ShareProxyAddr 将运行端口提供给其他进程
+	ShareAPIPort(port int) error
+	ShareProxyAddr(kind int, host string, port uint16) error
+}
+
+var Current Platform = newPlatform()
+
+// Dir 返回本程序在用户配置目录下的数据目录
+func Dir() string {
+	dir, err := os.UserConfigDir()
+	if nil != err {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "SSOOR")
+}
@@ -0,0 +1,202 @@
+//go:build !windows
+
+package platform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// shareState 为提供给其他进程的运行信息, 保存在 Dir()/share.json
+type shareState struct {
+	APIPort int    `json:"api_port,omitempty"`
+	HTTP    string `json:"http,omitempty"`
+	HTTPS   string `json:"https,omitempty"`
+	Forward string `json:"forward,omitempty"`
+	PAC     string `json:"pac,omitempty"`
+}
+
+type unixPlatform struct {
+	mutex sync.Mutex
+	lock  *os.File
+	share shareState
+}
+
+func newPlatform() Platform {
+	return &unixPlatform{}
+}
+
+// Lock 使用 flock 锁定 Dir()/<name>.lock, 进程退出时由系统释放
+func (p *unixPlatform) Lock(name string) error {
+	if err := os.MkdirAll(Dir(), 0700); nil != err {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(Dir(), name+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if nil != err {
+		return err
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); nil != err {
+		file.Close()
+		if syscall.EWOULDBLOCK == err {
+			return ErrorAlreadyRunning
+		}
+
+		return err
+	}
+
+	file.Truncate(0)
+	file.WriteString(strconv.Itoa(os.Getpid()))
+
+	p.mutex.Lock()
+	p.lock = file
+	p.mutex.Unlock()
+
+	return nil
+}
+
+// InstallCertificate 将证书导出到 Dir()/ca 目录, 需要管理员权限的安装步骤通过错误信息返回
+func (p *unixPlatform) InstallCertificate(store string, cert string) error {
+	dir := filepath.Join(Dir(), "ca")
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return err
+	}
+
+	fileName := filepath.Join(dir, "ssoor-"+strings.ToLower(store)+".crt")
+	if err := ioutil.WriteFile(fileName, []byte(cert), 0644); nil != err {
+		return err
+	}
+
+	if StoreRoot != store { // 中间证书由代理随站点证书一起下发, 只需要信任根证书
+		return nil
+	}
+
+	var steps []string
+	switch runtime.GOOS {
+	case "darwin":
+		steps = append(steps, "sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain "+fileName)
+	default:
+		steps = append(steps,
+			"sudo cp "+fileName+" /usr/local/share/ca-certificates/ && sudo update-ca-certificates",
+			"certutil -d sql:$HOME/.pki/nssdb -A -t C,, -n ssoor-root -i "+fileName+" # Chrome/Chromium (NSS)",
+			"certutil -d <firefox profile> -A -t C,, -n ssoor-root -i "+fileName+" # Firefox",
+		)
+	}
+
+	return errors.New("certificate exported to " + fileName + ", install it manually: " + strings.Join(steps, "; "))
+}
+
+// SetPACProxy 写入 Dir()/proxy.env 供 shell 使用, GNOME 及 macOS 下同时修改系统代理设置
+func (p *unixPlatform) SetPACProxy(autoConfigURL string) error {
+	p.mutex.Lock()
+	p.share.PAC = autoConfigURL
+	p.mutex.Unlock()
+
+	if err := p.save(); nil != err {
+		return err
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return setDarwinPACProxy(autoConfigURL)
+	case "linux":
+		if _, err := exec.LookPath("gsettings"); nil == err {
+			if err = exec.Command("gsettings", "set", "org.gnome.system.proxy", "autoconfig-url", autoConfigURL).Run(); nil != err {
+				return err
+			}
+
+			return exec.Command("gsettings", "set", "org.gnome.system.proxy", "mode", "auto").Run()
+		}
+	}
+
+	return nil
+}
+
+func setDarwinPACProxy(autoConfigURL string) error {
+	output, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if nil != err {
+		return err
+	}
+
+	for i, service := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if 0 == i || strings.HasPrefix(service, "*") { // 第一行为说明, * 开头的服务已停用
+			continue
+		}
+
+		if err = exec.Command("networksetup", "-setautoproxyurl", service, autoConfigURL).Run(); nil != err {
+			return fmt.Errorf("set auto proxy url for %s failed: %v", service, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *unixPlatform) ShareAPIPort(port int) error {
+	p.mutex.Lock()
+	p.share.APIPort = port
+	p.mutex.Unlock()
+
+	return p.save()
+}
+
+func (p *unixPlatform) ShareProxyAddr(kind int, host string, port uint16) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	p.mutex.Lock()
+	switch kind {
+	case ShareHTTP:
+		p.share.HTTP = addr
+	case ShareHTTPS:
+		p.share.HTTPS = addr
+	case ShareForward:
+		p.share.Forward = addr
+	}
+	p.mutex.Unlock()
+
+	return p.save()
+}
+
+// save 写入 share.json 及 proxy.env
+func (p *unixPlatform) save() error {
+	p.mutex.Lock()
+	share := p.share
+	p.mutex.Unlock()
+
+	if err := os.MkdirAll(Dir(), 0700); nil != err {
+		return err
+	}
+
+	data, err := json.MarshalIndent(share, "", "  ")
+	if nil != err {
+		return err
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(Dir(), "share.json"), data, 0600); nil != err {
+		return err
+	}
+
+	env := "# source this file to route command line tools through the proxy\n"
+	if "" != share.Forward {
+		env += "export http_proxy=http://" + share.Forward + "\n"
+		env += "export https_proxy=http://" + share.Forward + "\n"
+	} else if "" != share.HTTP {
+		env += "export http_proxy=http://" + share.HTTP + "\n"
+	}
+	if "" != share.PAC {
+		env += "export auto_proxy=" + share.PAC + "\n"
+	}
+
+	return ioutil.WriteFile(filepath.Join(Dir(), "proxy.env"), []byte(env), 0600)
+}
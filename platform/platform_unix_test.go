@@ -0,0 +1,138 @@
+//go:build !windows
+
+package platform
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testDir 将用户配置目录指向临时目录, 返回 Dir() 的位置
+func testDir(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	return Dir()
+}
+
+func TestUnixLock(t *testing.T) {
+	dir := testDir(t)
+
+	first := &unixPlatform{}
+	if err := first.Lock("tracksocks"); nil != err {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "tracksocks.lock"))
+	if strconv.Itoa(os.Getpid()) != string(data) {
+		t.Fatalf("lock file = %q", data)
+	}
+
+	second := &unixPlatform{}
+	if err := second.Lock("tracksocks"); ErrorAlreadyRunning != err {
+		t.Fatalf("second lock err = %v", err)
+	}
+
+	if err := second.Lock("other"); nil != err { // 不同名称互不影响
+		t.Fatalf("other lock err = %v", err)
+	}
+
+	first.lock.Close() // 进程退出时由系统释放
+	if err := second.Lock("tracksocks"); nil != err {
+		t.Fatalf("lock after release err = %v", err)
+	}
+}
+
+func TestUnixShare(t *testing.T) {
+	dir := testDir(t)
+	t.Setenv("PATH", "") // 不修改桌面环境的代理设置
+
+	readEnv := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "proxy.env"))
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		return string(data)
+	}
+
+	p := &unixPlatform{}
+	steps := []struct {
+		name  string
+		apply func() error
+		env   []string
+	}{
+		{"api port", func() error { return p.ShareAPIPort(9000) }, nil},
+		{"http", func() error { return p.ShareProxyAddr(ShareHTTP, "127.0.0.1", 8080) }, []string{"export http_proxy=http://127.0.0.1:8080"}},
+		{"https", func() error { return p.ShareProxyAddr(ShareHTTPS, "::1", 8443) }, []string{"export http_proxy=http://127.0.0.1:8080"}},
+		{"forward", func() error { return p.ShareProxyAddr(ShareForward, "127.0.0.1", 8888) }, // 正向代理同时支持 HTTPS
+			[]string{"export http_proxy=http://127.0.0.1:8888", "export https_proxy=http://127.0.0.1:8888"}},
+		{"pac", func() error { return p.SetPACProxy("http://127.0.0.1:44366/proxy.pac") },
+			[]string{"export http_proxy=http://127.0.0.1:8888", "export https_proxy=http://127.0.0.1:8888", "export auto_proxy=http://127.0.0.1:44366/proxy.pac"}},
+	}
+
+	for _, step := range steps {
+		if "pac" == step.name && "darwin" == runtime.GOOS { // macOS 下同时修改网络服务设置
+			continue
+		}
+
+		if err := step.apply(); nil != err {
+			t.Fatalf("%s: err = %v", step.name, err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(readEnv()), "\n")
+		if false == strings.HasPrefix(lines[0], "#") || strings.Join(step.env, "\n") != strings.Join(lines[1:], "\n") {
+			t.Fatalf("%s: proxy.env = %q", step.name, lines)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "share.json"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var share shareState
+	if err = json.Unmarshal(data, &share); nil != err {
+		t.Fatal(err)
+	}
+
+	if 9000 != share.APIPort || "127.0.0.1:8080" != share.HTTP || "[::1]:8443" != share.HTTPS || "127.0.0.1:8888" != share.Forward {
+		t.Fatalf("share = %+v", share)
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "share.json")); nil != err || 0600 != info.Mode().Perm() {
+		t.Fatalf("share.json mode = %v, err = %v", info, err)
+	}
+}
+
+func TestUnixInstallCertificate(t *testing.T) {
+	dir := testDir(t)
+	p := &unixPlatform{}
+
+	if err := p.InstallCertificate(StoreCA, "intermediate"); nil != err { // 中间证书只导出
+		t.Fatalf("intermediate err = %v", err)
+	}
+
+	err := p.InstallCertificate(StoreRoot, "root")
+	fileName := filepath.Join(dir, "ca", "ssoor-root.crt")
+	if nil == err || false == strings.Contains(err.Error(), fileName) {
+		t.Fatalf("root err = %v", err)
+	}
+
+	if "linux" == runtime.GOOS && (false == strings.Contains(err.Error(), "update-ca-certificates") || false == strings.Contains(err.Error(), "certutil")) {
+		t.Fatalf("root instructions = %v", err)
+	}
+
+	for name, content := range map[string]string{"ssoor-root.crt": "root", "ssoor-ca.crt": "intermediate"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "ca", name)); content != string(data) {
+			t.Fatalf("%s = %q", name, data)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package redirect
+package platform
 
 import (
 	"errors"
@@ -6,9 +6,56 @@ import (
 	"syscall"
 	"unsafe"
 
+	"github.com/ssoor/fundadore/assistant"
 	"github.com/ssoor/winapi"
 )
 
+type windowsPlatform struct{}
+
+func newPlatform() Platform {
+	return windowsPlatform{}
+}
+
+func (windowsPlatform) Lock(name string) error {
+	isFirst, err := assistant.IsFirstRuning("Global\\" + name)
+	if false == isFirst && nil == err {
+		err = ErrorAlreadyRunning
+	}
+
+	return err
+}
+
+func (windowsPlatform) InstallCertificate(store string, cert string) error {
+	isOK, err := assistant.AddCertificateCryptContextToStore(store, cert)
+	if nil == err && 0 == isOK {
+		err = errors.New("not install certificate")
+	}
+
+	return err
+}
+
+func (windowsPlatform) SetPACProxy(autoConfigURL string) error {
+	if succ, err := SetPACProxy(autoConfigURL); false == succ {
+		return err
+	}
+
+	return nil
+}
+
+func (windowsPlatform) ShareAPIPort(port int) error {
+	_, err := assistant.SetAPIPort2(port)
+	return err
+}
+
+func (windowsPlatform) ShareProxyAddr(kind int, host string, port uint16) error {
+	if ShareHTTP != kind && ShareHTTPS != kind {
+		return nil
+	}
+
+	_, err := assistant.SetBusinessData(kind, 1, host, port)
+	return err
+}
+
 func ClearIEBrowserSafeTip() (bool, error) {
 	var openHKey winapi.HKEY
 	if errorCode := winapi.RegOpenKeyEx(winapi.HKEY_CURRENT_USER, "Software\\Microsoft\\Windows\\CurrentVersion\\Internet Settings", 0, winapi.KEY_READ|winapi.KEY_WRITE, &openHKey); errorCode != 0 {
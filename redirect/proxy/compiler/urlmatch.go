@@ -3,6 +3,7 @@ package compiler
 import (
 	"errors"
 	"net/url"
+	"sort"
 	"strings"
 
 	"regexp"
@@ -73,6 +74,70 @@ func (sc *URLMatch) matchReplaces(md []matchData, url string, src []byte) (dst [
 	return src, errors.New("regular expression does not match")
 }
 
+func (sc *URLMatch) matchURLs(md []matchData, url string) bool {
+	for _, urlmatch := range md {
+		if nil != urlmatch.urlRegex2 {
+			if isMatch, _ := urlmatch.urlRegex2.MatchString(url); isMatch {
+				return true
+			}
+		} else if urlmatch.urlRegex.MatchString(url) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Hosts 返回所有规则的 host, 以 . 开头的为模糊匹配, "." 为全局规则
+func (sc *URLMatch) Hosts() []string {
+	hosts := make([]string, 0, len(sc.data))
+	for host := range sc.data {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// MatchHost 检查 host 是否存在规则(绝对匹配、模糊匹配及全局规则), 不检查 url
+func (sc *URLMatch) MatchHost(host string) bool {
+	host = strings.ToLower(host)
+
+	if _, exist := sc.data[host]; exist {
+		return true
+	}
+
+	host = "." + host
+	for i := 0; -1 != i; i = strings.IndexRune(host, '.') {
+		host = host[i+1:]
+		if _, exist := sc.data["."+host]; exist {
+			return true
+		}
+	}
+
+	_, exist := sc.data["."]
+	return exist
+}
+
+// Match 只检查 host 及 url 是否命中规则, 不执行替换
+func (sc *URLMatch) Match(url *url.URL) bool {
+	host := strings.ToLower(url.Host)
+
+	if sc.matchURLs(sc.data[host], url.String()) { // 处理绝对匹配
+		return true
+	}
+
+	host = "." + host // 处理模糊匹配
+	for i := 0; -1 != i; i = strings.IndexRune(host, '.') {
+		host = host[i+1:]
+		if matchdatas, exist := sc.data["."+host]; exist && sc.matchURLs(matchdatas, url.String()) {
+			return true
+		}
+	}
+
+	return sc.matchURLs(sc.data["."], url.String()) // 处理全局规则
+}
+
 func (sc *URLMatch) Replace(url *url.URL, src []byte) (dst []byte, err error) {
 	host := strings.ToLower(url.Host)
 
@@ -1,29 +1,92 @@
 package compiler_test
 
 import (
-	"errors"
-	"fmt"
-	"github.com/ssoor/socks/compiler"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/ssoor/tracksocks/redirect/proxy/compiler"
 )
 
-func test() {
-	var smatch SMatch
-	var rules compiler.SCompiler
+func newURLMatch(t *testing.T, matchs ...compiler.JSONURLMatch) *compiler.URLMatch {
+	urlMatch := compiler.NewURLMatch()
+	for _, match := range matchs {
+		if err := urlMatch.AddMatchs(match); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	return urlMatch
+}
+
+func TestURLMatchReplace(t *testing.T) {
+	rules := newURLMatch(t,
+		compiler.JSONURLMatch{Host: "www.hao123.com", Match: []string{"s@^(http[s]?)://www.hao123.com/*/\\?.*$@$1://www.hao123.com/?tn=13087099_4_hao_pg@i"}},
+		compiler.JSONURLMatch{Host: "www.baidu.com", Match: []string{"s@^(http[s]?)://www.baidu.com/*/s\\?(?:(.*)&)?(?:tn=[^&]*)(.*)$@$1://www.baidu.com/s?$2&tn=13087099_4_hao_pg$3@i"}},
+		compiler.JSONURLMatch{Host: "www.sogou.com", Match: []string{"s@^(http[s]?)://www.sogou.com/*/sogou\\?(?:(.*)&)?(?:pid=[^&]*)(.*)$@$1://www.sogou.com/sogou?$2&pid=sogou-netb-3be0214185d6177a-4012$3@i"}},
+	)
+
+	cases := []struct {
+		src string
+		dst string
+	}{
+		{"http://www.baidu.com/s?word=dfgdfg&tn=10018800_hao_pg&ie=utf-8&ssl_sample=normal", "http://www.baidu.com/s?word=dfgdfg&tn=13087099_4_hao_pg&ie=utf-8&ssl_sample=normal"},
+		{"http://www.sogou.com/sogou?query=dfgdfg&w=&pid=sogou-netb-51be2fed6c55f5aa-7749%00&sut=935", "http://www.sogou.com/sogou?query=dfgdfg&w=&pid=sogou-netb-3be0214185d6177a-4012&sut=935"},
+		{"http://www.hao123.com/?tn=130asd9_4_hao_pg", "http://www.hao123.com/?tn=13087099_4_hao_pg"},
+		{"http://WWW.HAO123.COM/?tn=130asd9_4_hao_pg", "http://www.hao123.com/?tn=13087099_4_hao_pg"},
+	}
+
+	for _, c := range cases {
+		srcurl, _ := url.Parse(c.src)
+		if dst, err := rules.Replace(srcurl, []byte(c.src)); nil != err || c.dst != string(dst) {
+			t.Fatalf("%s: dst = %s, err = %v", c.src, dst, err)
+		}
+	}
+
+	srcurl, _ := url.Parse("http://www.hao123.com/api/newforecast?callback=jQuery17208796808742918074_1452839147843&t=1")
+	if _, err := rules.Replace(srcurl, []byte(srcurl.String())); nil == err {
+		t.Fatal("expect no match for api path")
+	}
+}
 
-	rules.Add("www.hao123.com", "s@^(http[s]?)://www.hao123.com/*/\\?.*$@$1://www.hao123.com/?tn=13087099_4_hao_pg@i")
-	rules.Add("www.baidu.com", "s@^(http[s]?)://www.baidu.com/*/s\\?(?:(.*)&)?(?:tn=[^&]*)(.*)$@$1://www.baidu.com/s?$2&tn=13087099_4_hao_pg$3@i")
+func TestURLMatchHost(t *testing.T) {
+	rules := newURLMatch(t,
+		compiler.JSONURLMatch{Host: "www.example.com", Url: "/api/"},
+		compiler.JSONURLMatch{Host: ".example.org", Url: "/"},
+	)
 
-	rules.Add("www.sogou.com", "s@^(http[s]?)://www.sogou.com/*/sogou\\?(?:(.*)&)?(?:pid=[^&]*)(.*)$@$1://www.sogou.com/sogou?$2&pid=sogou-netb-3be0214185d6177a-4012$3@i")
+	cases := []struct {
+		host  string
+		match bool
+	}{
+		{"www.example.com", true},
+		{"WWW.Example.COM", true},
+		{"example.com", false},
+		{"api.www.example.com", false},
+		{"example.org", true},
+		{"a.b.example.org", true},
+		{"example.org.cn", false},
+		{"other.com", false},
+	}
 
-	dsturl, err := rules.Replace("www.baidu.com", "http://www.baidu.com/s?word=dfgdfg&tn=10018800_hao_pg&ie=utf-8&ssl_sample=normal")
-	fmt.Printf("%s - %s\n", err, dsturl)
+	for _, c := range cases {
+		if c.match != rules.MatchHost(c.host) {
+			t.Fatalf("MatchHost(%s) = %v", c.host, false == c.match)
+		}
+	}
 
-	dsturl, err = rules.Replace("www.sogou.com", "http://www.sogou.com/sogou?query=dfgdfg&_asf=www.sogou.com&_ast=1452842311&w=&p=40040702&pid=sogou-netb-51be2fed6c55f5aa-7749%00&sut=935&sst0=1452842311151&lkt=6%2C1452842310216%2C1452842310489")
-	fmt.Printf("%s - %s\n", err, dsturl)
+	apiURL, _ := url.Parse("http://www.example.com/api/list")
+	pageURL, _ := url.Parse("http://www.example.com/index.html")
+	if false == rules.Match(apiURL) || rules.Match(pageURL) {
+		t.Fatal("expect Match to check url")
+	}
 
-	dsturl, err = rules.Replace("www.hao123.com", "http://www.hao123.com/?tn=130asd9_4_hao_pg")
-	fmt.Printf("%s - %s\n", err, dsturl)
+	if hosts := rules.Hosts(); false == reflect.DeepEqual([]string{".example.org", "www.example.com"}, hosts) {
+		t.Fatalf("hosts = %v", hosts)
+	}
 
-	dsturl, err = rules.Replace("www.hao123.com", "http://www.hao123.com/api/newforecast?callback=jQuery17208796808742918074_1452839147843&t=1&_=1452839148069")
-	fmt.Printf("%s - %s\n", err, dsturl)
+	global := newURLMatch(t, compiler.JSONURLMatch{Host: ".", Url: "/"})
+	if false == global.MatchHost("any.example.net") || false == reflect.DeepEqual([]string{"."}, global.Hosts()) {
+		t.Fatal("expect global rule to match any host")
+	}
 }
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ssoor/tracksocks/log"
+
+	"github.com/ssoor/tracksocks/redirect/proxy/compiler"
+)
+
+const (
+	DefaultBreakpointTimeout  = 60 * time.Second
+	DefaultBreakpointBodySize = 1 << 20
+)
+
+const (
+	BreakpointRequest  = "request"
+	BreakpointResponse = "response"
+)
+
+var (
+	ErrorBreakpointAborted  = errors.New("request aborted by breakpoint")
+	ErrorBreakpointNotFound = errors.New("breakpoint not found")
+	ErrorBreakpointNoStage  = errors.New("breakpoint must pause request or response")
+)
+
+type Breakpoint struct {
+	ID       uint64 `json:"id"`
+	Host     string `json:"host"`
+	URL      string `json:"url"`
+	Request  bool   `json:"request"`
+	Response bool   `json:"response"`
+
+	match *compiler.URLMatch
+}
+
+// PausedExchange 为断点处暂停的请求或响应
+type PausedExchange struct {
+	ID         uint64      `json:"id"`
+	RequestID  string      `json:"request_id"`
+	Breakpoint uint64      `json:"breakpoint"`
+	Stage      string      `json:"stage"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+	Editable   bool        `json:"editable"` // 内容超过限制或不是文本时不允许修改 body
+	Paused     time.Time   `json:"paused"`
+	Deadline   time.Time   `json:"deadline"`
+
+	resume chan BreakpointEdit
+}
+
+// BreakpointEdit 为操作人员对暂停内容的修改, 未设置的字段保持不变
+type BreakpointEdit struct {
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *string     `json:"body,omitempty"`
+	Abort  bool        `json:"abort,omitempty"`
+}
+
+type BreakpointManager struct {
+	mutex   sync.Mutex
+	nextID  uint64
+	timeout time.Duration
+
+	breakpoints []*Breakpoint
+	paused      map[uint64]*PausedExchange
+}
+
+var Breakpoints = NewBreakpointManager(DefaultBreakpointTimeout)
+
+func NewBreakpointManager(timeout time.Duration) *BreakpointManager {
+	return &BreakpointManager{
+		timeout:     timeout,
+		breakpoints: make([]*Breakpoint, 0),
+		paused:      make(map[uint64]*PausedExchange),
+	}
+}
+
+func (m *BreakpointManager) SetTimeout(timeout time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.timeout = timeout
+}
+
+func (m *BreakpointManager) Add(breakpoint Breakpoint) (Breakpoint, error) {
+	if false == breakpoint.Request && false == breakpoint.Response {
+		return breakpoint, ErrorBreakpointNoStage
+	}
+
+	breakpoint.Host = strings.ToLower(breakpoint.Host) // 匹配时请求的 host 已转换为小写
+	breakpoint.match = compiler.NewURLMatch()
+	if err := breakpoint.match.AddMatchs(compiler.JSONURLMatch{Host: breakpoint.Host, Url: breakpoint.URL}); nil != err {
+		return breakpoint, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nextID++
+	breakpoint.ID = m.nextID
+	m.breakpoints = append(m.breakpoints, &breakpoint)
+
+	log.Info("Add breakpoint", breakpoint.ID, fmt.Sprintf("%s(%s)", breakpoint.Host, breakpoint.URL), ", request:", breakpoint.Request, ", response:", breakpoint.Response)
+	return breakpoint, nil
+}
+
+func (m *BreakpointManager) Remove(id uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, breakpoint := range m.breakpoints {
+		if id == breakpoint.ID {
+			m.breakpoints = append(m.breakpoints[:i], m.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrorBreakpointNotFound
+}
+
+func (m *BreakpointManager) List() []Breakpoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	breakpoints := make([]Breakpoint, 0, len(m.breakpoints))
+	for _, breakpoint := range m.breakpoints {
+		breakpoints = append(breakpoints, *breakpoint)
+	}
+
+	return breakpoints
+}
+
+func (m *BreakpointManager) Paused() []PausedExchange {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	paused := make([]PausedExchange, 0, len(m.paused))
+	for _, exchange := range m.paused {
+		paused = append(paused, *exchange)
+	}
+
+	return paused
+}
+
+func (m *BreakpointManager) PausedExchange(id uint64) (PausedExchange, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if exchange, exist := m.paused[id]; exist {
+		return *exchange, true
+	}
+
+	return PausedExchange{}, false
+}
+
+// Resume 释放暂停的请求, edit 中设置的内容会替换原始内容
+func (m *BreakpointManager) Resume(id uint64, edit BreakpointEdit) error {
+	m.mutex.Lock()
+	exchange, exist := m.paused[id]
+	delete(m.paused, id)
+	m.mutex.Unlock()
+
+	if false == exist {
+		return ErrorBreakpointNotFound
+	}
+
+	exchange.resume <- edit
+	return nil
+}
+
+func (m *BreakpointManager) find(req *http.Request, stage string) *Breakpoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, breakpoint := range m.breakpoints {
+		if (BreakpointRequest == stage && false == breakpoint.Request) || (BreakpointResponse == stage && false == breakpoint.Response) {
+			continue
+		}
+
+		if breakpoint.match.Match(req.URL) {
+			return breakpoint
+		}
+	}
+
+	return nil
+}
+
+// readPausedBody 读取不超过限制的内容, 返回内容、可替代原始 body 的 body 以及内容是否完整
+func readPausedBody(body io.ReadCloser, header http.Header) (data []byte, restored io.ReadCloser, complete bool) {
+	if nil == body || http.NoBody == body {
+		return []byte{}, body, true
+	}
+
+	data, _ = ioutil.ReadAll(io.LimitReader(body, DefaultBreakpointBodySize+1))
+	if len(data) > DefaultBreakpointBodySize {
+		return data[:DefaultBreakpointBodySize], &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(data), body), Closer: body}, false
+	}
+	body.Close()
+
+	if strings.EqualFold(header.Get("Content-Encoding"), "gzip") { // 解压后再交给操作人员修改
+		if read, err := gzip.NewReader(bytes.NewReader(data)); nil == err {
+			if plain, err := ioutil.ReadAll(read); nil == err {
+				data = plain
+				header.Del("Content-Encoding")
+				header.Set("Content-Length", strconv.Itoa(len(data)))
+			}
+		}
+	}
+
+	if 0 == len(data) {
+		return data, http.NoBody, true
+	}
+
+	return data, ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// wait 暂停直到操作人员释放、超时或者客户端断开, 超时与断开时返回空修改
+func (m *BreakpointManager) wait(req *http.Request, exchange *PausedExchange) BreakpointEdit {
+	m.mutex.Lock()
+	m.nextID++
+	exchange.ID = m.nextID
+	exchange.Paused = time.Now()
+	exchange.Deadline = exchange.Paused.Add(m.timeout)
+	exchange.resume = make(chan BreakpointEdit, 1)
+	m.paused[exchange.ID] = exchange
+	timeout := m.timeout
+	m.mutex.Unlock()
+
+	pauseLog := requestLog(req).WithFields(log.Fields{"breakpoint": exchange.Breakpoint, "stage": exchange.Stage, "pause_id": exchange.ID})
+	pauseLog.Info("Breakpoint paused")
+
+	select {
+	case edit := <-exchange.resume:
+		return edit
+	case <-time.After(timeout):
+		pauseLog.Info("Breakpoint pause timeout, auto resume")
+	case <-req.Context().Done():
+	}
+
+	m.mutex.Lock()
+	delete(m.paused, exchange.ID)
+	m.mutex.Unlock()
+
+	select {
+	case edit := <-exchange.resume: // 超时的同时被释放
+		return edit
+	default:
+		return BreakpointEdit{}
+	}
+}
+
+// PauseRequest 在请求发往服务器前暂停
+func (m *BreakpointManager) PauseRequest(req *http.Request) (err error) {
+	breakpoint := m.find(req, BreakpointRequest)
+	if nil == breakpoint {
+		return nil
+	}
+
+	body, restored, complete := readPausedBody(req.Body, req.Header)
+	req.Body = restored
+	if complete { // 请求体可能已被解压
+		req.ContentLength = int64(len(body))
+	}
+
+	exchange := &PausedExchange{
+		RequestID:  RequestID(req.Context()),
+		Breakpoint: breakpoint.ID,
+		Stage:      BreakpointRequest,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Header:     req.Header.Clone(),
+		Body:       string(body),
+		Editable:   complete && utf8.Valid(body),
+	}
+
+	edit := m.wait(req, exchange)
+	if edit.Abort {
+		return ErrorBreakpointAborted
+	}
+
+	if "" != edit.Method {
+		req.Method = edit.Method
+	}
+	if "" != edit.URL {
+		var dsturl *url.URL
+		if dsturl, err = url.Parse(edit.URL); nil != err {
+			return err
+		}
+
+		req.URL = dsturl
+		req.Host = dsturl.Host
+	}
+	if nil != edit.Header {
+		req.Header = edit.Header
+	}
+
+	if exchange.Editable && nil != edit.Body {
+		req.Body = http.NoBody
+		req.ContentLength = int64(len(*edit.Body))
+
+		if 0 != req.ContentLength {
+			req.Body = ioutil.NopCloser(strings.NewReader(*edit.Body))
+		}
+	}
+
+	return nil
+}
+
+// PauseResponse 在响应返回给客户端前暂停
+func (m *BreakpointManager) PauseResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	breakpoint := m.find(req, BreakpointResponse)
+	if nil == breakpoint {
+		return resp, nil
+	}
+
+	body, restored, complete := readPausedBody(resp.Body, resp.Header)
+	resp.Body = restored
+
+	exchange := &PausedExchange{
+		RequestID:  RequestID(req.Context()),
+		Breakpoint: breakpoint.ID,
+		Stage:      BreakpointResponse,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Status:     resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       string(body),
+		Editable:   complete && utf8.Valid(body),
+	}
+
+	edit := m.wait(req, exchange)
+	if edit.Abort {
+		resp.Body.Close()
+		return resp, ErrorBreakpointAborted
+	}
+
+	if 0 != edit.Status {
+		resp.StatusCode = edit.Status
+		resp.Status = fmt.Sprint(edit.Status, " ", http.StatusText(edit.Status))
+	}
+	if nil != edit.Header {
+		resp.Header = edit.Header
+	}
+
+	if complete {
+		if exchange.Editable && nil != edit.Body {
+			body = []byte(*edit.Body)
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssoor/socks"
+)
+
+func waitPaused(t *testing.T, stage string) PausedExchange {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if paused := Breakpoints.Paused(); 1 == len(paused) && stage == paused[0].Stage {
+			return paused[0]
+		}
+	}
+
+	t.Fatalf("no %s paused", stage)
+	return PausedExchange{}
+}
+
+func TestBreakpointRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s xff=%s ae=%s body=%s", r.Method, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("Accept-Encoding"), body)
+	}))
+	defer server.Close()
+
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+	breakpoint, err := Breakpoints.Add(Breakpoint{Host: "LOCALHOST:" + port, URL: "/edit", Request: true, Response: true}) // host 不区分大小写
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer Breakpoints.Remove(breakpoint.ID)
+	defer Breakpoints.SetTimeout(DefaultBreakpointTimeout)
+
+	transport := NewHTTPTransport(socks.Direct, []byte(`{}`))
+	send := func(method string, path string, body string) chan string {
+		result := make(chan string, 1)
+		go func() {
+			req, _ := http.NewRequest(method, "http://localhost:"+port+path, strings.NewReader(body))
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+			resp, _ := transport.RoundTrip(req)
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			result <- fmt.Sprint(resp.StatusCode, " ", string(data))
+		}()
+
+		return result
+	}
+
+	result := send(http.MethodPost, "/edit", "original")
+
+	paused := waitPaused(t, BreakpointRequest)
+	if breakpoint.ID != paused.Breakpoint || "original" != paused.Body || false == paused.Editable {
+		t.Fatalf("paused request = %+v", paused)
+	}
+
+	if "" != paused.Header.Get("X-Forwarded-For") || "gzip" != paused.Header.Get("Accept-Encoding") { // 暂停前已完成头部处理
+		t.Fatalf("paused header = %v", paused.Header)
+	}
+
+	header := paused.Header.Clone()
+	header.Set("X-Forwarded-For", "operator")
+	header.Set("Accept-Encoding", "identity")
+	body := "edited"
+	if err = Breakpoints.Resume(paused.ID, BreakpointEdit{Method: http.MethodPut, Header: header, Body: &body}); nil != err {
+		t.Fatal(err)
+	}
+
+	paused = waitPaused(t, BreakpointResponse)
+	if http.StatusOK != paused.Status || "PUT /edit xff=operator ae=identity body=edited" != paused.Body {
+		t.Fatalf("paused response = %+v", paused)
+	}
+
+	body = "replaced"
+	Breakpoints.Resume(paused.ID, BreakpointEdit{Status: http.StatusCreated, Body: &body})
+	if r := <-result; "201 replaced" != r {
+		t.Fatalf("result = %s", r)
+	}
+
+	if ErrorBreakpointNotFound != Breakpoints.Resume(paused.ID, BreakpointEdit{}) {
+		t.Fatal("expect resumed exchange to be removed")
+	}
+
+	result = send(http.MethodPost, "/edit", "abort")
+	paused = waitPaused(t, BreakpointRequest)
+	Breakpoints.Resume(paused.ID, BreakpointEdit{Abort: true})
+	if r := <-result; false == strings.HasPrefix(r, "502 ") {
+		t.Fatalf("aborted result = %s", r)
+	}
+
+	if r := <-send(http.MethodPost, "/other", "direct"); "200 POST /other xff= ae=gzip body=direct" != r {
+		t.Fatalf("unmatched result = %s", r)
+	}
+
+	Breakpoints.SetTimeout(20 * time.Millisecond)
+	if r := <-send(http.MethodPost, "/edit", "timeout"); "200 POST /edit xff= ae=gzip body=timeout" != r { // 超时后按原样放行
+		t.Fatalf("timeout result = %s", r)
+	}
+
+	if paused := Breakpoints.Paused(); 0 != len(paused) {
+		t.Fatalf("paused = %+v", paused)
+	}
+}
@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssoor/tracksocks/log"
+
+	"github.com/ssoor/tracksocks/redirect/proxy/compiler"
+)
+
+const (
+	DefaultCaptureBodySize      = 1 << 20
+	DefaultCaptureEntries       = 1000
+	DefaultCaptureFiles         = 10
+	DefaultCaptureRotateSeconds = 60 * 60
+	DefaultCaptureFlushSeconds  = 5
+)
+
+var ErrorCaptureDirEmpty = errors.New("capture directory is empty")
+
+type CaptureSetting struct {
+	Dir           string                  `json:"dir"`
+	MaxBodySize   int64                   `json:"max_body_size"`
+	MaxEntries    int                     `json:"max_entries"`
+	MaxFiles      int                     `json:"max_files"`
+	RotateSeconds int                     `json:"rotate_seconds"`
+	Filters       []compiler.JSONURLMatch `json:"filters"` // 为空时记录全部请求
+}
+
+// Capturer 记录经过代理的请求及响应, 并以 HAR 文件形式保存
+type Capturer struct {
+	setting CaptureSetting
+	filter  *compiler.URLMatch
+
+	mutex    sync.Mutex
+	dirty    bool
+	created  time.Time
+	fileName string
+	entries  []HAREntry
+
+	done      chan struct{} // Close 时关闭, 停止定时保存
+	closeOnce sync.Once
+}
+
+func NewCapturer(setting CaptureSetting) (*Capturer, error) {
+	if "" == setting.Dir {
+		return nil, ErrorCaptureDirEmpty
+	}
+
+	if 0 >= setting.MaxBodySize {
+		setting.MaxBodySize = DefaultCaptureBodySize
+	}
+	if 0 >= setting.MaxEntries {
+		setting.MaxEntries = DefaultCaptureEntries
+	}
+	if 0 >= setting.MaxFiles {
+		setting.MaxFiles = DefaultCaptureFiles
+	}
+	if 0 >= setting.RotateSeconds {
+		setting.RotateSeconds = DefaultCaptureRotateSeconds
+	}
+
+	if err := os.MkdirAll(setting.Dir, 0755); nil != err {
+		return nil, err
+	}
+
+	capturer := &Capturer{setting: setting, done: make(chan struct{})}
+
+	if 0 != len(setting.Filters) {
+		capturer.filter = compiler.NewURLMatch()
+
+		for _, match := range setting.Filters {
+			if err := capturer.filter.AddMatchs(match); nil != err {
+				return nil, errors.New(fmt.Sprint("capture filter ", match.Host, "(", match.Url, ") invalid: ", err))
+			}
+		}
+	}
+
+	capturer.rotate()
+	go capturer.flushLoop()
+
+	return capturer, nil
+}
+
+func (c *Capturer) flushLoop() {
+	ticker := time.NewTicker(DefaultCaptureFlushSeconds * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.mutex.Lock()
+		if c.dirty {
+			c.save()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// rotate 调用方需持有 mutex
+func (c *Capturer) rotate() {
+	if 0 != len(c.entries) {
+		c.save()
+	}
+
+	c.created = time.Now()
+	c.entries = make([]HAREntry, 0)
+	c.fileName = filepath.Join(c.setting.Dir, "capture-"+c.created.Format("20060102-150405.000")+".har")
+
+	if files, err := filepath.Glob(filepath.Join(c.setting.Dir, "capture-*.har")); nil == err && len(files) >= c.setting.MaxFiles {
+		sort.Strings(files)
+
+		for _, file := range files[:len(files)-c.setting.MaxFiles+1] {
+			os.Remove(file)
+		}
+	}
+}
+
+// save 调用方需持有 mutex
+func (c *Capturer) save() {
+	c.dirty = false
+
+	data, err := json.MarshalIndent(HAR{
+		Log: HARLog{
+			Version: HARVersion,
+			Creator: HARCreator{Name: "tracksocks", Version: HARVersion},
+			Entries: c.entries,
+		},
+	}, "", "  ")
+	if nil != err {
+		log.Warning("Marshal capture file", c.fileName, "failed, err:", err)
+		return
+	}
+
+	if err = ioutil.WriteFile(c.fileName+".tmp", data, 0644); nil == err {
+		err = os.Rename(c.fileName+".tmp", c.fileName)
+	}
+
+	if nil != err {
+		log.Warning("Save capture file", c.fileName, "failed, err:", err)
+	}
+}
+
+func (c *Capturer) add(entry HAREntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= c.setting.MaxEntries || time.Since(c.created) > time.Duration(c.setting.RotateSeconds)*time.Second {
+		c.rotate()
+	}
+
+	c.dirty = true
+	c.entries = append(c.entries, entry)
+}
+
+// Close 停止定时保存并将尚未写入的记录保存到文件
+func (c *Capturer) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.save()
+	return nil
+}
+
+// Begin 开始记录一次请求, 请求不需要记录时返回 nil
+func (c *Capturer) Begin(req *http.Request) (*http.Request, *captureExchange) {
+	if nil != c.filter && false == c.filter.Match(req.URL) {
+		return req, nil
+	}
+
+	exchange := &captureExchange{
+		capturer: c,
+		started:  time.Now(),
+		url:      req.URL.String(),
+	}
+
+	exchange.entry.StartedDateTime = exchange.started
+	exchange.entry.Request = HARRequest{
+		Method:      req.Method,
+		URL:         exchange.url,
+		HTTPVersion: req.Proto,
+		Cookies:     harRequestCookies(req),
+		Headers:     harHeaders(req.Header),
+		QueryString: harQueryString(req.URL),
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+
+	if data := peekRequestBody(req, c.setting.MaxBodySize); nil != data {
+		mimeType := req.Header.Get("Content-Type")
+		postData := &HARPostData{MimeType: mimeType}
+		postData.Text, postData.Encoding = harBodyText(mimeType, data)
+		exchange.entry.Request.PostData = postData
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), exchange.clientTrace())), exchange
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// peekRequestBody 读取不超过 limit 字节的请求体, 并保证 req.Body 仍可完整读取
+func peekRequestBody(req *http.Request, limit int64) []byte {
+	if nil == req.Body || http.NoBody == req.Body {
+		return nil
+	}
+
+	data, _ := ioutil.ReadAll(io.LimitReader(req.Body, limit))
+	req.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(data), req.Body), Closer: req.Body}
+
+	return data
+}
+
+type captureExchange struct {
+	capturer *Capturer
+	entry    HAREntry
+	url      string
+
+	started       time.Time
+	dnsStart      time.Time
+	connectStart  time.Time
+	tlsStart      time.Time
+	wroteRequest  time.Time
+	firstByte     time.Time
+	responseStart time.Time
+
+	original       *captureBody
+	originalHeader http.Header
+}
+
+func (e *captureExchange) clientTrace() *httptrace.ClientTrace {
+	e.entry.Timings = HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { e.dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			e.entry.Timings.DNS = harMilliseconds(time.Since(e.dnsStart))
+		},
+		ConnectStart: func(string, string) { e.connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			e.entry.Timings.Connect = harMilliseconds(time.Since(e.connectStart))
+		},
+		TLSHandshakeStart: func() { e.tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			e.entry.Timings.SSL = harMilliseconds(time.Since(e.tlsStart))
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { e.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { e.firstByte = time.Now() },
+	}
+}
+
+// Upstream 记录规则改写前的原始响应, resp.Body 会被替换为记录用的 body
+func (e *captureExchange) Upstream(resp *http.Response) {
+	e.originalHeader = resp.Header.Clone()
+	e.original = newCaptureBody(resp.Body, e.capturer.setting.MaxBodySize, nil)
+
+	resp.Body = e.original
+}
+
+// Finish 记录最终返回给客户端的响应, 响应体读取完毕后写入 HAR 文件
+func (e *captureExchange) Finish(req *http.Request, resp *http.Response) *http.Response {
+	e.responseStart = time.Now()
+
+	if false == strings.EqualFold(e.url, req.URL.String()) {
+		e.entry.Rewrite = &HARRewrite{URL: req.URL.String()}
+	}
+
+	if nil != e.original && resp.Body != e.original { // 响应内容被规则改写
+		if nil == e.entry.Rewrite {
+			e.entry.Rewrite = &HARRewrite{}
+		}
+
+		e.entry.Rewrite.Response = &HARResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     harResponseCookies(&http.Response{Header: e.originalHeader}),
+			Headers:     harHeaders(e.originalHeader),
+			Content:     harContent(e.originalHeader, e.original.data.Bytes(), e.original.size, e.original.truncated),
+			HeadersSize: -1,
+			BodySize:    e.original.size,
+		}
+	}
+
+	e.entry.Response = HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     harResponseCookies(resp),
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+
+	if "" == e.entry.Response.HTTPVersion {
+		e.entry.Response.HTTPVersion = "HTTP/1.1"
+	}
+
+	header := resp.Header.Clone()
+	resp.Body = newCaptureBody(resp.Body, e.capturer.setting.MaxBodySize, func(body *captureBody) {
+		e.entry.Response.BodySize = body.size
+		e.entry.Response.Content = harContent(header, body.data.Bytes(), body.size, body.truncated)
+
+		e.finishTimings()
+		e.capturer.add(e.entry)
+	})
+
+	return resp
+}
+
+func (e *captureExchange) finishTimings() {
+	now := time.Now()
+
+	e.entry.Time = harMilliseconds(now.Sub(e.started))
+	e.entry.Timings.Receive = harMilliseconds(now.Sub(e.responseStart))
+
+	if e.wroteRequest.IsZero() { // 请求没有发往服务器, 例如跳转规则
+		e.entry.Timings.Wait = harMilliseconds(e.responseStart.Sub(e.started))
+		return
+	}
+
+	if false == e.firstByte.IsZero() {
+		e.entry.Timings.Wait = harMilliseconds(e.firstByte.Sub(e.wroteRequest))
+	}
+}
+
+// captureBody 在读取响应体的同时保存不超过 limit 字节的数据
+type captureBody struct {
+	body  io.ReadCloser
+	limit int64
+
+	size      int64
+	data      bytes.Buffer
+	truncated bool
+
+	once   sync.Once
+	finish func(*captureBody)
+}
+
+func newCaptureBody(body io.ReadCloser, limit int64, finish func(*captureBody)) *captureBody {
+	return &captureBody{body: body, limit: limit, finish: finish}
+}
+
+func (b *captureBody) done() {
+	if nil != b.finish {
+		b.once.Do(func() { b.finish(b) })
+	}
+}
+
+func (b *captureBody) Read(data []byte) (n int, err error) {
+	n, err = b.body.Read(data)
+
+	if 0 < n {
+		b.size += int64(n)
+
+		if remain := b.limit - int64(b.data.Len()); remain > 0 {
+			if int64(n) > remain {
+				b.truncated = true
+				b.data.Write(data[:remain])
+			} else {
+				b.data.Write(data[:n])
+			}
+		} else {
+			b.truncated = true
+		}
+	}
+
+	if io.EOF == err {
+		b.done()
+	}
+
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.body.Close()
+	b.done()
+
+	return err
+}
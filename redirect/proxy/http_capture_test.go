@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssoor/socks"
+	"github.com/ssoor/tracksocks/redirect/proxy/compiler"
+)
+
+func readHARFiles(t *testing.T, dir string) []HAR {
+	files, err := filepath.Glob(filepath.Join(dir, "capture-*.har"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	hars := make([]HAR, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		var har HAR
+		if err = json.Unmarshal(data, &har); nil != err {
+			t.Fatalf("%s: %v", file, err)
+		}
+		hars = append(hars, har)
+	}
+
+	return hars
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<p>hello</p>"))
+		case "/api":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(strings.Repeat("x", 200)))
+		}
+	}))
+	defer server.Close()
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("other")) }))
+	defer other.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	transport := NewHTTPTransport(socks.Direct, []byte(`{"limits":{"max_response_content_len":65536},"srules":[{"compilers":[
+		{"type":0,"host":"`+host+`","url":"/old","match":["s@/old@/page@i"]},
+		{"type":2,"host":"`+host+`","url":"/page","match":["s@hello@bye@i"]}]}]}`))
+
+	dir := t.TempDir()
+	capturer, err := NewCapturer(CaptureSetting{Dir: dir, MaxBodySize: 64, Filters: []compiler.JSONURLMatch{{Host: host, Url: "/"}}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	transport.Capture = capturer
+
+	send := func(method string, rawurl string, body string) string {
+		req, _ := http.NewRequest(method, rawurl, strings.NewReader(body))
+		if "" != body {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, _ := transport.RoundTrip(req)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(data)
+	}
+
+	if body := send(http.MethodGet, server.URL+"/old?q=1", ""); "<p>bye</p>" != body {
+		t.Fatalf("rewritten body = %q", body)
+	}
+	if body := send(http.MethodPost, server.URL+"/api", `{"a":1}`); `{"a":1}` != body {
+		t.Fatalf("api body = %q", body)
+	}
+	send(http.MethodGet, server.URL+"/big", "")
+	send(http.MethodGet, other.URL+"/", "") // 不符合过滤条件
+
+	capturer.Close()
+
+	hars := readHARFiles(t, dir)
+	if 1 != len(hars) {
+		t.Fatalf("files = %d", len(hars))
+	}
+
+	har := hars[0]
+	if HARVersion != har.Log.Version || "tracksocks" != har.Log.Creator.Name || 3 != len(har.Log.Entries) {
+		t.Fatalf("log = %+v", har.Log)
+	}
+
+	page := har.Log.Entries[0]
+	if server.URL+"/old?q=1" != page.Request.URL || 1 != len(page.Request.QueryString) || http.StatusOK != page.Response.Status {
+		t.Fatalf("page request = %+v", page.Request)
+	}
+
+	if nil == page.Rewrite || server.URL+"/page?q=1" != page.Rewrite.URL || nil == page.Rewrite.Response {
+		t.Fatalf("page rewrite = %+v", page.Rewrite)
+	}
+
+	if "<p>hello</p>" != page.Rewrite.Response.Content.Text || "<p>bye</p>" != page.Response.Content.Text { // 改写前及改写后的响应
+		t.Fatalf("page content = %q, original = %q", page.Response.Content.Text, page.Rewrite.Response.Content.Text)
+	}
+
+	api := har.Log.Entries[1]
+	if nil == api.Request.PostData || `{"a":1}` != api.Request.PostData.Text || "application/json" != api.Request.PostData.MimeType {
+		t.Fatalf("post data = %+v", api.Request.PostData)
+	}
+
+	if nil != api.Rewrite || `{"a":1}` != api.Response.Content.Text || "" != api.Response.Content.Encoding {
+		t.Fatalf("api entry = %+v", api)
+	}
+
+	big := har.Log.Entries[2]
+	if 200 != big.Response.BodySize || 64 != len(big.Response.Content.Text) || "body truncated" != big.Response.Content.Comment {
+		t.Fatalf("big content = %+v, body size = %d", big.Response.Content, big.Response.BodySize)
+	}
+
+	if 0 > big.Time || big.StartedDateTime.IsZero() || -1 != big.Request.HeadersSize {
+		t.Fatalf("big timings = %+v", big)
+	}
+}
+
+func TestCaptureRotate(t *testing.T) {
+	dir := t.TempDir()
+	capturer, err := NewCapturer(CaptureSetting{Dir: dir, MaxEntries: 2, MaxFiles: 2})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		capturer.add(HAREntry{Request: HARRequest{URL: "http://example.com/" + string(rune('a'+i))}})
+		time.Sleep(2 * time.Millisecond) // 文件名精确到毫秒
+	}
+	capturer.Close()
+
+	hars := readHARFiles(t, dir)
+	if 2 != len(hars) || 2 != len(hars[0].Log.Entries) || 1 != len(hars[1].Log.Entries) { // 最早的文件被删除
+		t.Fatalf("files = %+v", hars)
+	}
+
+	if "http://example.com/c" != hars[0].Log.Entries[0].Request.URL || "http://example.com/e" != hars[1].Log.Entries[0].Request.URL {
+		t.Fatalf("entries = %+v, %+v", hars[0].Log.Entries, hars[1].Log.Entries)
+	}
+
+	if _, err = NewCapturer(CaptureSetting{}); ErrorCaptureDirEmpty != err {
+		t.Fatalf("err = %v", err)
+	}
+
+	if _, err = NewCapturer(CaptureSetting{Dir: dir, Filters: []compiler.JSONURLMatch{{Host: "a.example.com", Url: "("}}}); nil == err {
+		t.Fatal("expect invalid filter error")
+	}
+}
+
+func TestHARContent(t *testing.T) {
+	binary := harContent(http.Header{"Content-Type": {"image/png"}}, []byte{0x89, 'P', 'N', 'G'}, 4, false)
+	if "base64" != binary.Encoding || "iVBORw==" != binary.Text {
+		t.Fatalf("binary = %+v", binary)
+	}
+
+	query, _ := url.Parse("http://example.com/?a=1&a=2")
+	if values := harQueryString(query); 2 != len(values) {
+		t.Fatalf("query = %+v", values)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// 旧加密协议(兼容模式, 见 SetEncodeAuth)的分帧格式, ECipherConn 负责解码, Encoder 负责编码.
+//
+// 连接的第一个字节不是操作码时, 整个连接按明文转发. 否则连接由连续的数据帧组成:
+//
+//	opcode(1) | length(2, 大端) | check(1) | payload(length)
+//
+//	check   = opcode ^ (length[0] + length[1])  (按字节溢出相加)
+//	payload = 原始数据按字节异或 check|0x80
+//
+// 解码后的数据为操作码对应的方法前缀(EncodeMethodPrefix, HanderBinary 没有前缀)加上 payload.
+// check 校验失败时帧头按明文输出, 之后的数据不再解码. 数据帧之后出现非操作码字节时, 之后的数据同样按明文转发.
+
+const EncodeCheckMask = 0x80
+
+var ErrorEncodeFrameSize = errors.New("encode frame payload is too large")
+
+// EncodeMethodPrefix 为操作码解码后在数据前补充的 HTTP 方法前缀, 固定为 MaxHeaderSize 字节
+var EncodeMethodPrefix = map[byte][MaxHeaderSize]byte{
+	HeaderGet:     {'G', 'E', 'T', ' '},
+	HeaderPost:    {'P', 'O', 'S', 'T'},
+	HeaderConnect: {'C', 'O', 'N', 'N'},
+	HeaderPut:     {'P', 'U', 'T', ' '},
+	HeaderHead:    {'H', 'E', 'A', 'D'},
+	HanderTrace:   {'T', 'R', 'A', 'C'},
+	HanderDelect:  {'D', 'E', 'L', 'E'},
+}
+
+// encodeCheck 返回帧头的校验字节
+func encodeCheck(opcode byte, size uint16) byte {
+	return opcode ^ (byte(size>>8) + byte(size))
+}
+
+// AppendEncodeFrame 将一个数据帧追加到 dst, payload 不包含操作码对应的方法前缀
+func AppendEncodeFrame(dst []byte, opcode byte, payload []byte) ([]byte, error) {
+	if len(payload) > int(MaxEncodeSize) {
+		return dst, ErrorEncodeFrameSize
+	}
+
+	var header [MaxHeaderSize]byte
+	header[0] = opcode
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(payload)))
+	header[3] = encodeCheck(opcode, uint16(len(payload)))
+
+	dst = append(dst, header[:]...)
+	for _, b := range payload {
+		dst = append(dst, b^(header[3]|EncodeCheckMask))
+	}
+
+	return dst, nil
+}
+
+// Encoder 将写入的数据编码为 ECipherConn 可以解码的数据帧
+type Encoder struct {
+	w     io.Writer
+	frame []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// WriteFrame 写入一个数据帧
+func (e *Encoder) WriteFrame(opcode byte, payload []byte) (err error) {
+	if e.frame, err = AppendEncodeFrame(e.frame[:0], opcode, payload); nil != err {
+		return err
+	}
+
+	_, err = e.w.Write(e.frame)
+	return err
+}
+
+// Write 以 HTTP 方法开头的数据使用对应的操作码, 其余数据使用 HanderBinary, 超过 MaxEncodeSize 时拆分为多个数据帧
+func (e *Encoder) Write(data []byte) (n int, err error) {
+	for 0 < len(data) {
+		opcode, prefixSize := byte(HanderBinary), 0
+		for code, prefix := range EncodeMethodPrefix {
+			if bytes.HasPrefix(data, prefix[:]) {
+				opcode, prefixSize = code, len(prefix)
+				break
+			}
+		}
+
+		payload := data[prefixSize:]
+		if len(payload) > int(MaxEncodeSize) {
+			payload = payload[:MaxEncodeSize]
+		}
+
+		if err = e.WriteFrame(opcode, payload); nil != err {
+			return n, err
+		}
+
+		n += prefixSize + len(payload)
+		data = data[prefixSize+len(payload):]
+	}
+
+	return n, nil
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+type readOnlyRWC struct {
+	io.Reader
+}
+
+func (readOnlyRWC) Write(b []byte) (int, error) { return len(b), nil }
+func (readOnlyRWC) Close() error                { return nil }
+
+// decodeAll 使用 bufSize 大小的缓冲区读取 ECipherConn 直到出错
+func decodeAll(t testing.TB, data []byte, bufSize int) []byte {
+	conn := &ECipherConn{rwc: readOnlyRWC{bytes.NewReader(data)}}
+
+	var out []byte
+	buf := make([]byte, bufSize)
+	for reads := 0; ; reads++ {
+		if reads > 4*len(data)+16 {
+			t.Fatalf("reader does not terminate on %d bytes of input", len(data))
+		}
+
+		n, err := conn.Read(buf)
+		out = append(out, buf[:n]...)
+		if nil != err {
+			return out
+		}
+	}
+}
+
+func encodeAll(t testing.TB, chunks [][]byte) ([]byte, []byte) {
+	var encoded bytes.Buffer
+	var plain []byte
+
+	encoder := NewEncoder(&encoded)
+	for _, chunk := range chunks {
+		if _, err := encoder.Write(chunk); nil != err {
+			t.Fatal(err)
+		}
+		plain = append(plain, chunk...)
+	}
+
+	return encoded.Bytes(), plain
+}
+
+func TestAppendEncodeFrame(t *testing.T) {
+	frame, err := AppendEncodeFrame(nil, HeaderGet, []byte("/a"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	check := byte(HeaderGet ^ (0 + 2))
+	expect := []byte{HeaderGet, 0x00, 0x02, check, '/' ^ (check | EncodeCheckMask), 'a' ^ (check | EncodeCheckMask)}
+	if false == bytes.Equal(frame, expect) {
+		t.Fatalf("frame = % x, want % x", frame, expect)
+	}
+
+	if out := decodeAll(t, frame, 16); "GET /a" != string(out) {
+		t.Fatalf("decoded = %q", out)
+	}
+
+	if _, err = AppendEncodeFrame(nil, HanderBinary, make([]byte, int(MaxEncodeSize)+1)); ErrorEncodeFrameSize != err {
+		t.Fatalf("oversize payload err = %v", err)
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	prefixes := []string{"", "GET ", "POST", "CONNECT", "PUT ", "HEAD", "TRACE", "DELETE"}
+
+	roundTrip := func(seed int64) bool {
+		random := rand.New(rand.NewSource(seed))
+
+		chunks := make([][]byte, random.Intn(8))
+		for i := range chunks {
+			chunk := []byte(prefixes[random.Intn(len(prefixes))])
+			body := make([]byte, random.Intn(3*int(MaxEncodeSize)/2))
+			random.Read(body)
+			chunks[i] = append(chunk, body...)
+		}
+
+		encoded, plain := encodeAll(t, chunks)
+		return bytes.Equal(plain, decodeAll(t, encoded, 1+random.Intn(0x2000)))
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 50}); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestECipherConnPlaintext(t *testing.T) {
+	plain := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if out := decodeAll(t, plain, 7); false == bytes.Equal(out, plain) {
+		t.Fatalf("decoded = %q", out)
+	}
+}
+
+func TestECipherConnMixed(t *testing.T) {
+	encoded, plain := encodeAll(t, [][]byte{[]byte("POST /upload HTTP/1.1\r\n"), []byte("\x00\x01binary")})
+	tail := []byte("plain text after frames")
+
+	out := decodeAll(t, append(encoded, tail...), 5)
+	if expect := append(plain, tail...); false == bytes.Equal(out, expect) {
+		t.Fatalf("decoded = %q, want %q", out, expect)
+	}
+}
+
+func TestECipherConnBadCheck(t *testing.T) {
+	stream := []byte{HeaderGet, 0x00, 0x02, 0x00, 'h', 'i'}
+	if out := decodeAll(t, stream, 16); false == bytes.Equal(out, stream) {
+		t.Fatalf("decoded = % x, want the stream unchanged", out)
+	}
+}
+
+func TestECipherConnTruncated(t *testing.T) {
+	encoded, plain := encodeAll(t, [][]byte{[]byte("GET /index.html HTTP/1.1\r\n"), []byte("body"), []byte("HEAD / HTTP/1.1\r\n")})
+
+	for i := 0; i <= len(encoded); i++ {
+		if out := decodeAll(t, encoded[:i], 3); false == bytes.HasPrefix(plain, out) {
+			t.Fatalf("truncated at %d: decoded %q is not a prefix of %q", i, out, plain)
+		}
+	}
+}
+
+func TestECipherConnOversizeLength(t *testing.T) {
+	// 长度为最大值但数据不足时只输出已读取的数据
+	check := encodeCheck(HanderBinary, MaxEncodeSize)
+	stream := []byte{HanderBinary, 0xFF, 0xFF, check, 'x' ^ (check | EncodeCheckMask)}
+
+	if out := decodeAll(t, stream, 4); "x" != string(out) {
+		t.Fatalf("decoded = %q", out)
+	}
+}
+
+// chunkRWC 每次 Read 返回一个数据块, 没有数据块时阻塞, 模拟网络连接
+type chunkRWC struct {
+	readOnlyRWC
+	chunks chan []byte
+}
+
+func (c chunkRWC) Read(b []byte) (int, error) {
+	chunk, ok := <-c.chunks
+	if false == ok {
+		return 0, io.EOF
+	}
+
+	return copy(b, chunk), nil
+}
+
+func TestECipherConnPartialHeader(t *testing.T) {
+	first, _ := AppendEncodeFrame(nil, HanderBinary, []byte("first"))
+	second, _ := AppendEncodeFrame(nil, HanderBinary, []byte("second"))
+
+	rwc := chunkRWC{chunks: make(chan []byte, 2)}
+	conn := &ECipherConn{rwc: rwc}
+
+	rwc.chunks <- append(first, second[:2]...) // 第二个帧头只到达一部分
+
+	type result struct {
+		data string
+		err  error
+	}
+	read := func() chan result {
+		done := make(chan result, 1)
+		go func() {
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			done <- result{string(buf[:n]), err}
+		}()
+		return done
+	}
+
+	select {
+	case r := <-read():
+		if "first" != r.data || nil != r.err {
+			t.Fatalf("first = %q, err = %v", r.data, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read blocked on partial header after decoding data")
+	}
+
+	rwc.chunks <- second[2:]
+	if r := <-read(); "second" != r.data || nil != r.err {
+		t.Fatalf("second = %q, err = %v", r.data, r.err)
+	}
+}
+
+func FuzzECipherConnRead(f *testing.F) {
+	encoded, _ := encodeAll(f, [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n"), []byte("\xff\xfe")})
+	f.Add(encoded, uint16(7))
+	f.Add(encoded[:5], uint16(1))
+	f.Add([]byte("GET / HTTP/1.1\r\n\r\n"), uint16(64))
+	f.Add([]byte{HanderBinary, 0xFF, 0xFF, encodeCheck(HanderBinary, MaxEncodeSize)}, uint16(3))
+	f.Add(append(encoded, "trailing plaintext"...), uint16(2))
+
+	f.Fuzz(func(t *testing.T, data []byte, bufSize uint16) {
+		out := decodeAll(t, data, 1+int(bufSize)%0x1000)
+		if len(out) > len(data) { // 帧头与方法前缀长度相同, 解码后的数据不会超过输入
+			t.Fatalf("decoded %d bytes from %d bytes of input", len(out), len(data))
+		}
+	})
+}
+
+func FuzzEncoderRoundTrip(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\n\r\n"), []byte("POST"), uint16(3))
+	f.Add([]byte{}, []byte("\x00\x01"), uint16(1))
+
+	f.Fuzz(func(t *testing.T, first []byte, second []byte, bufSize uint16) {
+		encoded, plain := encodeAll(t, [][]byte{first, second})
+		if out := decodeAll(t, encoded, 1+int(bufSize)%0x1000); false == bytes.Equal(out, plain) {
+			t.Fatalf("decoded %q, want %q", out, plain)
+		}
+	})
+}
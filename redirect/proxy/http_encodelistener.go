@@ -1,231 +1,365 @@
 package proxy
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/encode"
+	"github.com/ssoor/tracksocks/log"
 )
 
 const MaxHeaderSize = 4
 const MaxBufferSize = 0x1000
 const MaxEncodeSize = uint16(0xFFFF)
 
+// encodeAuth 为加密端口的认证设置, 需要在启动监听前通过 SetEncodeAuth 设置
+var encodeAuth struct {
+	key    []byte
+	legacy bool
+}
+
+// SetEncodeAuth 设置加密端口的共享密钥, legacy 为 true 时同时接受旧的异或协议
+func SetEncodeAuth(key []byte, legacy bool) {
+	encodeAuth.key, encodeAuth.legacy = key, legacy
+}
+
 // NewHTTPLPProxy constructs one HTTPLPProxy
 func NewEncodeListener(addr string) (*LPListener,error) {
+	if 0 == len(encodeAuth.key) && false == encodeAuth.legacy {
+		return nil, errors.New("encode key is not set")
+	}
+
 	ln, err := net.Listen("tcp", addr)
 	if  nil != err{
 		return nil, err
 	}
 
-	return &LPListener{listener: ln}, nil
+	return &LPListener{listener: ln, key: encodeAuth.key, legacy: encodeAuth.legacy}, nil
 }
 
+// encodeServerConn 根据连接的第一个字节选择协议, 协议版本字节使用认证通道, 其余字节只在兼容模式下按旧协议处理
+type encodeServerConn struct {
+	net.Conn
+	key    []byte
+	legacy bool
+
+	once sync.Once
+	conn net.Conn
+	err  error
+}
+
+func (c *encodeServerConn) negotiate() error {
+	c.once.Do(func() {
+		client := &bufferedConn{Conn: c.Conn, reader: bufio.NewReader(c.Conn)}
+
+		first, err := client.reader.Peek(1)
+		if nil != err {
+			c.err = err
+			return
+		}
+
+		fields := log.Fields{"client": c.Conn.RemoteAddr().String()}
+		switch {
+		case encode.Version == first[0] && 0 != len(c.key):
+			server := encode.Server(client, c.key)
+			if c.err = server.Handshake(); nil != c.err {
+				fields["error"] = c.err
+				log.WithFields(fields).Warning("Encode handshake failed")
+				metricEncodeConnections.Add(1, "failed")
+				return
+			}
+
+			c.conn = server
+			metricEncodeConnections.Add(1, "auth")
+		case c.legacy:
+			c.conn = &ECipherConn{Conn: c.Conn, rwc: client}
+			metricEncodeConnections.Add(1, "legacy")
+		default:
+			c.err = encode.ErrorVersion
+			fields["version"] = first[0]
+			log.WithFields(fields).Warning("Reject encode connection with unsupported protocol")
+			metricEncodeConnections.Add(1, "rejected")
+		}
+	})
+
+	return c.err
+}
+
+func (c *encodeServerConn) Read(data []byte) (int, error) {
+	if err := c.negotiate(); nil != err {
+		return 0, err
+	}
+
+	return c.conn.Read(data)
+}
+
+func (c *encodeServerConn) Write(data []byte) (int, error) {
+	if err := c.negotiate(); nil != err {
+		return 0, err
+	}
+
+	return c.conn.Write(data)
+}
+
+// encodeScratchPool 为读取底层连接使用的临时缓冲区, 帧头与数据可以在一次系统调用中读取
+var encodeScratchPool = sync.Pool{
+	New: func() interface{} {
+		scratch := make([]byte, MaxBufferSize)
+		return &scratch
+	},
+}
+
+const (
+	encodeStateHeader  = iota // 等待数据帧帧头, 第一个字节不是操作码时转为明文转发
+	encodeStatePayload        // 正在解码数据帧
+	encodeStatePass           // 明文转发
+)
+
+// maxEmptyReads 为底层连接连续返回 (0, nil) 的最大次数, 超过后返回 io.ErrNoProgress
+const maxEmptyReads = 100
+
+// ECipherConn 解码旧加密协议(格式见 http_encodeframe.go), 数据直接在调用方的缓冲区中解码
 type ECipherConn struct {
 	net.Conn
 	rwc io.ReadWriteCloser
 
-	isPass     bool
-	beforeSend []byte
-
-	decodeSize int
+	state      int
+	decodeSize int // 当前数据帧剩余未解码的长度
 	decodeCode byte
+
+	headSize   int // headBuffer 中已读取的帧头长度
 	headBuffer [MaxHeaderSize]byte
+
+	pending     [MaxHeaderSize]byte // 等待输出的方法前缀或明文帧头
+	pendingHead int
+	pendingTail int
+
+	scratch  *[]byte
+	buffered []byte // scratch 中尚未处理的数据
+	readErr  error  // 读取 scratch 时与数据一起返回的错误, 数据处理完后返回
+
+	prefixLogged bool // 旧的方法前缀操作码只在每个连接第一次出现时记录
 }
 
 func (this *ECipherConn) getEncodeSize(encodeHeader []byte) (int, error) {
 	if encodeHeader[3] != (encodeHeader[0] ^ (encodeHeader[1] + encodeHeader[2])) {
-		return 0, errors.New(fmt.Sprint("encryption header information check fails: ", encodeHeader[3], ",Unexpected value: ", (encodeHeader[0] ^ encodeHeader[1] + encodeHeader[2])))
+		return 0, errors.New(fmt.Sprint("encryption header information check fails: ", encodeHeader[3], ",Unexpected value: ", (encodeHeader[0] ^ (encodeHeader[1] + encodeHeader[2]))))
 	}
 
 	return int(binary.BigEndian.Uint16(encodeHeader[1:3])), nil
 }
 
-func (econn *ECipherConn) Read(data []byte) (lenght int, err error) {
-
-	if 0 != len(econn.beforeSend) { // 发送缓冲区中的数据
-		bufSize := len(data)
+// Read 至少返回一个字节或一个错误, 已有数据时只继续处理已缓冲的数据, 不再阻塞读取
+func (econn *ECipherConn) Read(data []byte) (n int, err error) {
+	if 0 == len(data) {
+		return 0, nil
+	}
 
-		if bufSize > len(econn.beforeSend) {
-			bufSize = len(econn.beforeSend)
+	for n < len(data) {
+		if econn.pendingHead < econn.pendingTail {
+			copied := copy(data[n:], econn.pending[econn.pendingHead:econn.pendingTail])
+			econn.pendingHead += copied
+			n += copied
+			continue
 		}
 
-		err = nil
-		lenght = copy(data, econn.beforeSend[:bufSize])
+		if 0 < n && 0 == len(econn.buffered) {
+			break
+		}
 
-		econn.beforeSend = econn.beforeSend[bufSize:]
+		var read int
+		switch econn.state {
+		case encodeStatePass:
+			read, err = econn.readRaw(data[n:])
+		case encodeStatePayload:
+			read, err = econn.readPayload(data[n:])
+		default:
+			err = econn.readHeader(0 == n)
+		}
 
-		//log.Info(string(data[:lenght]))
-		//log.Info("Socksd header data is ", string(data[:lenght]))
-		return
+		if n += read; nil != err {
+			return n, err
+		}
 	}
 
-	if econn.isPass { // 后续数据不用解密 ,直接调用原始函数 - isPass 由 readDecodeHeader() 函数设置
-		lenght, err = econn.rwc.Read(data)
+	return n, nil
+}
+
+func (econn *ECipherConn) setPending(data []byte) {
+	econn.pendingHead, econn.pendingTail = 0, copy(econn.pending[:], data)
+}
 
-		if 0 != lenght && data[0] >= 'A' && data[0] <= 'z' {
-			//log.Warning(string(data[:lenght]))
+// readHeader 读取数据帧帧头, 不完整的帧头在连接结束时被丢弃.
+// wait 为 false 时已缓冲的数据不足一个帧头就返回, 已读取的部分保留到下一次调用
+func (econn *ECipherConn) readHeader(wait bool) error {
+	if 0 == econn.headSize {
+		if _, err := econn.readRaw(econn.headBuffer[:1]); nil != err {
+			return err
 		}
-		return
-	}
 
-	if 0 == econn.decodeSize { // 当前需要解密的数据为0，准备接受下一个加密头
-		return econn.readDecodeHeader(data)
-	}
+		econn.headSize = 1
+		if false == econn.isDecodeHeader(econn.headBuffer[0]) { // 不是加密数据, 之后的数据直接放过
+			econn.headSize = 0
+			econn.state = encodeStatePass
+			econn.setPending(econn.headBuffer[:1])
 
-	///////////////////////////////////////////////////////////////////////////////////////////
-	//
+			if econn.headBuffer[0] >= 'A' && econn.headBuffer[0] <= 'z' {
+				log.Debug("Socket decode check failed, current encode type is", econn.headBuffer[0])
+			}
+			return nil
+		}
+	}
 
-	econn.beforeSend = make([]byte, econn.decodeSize)
-	if lenght, err = io.ReadFull(econn.rwc, econn.beforeSend); nil != err { // 检测数据包是否为加密包或者有效的 HTTP 包
-		if io.ErrUnexpectedEOF == err {
-			err = io.EOF
+	for econn.headSize < MaxHeaderSize {
+		if false == wait && 0 == len(econn.buffered) {
+			return nil
 		}
 
-		if io.EOF != err {
-			log.Warning("Socket full reading failed, current read data size:", lenght, ", need read size:", econn.decodeSize, " err is:", err)
+		read, err := econn.readRaw(econn.headBuffer[econn.headSize:])
+		if econn.headSize += read; nil != err {
+			return err
 		}
+	}
 
+	econn.headSize = 0
+
+	size, err := econn.getEncodeSize(econn.headBuffer[:])
+	if nil != err { // 帧头按明文发送, 之后的数据不再解密
+		econn.state = encodeStatePass
+		econn.setPending(econn.headBuffer[:])
+		return nil
 	}
 
-	for i := 0; i < len(econn.beforeSend); i++ { // econn.decodeSize
-		econn.beforeSend[i] ^= econn.decodeCode | 0x80
+	if prefix, exist := EncodeMethodPrefix[econn.headBuffer[0]]; exist {
+		econn.setPending(prefix[:])
+
+		if false == econn.prefixLogged {
+			econn.prefixLogged = true
+			log.Debug("Old socksd encode type:", econn.headBuffer[0], ", encode len: ", size)
+		}
 	}
 
-	econn.decodeSize = 0
+	econn.decodeSize = size
+	econn.decodeCode = econn.headBuffer[3] | EncodeCheckMask
+	if 0 != size {
+		econn.state = encodeStatePayload
+	}
 
-	return 0, nil
+	return nil
 }
 
-// 加密类型
-const (
-	HeaderGet     = 0xCD
-	HeaderPost    = 0xDC
-	HeaderConnect = 0x00
-
-	HeaderPut    = 0xF0
-	HeaderHead   = 0xF1
-	HanderTrace  = 0xF2
-	HanderDelect = 0xF3
+// readPayload 将数据帧读取到 data 中并原地解码
+func (econn *ECipherConn) readPayload(data []byte) (int, error) {
+	if len(data) > econn.decodeSize {
+		data = data[:econn.decodeSize]
+	}
 
-	HanderBinary = 0xFF
-)
+	read, err := econn.readRaw(data)
+	for i := 0; i < read; i++ {
+		data[i] ^= econn.decodeCode
+	}
 
-func (econn *ECipherConn) isDecodeHeader(data byte) bool {
-	switch data {
-	case HeaderGet: // GET
-	case HeaderPost: // POST
-	case HeaderConnect: // CONNNECT
-	case HeaderPut: // PUT
-	case HeaderHead: // HEAD
-	case HanderTrace: // TRACE
-	case HanderDelect: // DELECT
-	case HanderBinary:
-	default:
-		return false
+	if econn.decodeSize -= read; 0 == econn.decodeSize {
+		econn.state = encodeStateHeader
 	}
 
-	return true
+	return read, err
 }
 
-func (this *ECipherConn) readDecodeHeader(data []byte) (lenght int, err error) {
-	this.headBuffer[0] = 0
-	this.headBuffer[1] = 0
-	this.headBuffer[2] = 0
-	this.headBuffer[3] = 0
+// readRaw 从底层连接读取数据, 大于临时缓冲区的读取直接使用调用方的缓冲区
+func (econn *ECipherConn) readRaw(data []byte) (int, error) {
+	if 0 == len(econn.buffered) {
+		if nil != econn.readErr {
+			return 0, econn.readErr
+		}
 
-	if lenght, err = this.rwc.Read(this.headBuffer[:1]); 1 != lenght {
-		return
-	}
+		if len(data) >= MaxBufferSize {
+			for i := 0; i < maxEmptyReads; i++ {
+				if read, err := econn.rwc.Read(data); 0 != read || nil != err {
+					return read, err
+				}
+			}
 
-	this.isPass = true // 一个新的数据包,默认不需要解密，直接放过
-	if false == this.isDecodeHeader(this.headBuffer[0]) {
-		this.beforeSend = this.headBuffer[:1] // 数据需要发送
+			return 0, io.ErrNoProgress
+		}
 
-		if this.headBuffer[0] >= 'A' && this.headBuffer[0] <= 'z' {
-			log.Warning("Socket decode check failed, current encode type is", this.headBuffer[0])
+		if err := econn.fill(); nil != err {
+			return 0, err
 		}
-		return 0, nil
 	}
 
-	///////////////////////////////////////////////////////////////////////////////////////////
-	//
+	read := copy(data, econn.buffered)
+	if econn.buffered = econn.buffered[read:]; 0 == len(econn.buffered) {
+		econn.releaseScratch()
+	}
 
-	if lenght, err = io.ReadFull(this.rwc, this.headBuffer[1:]); nil != err { // 检测数据包是否为加密包或者有效的 HTTP 包
-		if io.ErrUnexpectedEOF == err {
-			err = io.EOF
+	return read, nil
+}
+
+func (econn *ECipherConn) fill() error {
+	if nil == econn.scratch {
+		econn.scratch = encodeScratchPool.Get().(*[]byte)
+	}
+
+	for i := 0; i < maxEmptyReads; i++ {
+		read, err := econn.rwc.Read(*econn.scratch)
+		econn.buffered, econn.readErr = (*econn.scratch)[:read], err
+
+		if 0 != read {
+			return nil
 		}
 
-		if io.EOF == err {
-			this.isPass = false
-		} else {
-			log.Warning("Socket full reading failed, current read data:", string(this.headBuffer[:1+lenght]), "(", 1+lenght, "), need read size:", MaxHeaderSize, " err is:", err)
+		if nil != err {
+			econn.releaseScratch()
+			return err
 		}
-		return copy(data, this.headBuffer[:lenght]), err
 	}
 
-	this.beforeSend = this.headBuffer[:MaxHeaderSize] // make([]byte, MaxHeaderSize) // 数据需要发送
+	econn.releaseScratch()
+	return io.ErrNoProgress
+}
 
-	if lenght, err = this.getEncodeSize(this.headBuffer[:MaxHeaderSize]); nil != err || lenght > int(MaxEncodeSize) {
-		return copy(data, this.headBuffer[:MaxHeaderSize]), nil
+func (econn *ECipherConn) releaseScratch() {
+	if nil != econn.scratch {
+		encodeScratchPool.Put(econn.scratch)
+		econn.scratch, econn.buffered = nil, nil
 	}
+}
+
+// 加密类型
+const (
+	HeaderGet     = 0xCD
+	HeaderPost    = 0xDC
+	HeaderConnect = 0x00
+
+	HeaderPut    = 0xF0
+	HeaderHead   = 0xF1
+	HanderTrace  = 0xF2
+	HanderDelect = 0xF3
 
-	this.isPass = false // 数据需要解密
-	this.decodeSize = lenght
-	this.decodeCode = this.headBuffer[3]
+	HanderBinary = 0xFF
+)
 
-	switch this.headBuffer[0] {
+func (econn *ECipherConn) isDecodeHeader(data byte) bool {
+	switch data {
 	case HeaderGet: // GET
-		this.beforeSend[0] = 'G'
-		this.beforeSend[1] = 'E'
-		this.beforeSend[2] = 'T'
-		this.beforeSend[3] = ' '
 	case HeaderPost: // POST
-		this.beforeSend[0] = 'P'
-		this.beforeSend[1] = 'O'
-		this.beforeSend[2] = 'S'
-		this.beforeSend[3] = 'T'
 	case HeaderConnect: // CONNNECT
-		this.beforeSend[0] = 'C'
-		this.beforeSend[1] = 'O'
-		this.beforeSend[2] = 'N'
-		this.beforeSend[3] = 'N'
 	case HeaderPut: // PUT
-		this.beforeSend[0] = 'P'
-		this.beforeSend[1] = 'U'
-		this.beforeSend[2] = 'T'
-		this.beforeSend[3] = ' '
 	case HeaderHead: // HEAD
-		this.beforeSend[0] = 'H'
-		this.beforeSend[1] = 'E'
-		this.beforeSend[2] = 'A'
-		this.beforeSend[3] = 'D'
 	case HanderTrace: // TRACE
-		this.beforeSend[0] = 'T'
-		this.beforeSend[1] = 'R'
-		this.beforeSend[2] = 'A'
-		this.beforeSend[3] = 'C'
 	case HanderDelect: // DELECT
-		this.beforeSend[0] = 'D'
-		this.beforeSend[1] = 'E'
-		this.beforeSend[2] = 'L'
-		this.beforeSend[3] = 'E'
 	case HanderBinary:
-		this.beforeSend = nil
 	default:
-		log.Warning("Unknown socksd encode type:", this.headBuffer[0], ", encode len: ", this.decodeSize, "\n")
-	}
-
-	if nil != this.beforeSend {
-		log.Warning("Old socksd encode type:", this.headBuffer[0], ", encode len: ", this.decodeSize, "\n")
+		return false
 	}
 
-	//log.Infof("Socksd encode code: % 5d , encode len: %d\n", this.decodeCode, this.decodeSize)
-
-	return 0, nil
+	return true
 }
 
 func (c *ECipherConn) Write(data []byte) (int, error) {
@@ -240,6 +374,8 @@ func (c *ECipherConn) Close() error {
 
 type LPListener struct {
 	listener net.Listener
+	key      []byte
+	legacy   bool
 }
 
 func (this *LPListener) Accept() (c net.Conn, err error) {
@@ -249,13 +385,7 @@ func (this *LPListener) Accept() (c net.Conn, err error) {
 		return nil, err
 	}
 
-	return &ECipherConn{
-		Conn: conn,
-		rwc:  conn,
-
-		isPass:     false,
-		beforeSend: nil,
-	}, nil
+	return &encodeServerConn{Conn: conn, key: this.key, legacy: this.legacy}, nil
 }
 
 func (this *LPListener) Close() error {
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/ssoor/tracksocks/encode"
+)
+
+// copyingECipherConn 为改进前的解码实现, 每个数据帧分配新的缓冲区并在两次 Read 之间复制, 只用于基准测试对比
+type copyingECipherConn struct {
+	rwc io.Reader
+
+	isPass     bool
+	beforeSend []byte
+
+	decodeSize int
+	decodeCode byte
+	headBuffer [MaxHeaderSize]byte
+}
+
+func (c *copyingECipherConn) Read(data []byte) (int, error) {
+	if 0 != len(c.beforeSend) {
+		n := copy(data, c.beforeSend)
+		c.beforeSend = c.beforeSend[n:]
+		return n, nil
+	}
+
+	if c.isPass {
+		return c.rwc.Read(data)
+	}
+
+	if 0 == c.decodeSize {
+		return c.readDecodeHeader()
+	}
+
+	c.beforeSend = make([]byte, c.decodeSize)
+	n, _ := io.ReadFull(c.rwc, c.beforeSend)
+	c.beforeSend = c.beforeSend[:n]
+
+	for i := range c.beforeSend {
+		c.beforeSend[i] ^= c.decodeCode | EncodeCheckMask
+	}
+
+	c.decodeSize = 0
+	return 0, nil
+}
+
+func (c *copyingECipherConn) readDecodeHeader() (int, error) {
+	if n, err := c.rwc.Read(c.headBuffer[:1]); 1 != n {
+		return 0, err
+	}
+
+	c.isPass = true
+	if _, exist := EncodeMethodPrefix[c.headBuffer[0]]; false == exist && HanderBinary != c.headBuffer[0] {
+		c.beforeSend = c.headBuffer[:1]
+		return 0, nil
+	}
+
+	if _, err := io.ReadFull(c.rwc, c.headBuffer[1:]); nil != err {
+		return 0, io.EOF
+	}
+
+	c.beforeSend = c.headBuffer[:]
+	if c.headBuffer[3] != encodeCheck(c.headBuffer[0], binary.BigEndian.Uint16(c.headBuffer[1:3])) {
+		return 0, nil
+	}
+
+	c.isPass = false
+	c.decodeSize = int(binary.BigEndian.Uint16(c.headBuffer[1:3]))
+	c.decodeCode = c.headBuffer[3]
+
+	if prefix, exist := EncodeMethodPrefix[c.headBuffer[0]]; exist {
+		copy(c.beforeSend, prefix[:])
+	} else {
+		c.beforeSend = nil
+	}
+
+	return 0, nil
+}
+
+func TestECipherConnNoEmptyRead(t *testing.T) {
+	encoded, plain := encodeAll(t, [][]byte{[]byte("GET / HTTP/1.1\r\n"), {}, []byte("\x00\x01"), []byte("POST")})
+	conn := &ECipherConn{rwc: readOnlyRWC{bytes.NewReader(encoded)}}
+
+	var out []byte
+	buf := make([]byte, 3)
+	for {
+		n, err := conn.Read(buf)
+		if 0 == n && nil == err {
+			t.Fatal("Read returned (0, nil)")
+		}
+
+		out = append(out, buf[:n]...)
+		if io.EOF == err {
+			break
+		}
+	}
+
+	if false == bytes.Equal(out, plain) {
+		t.Fatalf("decoded = %q, want %q", out, plain)
+	}
+}
+
+func TestECipherConnMatchesCopyingReader(t *testing.T) {
+	encoded, _ := encodeAll(t, [][]byte{[]byte("GET /index.html HTTP/1.1\r\n"), bytes.Repeat([]byte{0xAA}, 3*int(MaxEncodeSize)/2)})
+
+	expect, err := io.ReadAll(&copyingECipherConn{rwc: bytes.NewReader(encoded)})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if out := decodeAll(t, encoded, MaxBufferSize); false == bytes.Equal(out, expect) {
+		t.Fatal("decoded data differs from the copying reader")
+	}
+}
+
+func benchmarkStream(b *testing.B, frameSize int) []byte {
+	var chunks [][]byte
+	for size := 0; size < 1<<20; size += frameSize {
+		chunks = append(chunks, bytes.Repeat([]byte{'x'}, frameSize))
+	}
+
+	encoded, _ := encodeAll(b, chunks)
+	return encoded
+}
+
+func benchmarkReader(b *testing.B, frameSize int, newReader func(io.Reader) io.Reader) {
+	encoded := benchmarkStream(b, frameSize)
+	buf := make([]byte, 32*1024)
+
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader := newReader(bytes.NewReader(encoded))
+		for {
+			if _, err := reader.Read(buf); nil != err {
+				break
+			}
+		}
+	}
+}
+
+func newECipherReader(r io.Reader) io.Reader {
+	return &ECipherConn{rwc: readOnlyRWC{r}}
+}
+
+func newCopyingReader(r io.Reader) io.Reader {
+	return &copyingECipherConn{rwc: r}
+}
+
+func BenchmarkECipherConnRead(b *testing.B) {
+	for _, frameSize := range []int{512, 16 * 1024, int(MaxEncodeSize)} {
+		b.Run("inplace/"+strconv.Itoa(frameSize), func(b *testing.B) { benchmarkReader(b, frameSize, newECipherReader) })
+		b.Run("copying/"+strconv.Itoa(frameSize), func(b *testing.B) { benchmarkReader(b, frameSize, newCopyingReader) })
+	}
+}
+
+func TestEncodeServerConnNegotiate(t *testing.T) {
+	key, _ := encode.GenerateKey()
+	otherKey, _ := encode.GenerateKey()
+
+	cases := []struct {
+		name   string
+		legacy bool
+		dial   func(conn net.Conn) net.Conn
+		err    error
+	}{
+		{"auth", false, func(conn net.Conn) net.Conn { return encode.Client(conn, key) }, nil},
+		{"auth with legacy", true, func(conn net.Conn) net.Conn { return encode.Client(conn, key) }, nil},
+		{"failed", true, func(conn net.Conn) net.Conn { return encode.Client(conn, otherKey) }, encode.ErrorAuthentication},
+		{"legacy", true, func(conn net.Conn) net.Conn { return conn }, nil},
+		{"rejected", false, func(conn net.Conn) net.Conn { return conn }, encode.ErrorVersion},
+	}
+
+	for _, c := range cases {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			c.dial(clientConn).Write([]byte("GET / HTTP/1.1\r\n"))
+		}()
+
+		server := &encodeServerConn{Conn: serverConn, key: key, legacy: c.legacy}
+
+		data := make([]byte, 64)
+		n, err := server.Read(data)
+		if c.err != err {
+			t.Fatalf("%s: err = %v, want %v", c.name, err, c.err)
+		}
+
+		if nil == c.err && "GET / HTTP/1.1\r\n" != string(data[:n]) {
+			t.Fatalf("%s: data = %q", c.name, data[:n])
+		}
+
+		if err = server.negotiate(); c.err != err { // 协商结果只确定一次
+			t.Fatalf("%s: negotiate err = %v", c.name, err)
+		}
+
+		switch server.conn.(type) {
+		case *encode.Conn:
+			if "legacy" == c.name || nil != c.err {
+				t.Fatalf("%s: conn = %T", c.name, server.conn)
+			}
+		case *ECipherConn:
+			if "legacy" != c.name {
+				t.Fatalf("%s: conn = %T", c.name, server.conn)
+			}
+		default:
+			if nil == c.err {
+				t.Fatalf("%s: conn = %T", c.name, server.conn)
+			}
+		}
+
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ssoor/tracksocks/log"
+	"github.com/ssoor/tracksocks/redirect/proxy/compiler"
+)
+
+var ErrorFaultDrop = errors.New("connection dropped by fault injection")
+
+const (
+	defaultFaultStatus   = http.StatusServiceUnavailable
+	defaultTruncateBytes = 1024 // 响应长度未知时 fault_truncate 发送的字节数
+	gzipHeaderSize       = 10
+)
+
+// JSONFault 为故障注入规则的参数
+type JSONFault struct {
+	Name        string   `json:"name"`        // 统计中使用的名称, 为空时使用规则类型及 host
+	Probability *float64 `json:"probability"` // 命中规则时注入的概率, 0 至 1, 未设置时总是注入
+	Status      int      `json:"status"`      // fault_status 返回的状态码, 默认 503
+	Body        string   `json:"body"`        // fault_status 返回的响应体
+	DelayMS     int      `json:"delay_ms"`    // fault_delay 返回响应头前的延迟
+	Bytes       int64    `json:"bytes"`       // fault_drop 断开前及 fault_truncate 结束前发送的字节数, fault_truncate 为 0 时发送一半
+}
+
+type faultRule struct {
+	name        string
+	ruleType    int
+	fault       JSONFault
+	probability float64
+	match       *compiler.URLMatch
+
+	matched  uint64
+	injected uint64
+}
+
+// FaultState 为故障注入规则的统计, Matched 为命中规则的请求数, Injected 为实际注入的次数
+type FaultState struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Matched  uint64 `json:"matched"`
+	Injected uint64 `json:"injected"`
+}
+
+// FaultRegistry 记录所有故障注入规则, 用于在 internest 中查看统计
+type FaultRegistry struct {
+	mutex sync.RWMutex
+	rules []*faultRule
+}
+
+var Faults = &FaultRegistry{}
+
+func (r *FaultRegistry) register(rule *faultRule) {
+	r.mutex.Lock()
+	r.rules = append(r.rules, rule)
+	r.mutex.Unlock()
+}
+
+func (r *FaultRegistry) States() []FaultState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	states := make([]FaultState, 0, len(r.rules))
+	for _, rule := range r.rules {
+		states = append(states, FaultState{
+			Name:     rule.name,
+			Type:     RuleName(rule.ruleType),
+			Matched:  atomic.LoadUint64(&rule.matched),
+			Injected: atomic.LoadUint64(&rule.injected),
+		})
+	}
+
+	return states
+}
+
+func isFaultRule(ruleType int) bool {
+	return Fault_Status <= ruleType && ruleType <= Fault_Drop
+}
+
+// newFaultRule 检查并解析故障注入规则的参数, 在规则加入 urlMatch 之前调用, 参数错误的规则不生效
+func newFaultRule(internalMatch internalJSONURLMatch, match compiler.JSONURLMatch) (*faultRule, error) {
+	rule := &faultRule{ruleType: internalMatch.Type, fault: internalMatch.Fault, probability: 1, match: compiler.NewURLMatch()}
+	if nil != rule.fault.Probability {
+		rule.probability = *rule.fault.Probability
+	}
+
+	if rule.probability < 0 || rule.probability > 1 {
+		return nil, errors.New("fault probability must be between 0 and 1")
+	}
+
+	if rule.name = rule.fault.Name; "" == rule.name {
+		rule.name = RuleName(rule.ruleType) + ":" + match.Host
+	}
+
+	if err := rule.match.AddMatchs(match); nil != err {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// addFault 记录故障注入规则, 规则本身同时加入 urlMatch, 使 host 被解密及出现在 PAC 中
+func (s *SRules) addFault(rule *faultRule) {
+	s.faults = append(s.faults, rule)
+	Faults.register(rule)
+}
+
+// pickFault 返回第一个命中 srcurl 且按概率需要注入的 ruleType 规则
+func (s *SRules) pickFault(srcurl *url.URL, ruleTypes ...int) *faultRule {
+	for _, rule := range s.faults {
+		if false == containsInt(ruleTypes, rule.ruleType) || false == rule.match.Match(srcurl) {
+			continue
+		}
+
+		atomic.AddUint64(&rule.matched, 1)
+		if rand.Float64() < rule.probability {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func (rule *faultRule) inject(req *http.Request) {
+	atomic.AddUint64(&rule.injected, 1)
+	markTrafficRule(req, rule.ruleType)
+
+	requestLog(req).WithFields(log.Fields{"rule": RuleName(rule.ruleType), "fault": rule.name}).Info("Inject fault")
+}
+
+// resolveStatusFault 命中 fault_status 时直接返回指定的响应, 不发送请求
+func (s *SRules) resolveStatusFault(req *http.Request) *http.Response {
+	rule := s.pickFault(req.URL, Fault_Status)
+	if nil == rule {
+		return nil
+	}
+	rule.inject(req)
+
+	status := rule.fault.Status
+	if 0 == status {
+		status = defaultFaultStatus
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Content-Type":       []string{"text/plain; charset=utf-8"},
+			"X-Tracksocks-Fault": []string{rule.name},
+		},
+		ContentLength: int64(len(rule.fault.Body)),
+		Body:          ioutil.NopCloser(strings.NewReader(rule.fault.Body)),
+		Close:         true,
+	}
+}
+
+// ResolveFault 按改写前的 srcurl 对上游响应注入延迟、截断、gzip 损坏或断开连接, 请求被取消时返回错误
+func (s *SRules) ResolveFault(req *http.Request, srcurl *url.URL, resp *http.Response) (*http.Response, error) {
+	rule := s.pickFault(srcurl, Fault_Truncate, Fault_Delay, Fault_CorruptGzip, Fault_Drop)
+	if nil == rule {
+		return resp, nil
+	}
+
+	switch rule.ruleType {
+	case Fault_Delay:
+		rule.inject(req)
+
+		timer := time.NewTimer(time.Duration(rule.fault.DelayMS) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return resp, req.Context().Err()
+		}
+	case Fault_Truncate:
+		rule.inject(req)
+
+		limit := rule.fault.Bytes
+		if 0 == limit {
+			limit = defaultTruncateBytes
+			if 0 < resp.ContentLength {
+				limit = resp.ContentLength / 2
+			}
+		}
+		resp.Body = &faultBody{ReadCloser: resp.Body, limit: limit, err: io.EOF}
+	case Fault_Drop:
+		rule.inject(req)
+		resp.Body = &faultBody{ReadCloser: resp.Body, limit: rule.fault.Bytes, err: ErrorFaultDrop}
+	case Fault_CorruptGzip:
+		if false == strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") { // 响应没有压缩时不注入
+			return resp, nil
+		}
+
+		rule.inject(req)
+		resp.Body = &faultBody{ReadCloser: resp.Body, limit: -1, corrupt: true}
+	}
+
+	return resp, nil
+}
+
+// faultBody 读取 limit 个字节后返回 err, limit 小于 0 时不限制. corrupt 时翻转 gzip 头部之后每 16 个字节中的一个
+type faultBody struct {
+	io.ReadCloser
+	limit   int64
+	err     error
+	corrupt bool
+
+	total int64
+}
+
+func (b *faultBody) Read(data []byte) (int, error) {
+	if 0 <= b.limit {
+		if b.total >= b.limit {
+			return 0, b.err
+		}
+
+		if remain := b.limit - b.total; int64(len(data)) > remain {
+			data = data[:remain]
+		}
+	}
+
+	n, err := b.ReadCloser.Read(data)
+	if b.corrupt {
+		for i := 0; i < n; i++ {
+			if offset := b.total + int64(i); gzipHeaderSize <= offset && 0 == offset%16 {
+				data[i] ^= 0xFF
+			}
+		}
+	}
+	b.total += int64(n)
+
+	return n, err
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ssoor/socks"
+)
+
+func newFaultRules(t *testing.T, compilers string) *SRules {
+	rules := NewSRules(socks.Direct)
+	if err := rules.ResolveJson([]byte(`{"srules":[{"compilers":[` + compilers + `]}]}`)); nil != err {
+		t.Fatal(err)
+	}
+
+	return rules
+}
+
+func newFaultResponse(body []byte, header http.Header) *http.Response {
+	if nil == header {
+		header = make(http.Header)
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: int64(len(body)), Body: io.NopCloser(bytes.NewReader(body))}
+}
+
+func TestStatusFault(t *testing.T) {
+	rules := newFaultRules(t, `{"type":5,"host":"fault.example.com","url":"/api/","match":["s@a@a@i"],"fault":{"name":"api-500","status":500,"body":"injected"}},
+		{"type":5,"host":"fault.example.com","url":"/never/","match":["s@a@a@i"],"fault":{"probability":0}}`)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://fault.example.com/api/list", nil)
+	_, resp := rules.ResolveRequest(req)
+	if nil == resp || http.StatusInternalServerError != resp.StatusCode || "api-500" != resp.Header.Get("X-Tracksocks-Fault") {
+		t.Fatalf("resp = %+v", resp)
+	}
+
+	if body, _ := io.ReadAll(resp.Body); "injected" != string(body) {
+		t.Fatalf("body = %q", body)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "http://fault.example.com/never/list", nil)
+	if _, resp = rules.ResolveRequest(req); nil != resp {
+		t.Fatal("expect no fault with probability 0")
+	}
+
+	states := make(map[string]FaultState)
+	for _, state := range Faults.States() { // 同名时使用最后注册的规则
+		states[state.Name] = state
+	}
+
+	if state, exist := states["api-500"]; false == exist || 1 != state.Matched || 1 != state.Injected {
+		t.Fatalf("api-500 state = %+v, exist = %v", state, exist)
+	}
+
+	if state, exist := states["fault_status:fault.example.com"]; false == exist || 1 != state.Matched || 0 != state.Injected {
+		t.Fatalf("fault_status state = %+v, exist = %v", state, exist)
+	}
+
+	// 配置错误的规则被忽略, 也不加入 urlMatch
+	invalid := newFaultRules(t, `{"type":5,"host":"a.example.com","url":"/","match":["s@a@a@i"],"fault":{"probability":2}}`)
+	if 0 != len(invalid.faults) || invalid.MatchHost("a.example.com") {
+		t.Fatal("expect invalid probability ignored")
+	}
+}
+
+func TestResponseFault(t *testing.T) {
+	rules := newFaultRules(t, `{"type":6,"host":"truncate.example.com","url":"/","match":["s@a@a@i"]},
+		{"type":9,"host":"drop.example.com","url":"/","match":["s@a@a@i"],"fault":{"bytes":100}},
+		{"type":8,"host":"gzip.example.com","url":"/","match":["s@a@a@i"]}`)
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	resolve := func(rawurl string, resp *http.Response) ([]byte, error) {
+		req, _ := http.NewRequest(http.MethodGet, rawurl, nil)
+		resp, err := rules.ResolveFault(req, req.URL, resp)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		return io.ReadAll(resp.Body)
+	}
+
+	if body, err := resolve("http://truncate.example.com/", newFaultResponse(data, nil)); nil != err || 500 != len(body) {
+		t.Fatalf("truncate: read %d bytes, err = %v", len(body), err)
+	}
+
+	if body, err := resolve("http://drop.example.com/", newFaultResponse(data, nil)); ErrorFaultDrop != err || 100 != len(body) {
+		t.Fatalf("drop: read %d bytes, err = %v", len(body), err)
+	}
+
+	if body, err := resolve("http://gzip.example.com/", newFaultResponse(data, nil)); nil != err || false == bytes.Equal(data, body) {
+		t.Fatal("expect uncompressed response unchanged")
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+
+	body, err := resolve("http://gzip.example.com/", newFaultResponse(compressed.Bytes(), http.Header{"Content-Encoding": []string{"gzip"}}))
+	if nil != err || len(body) != compressed.Len() || false == bytes.Equal(compressed.Bytes()[:gzipHeaderSize], body[:gzipHeaderSize]) {
+		t.Fatalf("corrupt: read %d bytes, err = %v", len(body), err)
+	}
+
+	if reader, err := gzip.NewReader(bytes.NewReader(body)); nil == err {
+		if decoded, err := io.ReadAll(reader); nil == err && bytes.Equal(data, decoded) {
+			t.Fatal("expect corrupted gzip body")
+		}
+	}
+
+	srcurl, _ := url.Parse("http://other.example.com/")
+	resp := newFaultResponse(data, nil)
+	if result, _ := rules.ResolveFault(&http.Request{URL: srcurl}, srcurl, resp); resp != result {
+		t.Fatal("expect response unchanged without matched rule")
+	}
+}
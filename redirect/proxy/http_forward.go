@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ssoor/socks"
+	"github.com/ssoor/tracksocks/log"
+)
+
+const ForwardListenerName = "forward"
+
+// ForwardProxy 为标准的正向代理, 同一端口处理普通 HTTP 请求及 CONNECT 隧道.
+// CONNECT 的目标由 Interception 决定是否解密, 不解密时直接转发原始数据.
+type ForwardProxy struct {
+	Transport *HTTPTransport
+
+	http  http.Handler
+	https http.Handler
+}
+
+func NewForwardProxy(router socks.Dialer, tran *HTTPTransport) *ForwardProxy {
+	return &ForwardProxy{
+		Transport: tran,
+		http:      socks.NewHTTPProxyHandler("http", router, tran),
+		https:     socks.NewHTTPProxyHandler("https", router, tran),
+	}
+}
+
+func (f *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if http.MethodConnect != r.Method {
+		f.http.ServeHTTP(w, r)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if nil != err {
+		http.Error(w, "invalid connect address", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if false == ok {
+		http.Error(w, "connect is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if nil != err {
+		log.Warning("Hijack connect", r.Host, "failed, err:", err)
+		return
+	}
+
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); nil != err {
+		conn.Close()
+		return
+	}
+
+	client := &bufferedConn{Conn: conn, reader: buffered.Reader}
+	intercept, reason := Interception.ShouldIntercept(f.Transport.Rules, host)
+	metricTLSDecisions.Add(1, ForwardListenerName, reason)
+
+	if intercept {
+		log.WithFields(log.Fields{"listener": ForwardListenerName, "addr": r.Host}).Debug("Intercept connect tunnel")
+		serveInterceptedConn(client, host, f.http, f.https)
+	} else {
+		log.WithFields(log.Fields{"listener": ForwardListenerName, "addr": r.Host, "reason": reason}).Debug("Tunnel connect")
+		spliceConn(r.Context(), f.Transport.Rules, client, r.Host)
+	}
+}
+
+// bufferedConn 保留 Hijack 时已读取但未处理的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcp.CloseWrite()
+	}
+
+	return nil
+}
+
+// singleConnListener 只返回一个连接, 用于在已建立的隧道上运行 http.Server
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	closed := make(chan struct{})
+	return &singleConnListener{conn: &notifyCloseConn{Conn: conn, closed: closed}, closed: closed}
+}
+
+func (l *singleConnListener) Accept() (conn net.Conn, err error) {
+	err = errors.New("listener closed")
+	l.once.Do(func() {
+		conn, err = l.conn, nil
+	})
+
+	if nil != err { // 连接处理结束后才返回, 避免 Serve 提前退出
+		<-l.closed
+	}
+
+	return conn, err
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func StartForwardProxy(addr string, router socks.Dialer, tran *HTTPTransport) {
+	server := &http.Server{
+		ErrorLog:          log.Warn,
+		Handler:           NewForwardProxy(router, tran),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if nil == err {
+		Listeners.up(ForwardListenerName, addr)
+		err = server.Serve(newMetricsListener(listener, ForwardListenerName))
+	}
+
+	Listeners.down(ForwardListenerName, addr, err)
+	if nil != err {
+		log.Error("Start forward proxy at ", addr, " failed, err:", err)
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssoor/socks"
+)
+
+// newForwardServer 解密后的请求交给 intercepted 处理, ServeHTTP 返回时通过 done 通知
+func newForwardServer(rules string, intercepted http.Handler) (*httptest.Server, chan string) {
+	forward := &ForwardProxy{Transport: NewHTTPTransport(socks.Direct, []byte(rules)), http: intercepted, https: intercepted}
+
+	done := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forward.ServeHTTP(w, r)
+		done <- r.Host
+	}))
+
+	return server, done
+}
+
+// sendConnect 在同一次写入中发送 CONNECT 及隧道内的数据, 返回已读取 200 响应的连接
+func sendConnect(t *testing.T, proxyURL string, target string, pipelined string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+pipelined); nil != err {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if http.StatusOK != resp.StatusCode || "200 Connection Established" != resp.Status {
+		t.Fatalf("connect status = %s", resp.Status)
+	}
+
+	return conn, reader
+}
+
+func waitForwardDone(t *testing.T, done chan string, target string) {
+	select {
+	case host := <-done:
+		if target != host {
+			t.Fatalf("done host = %s", host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: connect handler not returned", target)
+	}
+}
+
+func TestForwardConnectTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		conn, err := echo.Accept()
+		if nil != err {
+			return
+		}
+
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	server, done := newForwardServer(`{}`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected intercepted request %s", r.URL)
+	}))
+	defer server.Close()
+
+	target := echo.Addr().String()
+	conn, reader := sendConnect(t, server.URL, target, "ping") // Hijack 时已读取的数据需要转发
+	defer conn.Close()
+
+	io.WriteString(conn, " pong")
+	conn.(*net.TCPConn).CloseWrite()
+
+	data, err := ioutil.ReadAll(reader)
+	if nil != err || "ping pong" != string(data) {
+		t.Fatalf("tunnel data = %q, err = %v", data, err)
+	}
+
+	waitForwardDone(t, done, target)
+}
+
+func TestForwardConnectIntercept(t *testing.T) {
+	server, done := newForwardServer(`{"srules":[{"compilers":[{"type":0,"host":"localhost","url":"/","match":["s@a@a@i"]}]}]}`,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "intercepted "+r.Host+r.URL.Path)
+		}))
+	defer server.Close()
+
+	target := "localhost:1" // 解密后的请求不会连接目标
+	conn, reader := sendConnect(t, server.URL, target, "GET /first HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	defer conn.Close()
+
+	for _, path := range []string{"/first", "/second"} {
+		if "/second" == path {
+			io.WriteString(conn, "GET /second HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		}
+
+		resp, err := http.ReadResponse(reader, nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if "intercepted "+target+path != string(body) {
+			t.Fatalf("%s: body = %s", path, body)
+		}
+	}
+
+	conn.Close() // 连接关闭后 singleConnListener 结束 http.Server
+	waitForwardDone(t, done, target)
+}
+
+func TestForwardConnectInvalidAddress(t *testing.T) {
+	server, _ := newForwardServer(`{}`, nil)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "CONNECT nohost HTTP/1.1\r\nHost: nohost\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if http.StatusBadRequest != resp.StatusCode {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestSingleConnListener(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	listener := newSingleConnListener(server)
+	conn, err := listener.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+
+	select {
+	case err := <-accepted:
+		t.Fatalf("second accept returned before close, err = %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-accepted:
+		if nil == err {
+			t.Fatal("expect error after connection closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second accept not returned after close")
+	}
+}
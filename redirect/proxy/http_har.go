@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HTTP Archive 1.2 格式, 参见 http://www.softwareishard.com/blog/har-12-spec/
+
+const HARVersion = "1.2"
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+
+	Rewrite *HARRewrite `json:"_rewrite,omitempty"` // 规则改写前的原始数据
+}
+
+type HARRewrite struct {
+	URL      string       `json:"url,omitempty"`
+	Response *HARResponse `json:"response,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func harMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := make([]HARNameValue, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+
+	return headers
+}
+
+func harQueryString(u *url.URL) []HARNameValue {
+	query := make([]HARNameValue, 0)
+	for name, values := range u.Query() {
+		for _, value := range values {
+			query = append(query, HARNameValue{Name: name, Value: value})
+		}
+	}
+
+	return query
+}
+
+func harRequestCookies(req *http.Request) []HARCookie {
+	cookies := make([]HARCookie, 0)
+	for _, cookie := range req.Cookies() {
+		cookies = append(cookies, HARCookie{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	return cookies
+}
+
+func harResponseCookies(resp *http.Response) []HARCookie {
+	cookies := make([]HARCookie, 0)
+	for _, cookie := range resp.Cookies() {
+		cookies = append(cookies, HARCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		})
+	}
+
+	return cookies
+}
+
+func harIsText(mimeType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+	case strings.HasSuffix(mediaType, "json"), strings.HasSuffix(mediaType, "xml"), strings.HasSuffix(mediaType, "javascript"):
+	case mediaType == "application/x-www-form-urlencoded":
+	default:
+		return false
+	}
+
+	return true
+}
+
+// harBodyText 按内容类型返回文本或 base64 编码的 body
+func harBodyText(mimeType string, data []byte) (text string, encoding string) {
+	if harIsText(mimeType) && utf8.Valid(data) {
+		return string(data), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func harContent(header http.Header, data []byte, size int64, truncated bool) (content HARContent) {
+	content.Size = size
+	content.MimeType = header.Get("Content-Type")
+
+	if false == truncated && strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		if read, err := gzip.NewReader(bytes.NewReader(data)); nil == err {
+			if plain, err := ioutil.ReadAll(read); nil == err {
+				data = plain
+				content.Size = int64(len(plain))
+			}
+		}
+	}
+
+	content.Text, content.Encoding = harBodyText(content.MimeType, data)
+
+	if truncated {
+		content.Comment = "body truncated"
+	}
+
+	return content
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/ssoor/tracksocks/log"
+)
+
+var (
+	ErrorHookExists      = errors.New("hook already exists")
+	ErrorHookUnsupported = errors.New("hook must implement RequestHook, ResponseHook or ConnectHook")
+)
+
+// RuleMatch 为请求命中的规则信息, 传递给扩展使用
+type RuleMatch struct {
+	RequestID string
+	SourceURL url.URL  // 规则改写前的 URL
+	Rules     []string // 命中的规则类型名称, 按命中顺序排列
+	Upstream  string   // 发送请求使用的出口, 请求未发送时为空
+}
+
+// RequestHook 在规则处理请求后、发送请求前调用, 可以直接修改 req. 返回的响应不为 nil 时直接返回给客户端,
+// 不再发送请求及调用之后的扩展; 返回错误时客户端收到 502 响应
+type RequestHook interface {
+	HookRequest(req *http.Request, match RuleMatch) (*http.Response, error)
+}
+
+// ResponseHook 在规则处理上游响应后调用, 返回的响应替换原响应交给之后的扩展; 返回错误时客户端收到 502 响应.
+// 由规则或 RequestHook 直接返回的响应不调用
+type ResponseHook interface {
+	HookResponse(req *http.Request, resp *http.Response, match RuleMatch) (*http.Response, error)
+}
+
+// ConnectHook 在不解密的连接建立前调用, 返回实际连接的地址, 返回错误时关闭客户端连接
+type ConnectHook interface {
+	HookConnect(ctx context.Context, addr string) (string, error)
+}
+
+type namedHook struct {
+	name string
+	hook interface{}
+}
+
+// HookRegistry 保存嵌入程序注册的扩展, 按注册顺序调用
+type HookRegistry struct {
+	mutex sync.RWMutex
+	hooks []namedHook
+}
+
+var Hooks = &HookRegistry{}
+
+// Add 注册扩展, hook 需要实现 RequestHook、ResponseHook、ConnectHook 中的至少一个
+func (r *HookRegistry) Add(name string, hook interface{}) error {
+	_, isRequest := hook.(RequestHook)
+	_, isResponse := hook.(ResponseHook)
+	_, isConnect := hook.(ConnectHook)
+	if false == isRequest && false == isResponse && false == isConnect {
+		return ErrorHookUnsupported
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, entry := range r.hooks {
+		if name == entry.name {
+			return ErrorHookExists
+		}
+	}
+
+	hooks := make([]namedHook, len(r.hooks), len(r.hooks)+1) // 复制后替换, 调用扩展时不需要持有锁
+	copy(hooks, r.hooks)
+	r.hooks = append(hooks, namedHook{name: name, hook: hook})
+
+	return nil
+}
+
+func (r *HookRegistry) Remove(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, entry := range r.hooks {
+		if name == entry.name {
+			hooks := make([]namedHook, 0, len(r.hooks)-1)
+			r.hooks = append(append(hooks, r.hooks[:i]...), r.hooks[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *HookRegistry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.hooks))
+	for _, entry := range r.hooks {
+		names = append(names, entry.name)
+	}
+
+	return names
+}
+
+func (r *HookRegistry) list() []namedHook {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.hooks
+}
+
+type ruleMatchKey struct{}
+
+// withRuleMatch 在 context 中记录请求命中的规则, markTrafficRule 记录的规则写入其中
+func withRuleMatch(req *http.Request) (*http.Request, *RuleMatch) {
+	match := &RuleMatch{RequestID: RequestID(req.Context()), SourceURL: *req.URL}
+	return req.WithContext(context.WithValue(req.Context(), ruleMatchKey{}, match)), match
+}
+
+func ruleMatchOf(req *http.Request) *RuleMatch {
+	match, _ := req.Context().Value(ruleMatchKey{}).(*RuleMatch)
+	return match
+}
+
+// snapshot 复制命中的规则, 扩展修改时不影响之后的记录
+func (m *RuleMatch) snapshot() RuleMatch {
+	match := *m
+	match.Rules = append([]string(nil), m.Rules...)
+	return match
+}
+
+func (r *HookRegistry) resolveRequest(req *http.Request, match RuleMatch) (*http.Response, error) {
+	for _, entry := range r.list() {
+		hook, ok := entry.hook.(RequestHook)
+		if false == ok {
+			continue
+		}
+
+		resp, err := hook.HookRequest(req, match)
+		if nil != err {
+			requestLog(req).WithFields(log.Fields{"hook": entry.name, "error": err}).Warning("Request hook failed")
+			return nil, err
+		}
+
+		if nil != resp {
+			requestLog(req).With("hook", entry.name).Info("Request answered by hook")
+			return completeHookResponse(req, resp), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *HookRegistry) resolveResponse(req *http.Request, resp *http.Response, match RuleMatch) (*http.Response, error) {
+	for _, entry := range r.list() {
+		hook, ok := entry.hook.(ResponseHook)
+		if false == ok {
+			continue
+		}
+
+		result, err := hook.HookResponse(req, resp, match)
+		if nil != err {
+			requestLog(req).WithFields(log.Fields{"hook": entry.name, "error": err}).Warning("Response hook failed")
+			return resp, err
+		}
+
+		if nil != result {
+			resp = completeHookResponse(req, result)
+		}
+	}
+
+	return resp, nil
+}
+
+// completeHookResponse 补全插件返回的响应, 之后的处理会修改响应头及读取响应体
+func completeHookResponse(req *http.Request, resp *http.Response) *http.Response {
+	if nil == resp.Request {
+		resp.Request = req
+	}
+	if nil == resp.Header {
+		resp.Header = make(http.Header)
+	}
+	if nil == resp.Body {
+		resp.Body = http.NoBody
+	}
+
+	return resp
+}
+
+func (r *HookRegistry) resolveConnect(ctx context.Context, addr string) (string, error) {
+	for _, entry := range r.list() {
+		hook, ok := entry.hook.(ConnectHook)
+		if false == ok {
+			continue
+		}
+
+		target, err := hook.HookConnect(ctx, addr)
+		if nil != err {
+			contextLog(ctx).WithFields(log.Fields{"hook": entry.name, "addr": addr, "error": err}).Warning("Connect hook refused")
+			return "", err
+		}
+
+		if "" != target && target != addr {
+			contextLog(ctx).WithFields(log.Fields{"hook": entry.name, "addr": addr, "target": target}).Info("Connect redirected by hook")
+			addr = target
+		}
+	}
+
+	return addr, nil
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssoor/socks"
+)
+
+type testHook struct {
+	name     string
+	calls    *[]string
+	request  func(req *http.Request, match RuleMatch) (*http.Response, error)
+	response func(req *http.Request, resp *http.Response, match RuleMatch) (*http.Response, error)
+	connect  func(ctx context.Context, addr string) (string, error)
+}
+
+func (h testHook) HookRequest(req *http.Request, match RuleMatch) (*http.Response, error) {
+	*h.calls = append(*h.calls, h.name+":request")
+	if nil != h.request {
+		return h.request(req, match)
+	}
+
+	return nil, nil
+}
+
+func (h testHook) HookResponse(req *http.Request, resp *http.Response, match RuleMatch) (*http.Response, error) {
+	*h.calls = append(*h.calls, h.name+":response")
+	resp.Header.Add("X-Hook", h.name)
+	if nil != h.response {
+		return h.response(req, resp, match)
+	}
+
+	return nil, nil
+}
+
+func (h testHook) HookConnect(ctx context.Context, addr string) (string, error) {
+	if nil != h.connect {
+		return h.connect(ctx, addr)
+	}
+
+	return addr, nil
+}
+
+func TestHookRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Tenant")))
+	}))
+	defer server.Close()
+
+	var calls []string
+	var matched RuleMatch
+	first := testHook{name: "first", calls: &calls, request: func(req *http.Request, match RuleMatch) (*http.Response, error) {
+		matched = match
+		if strings.HasPrefix(req.URL.Path, "/blocked") {
+			return &http.Response{StatusCode: http.StatusForbidden}, nil
+		}
+
+		req.Header.Set("X-Tenant", "hooked")
+		return nil, nil
+	}}
+
+	if err := Hooks.Add("first", first); nil != err {
+		t.Fatal(err)
+	}
+	defer Hooks.Remove("first")
+
+	if err := Hooks.Add("second", testHook{name: "second", calls: &calls}); nil != err {
+		t.Fatal(err)
+	}
+	defer Hooks.Remove("second")
+
+	if ErrorHookExists != Hooks.Add("first", first) || ErrorHookUnsupported != Hooks.Add("other", struct{}{}) {
+		t.Fatal("expect duplicate and unsupported hook errors")
+	}
+
+	transport := NewHTTPTransport(socks.Direct, []byte(`{}`))
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api", nil)
+	resp, _ := transport.RoundTrip(req)
+	body, _ := io.ReadAll(resp.Body)
+	if http.StatusOK != resp.StatusCode || "hooked" != string(body) || "first,second" != strings.Join(resp.Header.Values("X-Hook"), ",") {
+		t.Fatalf("status = %d, body = %q, hooks = %v", resp.StatusCode, body, resp.Header.Values("X-Hook"))
+	}
+
+	if "first:request,second:request,first:response,second:response" != strings.Join(calls, ",") {
+		t.Fatalf("calls = %v", calls)
+	}
+
+	if "" == matched.RequestID || "/api" != matched.SourceURL.Path || "remote" != matched.Upstream {
+		t.Fatalf("match = %+v", matched)
+	}
+
+	calls = nil
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/blocked", nil)
+	if resp, _ = transport.RoundTrip(req); http.StatusForbidden != resp.StatusCode || "first:request" != strings.Join(calls, ",") {
+		t.Fatalf("status = %d, calls = %v", resp.StatusCode, calls)
+	}
+}
+
+func TestResponseHookReplace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer server.Close()
+
+	var calls []string
+	hook := testHook{name: "bare", calls: &calls, response: func(req *http.Request, resp *http.Response, match RuleMatch) (*http.Response, error) {
+		resp.Body.Close()
+		return &http.Response{StatusCode: http.StatusTeapot}, nil // 没有设置响应头及响应体
+	}}
+
+	if err := Hooks.Add("bare", hook); nil != err {
+		t.Fatal(err)
+	}
+	defer Hooks.Remove("bare")
+
+	transport := NewHTTPTransport(socks.Direct, []byte(`{}`))
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	resp, err := transport.RoundTrip(req)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if http.StatusTeapot != resp.StatusCode || nil != err || 0 != len(body) {
+		t.Fatalf("status = %d, body = %q, err = %v", resp.StatusCode, body, err)
+	}
+
+	if nil == resp.Request || "" == resp.Header.Get("Content-Security-Policy") {
+		t.Fatalf("request = %v, header = %v", resp.Request, resp.Header)
+	}
+}
+
+func TestHookRuleMatch(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req, match := withRuleMatch(req)
+
+	markTrafficRule(req, Redirect_URL)
+	markTrafficRule(req, Fault_Delay)
+
+	snapshot := match.snapshot()
+	snapshot.Rules[0] = "changed"
+	if "redirect_url,fault_delay" != strings.Join(match.Rules, ",") {
+		t.Fatalf("rules = %v", match.Rules)
+	}
+}
+
+func TestConnectHook(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	go func() {
+		if conn, err := target.Accept(); nil == err {
+			conn.Write([]byte("redirected"))
+			conn.Close()
+		}
+	}()
+
+	var calls []string
+	hook := testHook{name: "connect", calls: &calls, connect: func(ctx context.Context, addr string) (string, error) {
+		if "blocked.example.com:443" == addr {
+			return "", errors.New("blocked")
+		}
+
+		return target.Addr().String(), nil
+	}}
+
+	if err := Hooks.Add("connect", hook); nil != err {
+		t.Fatal(err)
+	}
+	defer Hooks.Remove("connect")
+
+	rules := NewSRules(socks.Direct)
+	for addr, want := range map[string]string{"blocked.example.com:443": "", "www.example.com:443": "redirected"} {
+		client, peer := net.Pipe()
+		go spliceConn(context.Background(), rules, peer, addr)
+
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		size := len(want)
+		if 0 == size { // 拒绝时连接被关闭, 读取不到数据
+			size = 1
+		}
+
+		data := make([]byte, size)
+		if n, _ := io.ReadFull(client, data); want != string(data[:n]) {
+			t.Fatalf("%s: read %q, want %q", addr, data, want)
+		}
+		client.Close()
+	}
+}
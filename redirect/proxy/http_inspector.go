@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInspectorRecords  = 200
+	DefaultInspectorBodySize = 32 << 10
+)
+
+// TrafficRecord 为单次请求在实时查看器中的记录
+type TrafficRecord struct {
+	ID        uint64    `json:"id"`
+	RequestID string    `json:"request_id"`
+	Started   time.Time `json:"started"`
+	Finished  bool      `json:"finished"`
+
+	Method     string   `json:"method"`
+	URL        string   `json:"url"`
+	Host       string   `json:"host"`
+	RewriteURL string   `json:"rewrite_url,omitempty"`
+	Status     int      `json:"status"`
+	Size       int64    `json:"size"`
+	Duration   float64  `json:"duration"` // 毫秒
+	Rules      []string `json:"rules"`
+	Transport  string   `json:"transport"` // remote: 上游代理, local: 直连
+	Upstream   string   `json:"upstream"`
+	Error      string   `json:"error,omitempty"`
+
+	RequestHeader        http.Header `json:"request_header,omitempty"`
+	RequestBody          string      `json:"request_body,omitempty"`
+	RequestBodyEncoding  string      `json:"request_body_encoding,omitempty"`
+	RequestBodyTruncated bool        `json:"request_body_truncated,omitempty"`
+	ResponseHeader       http.Header `json:"response_header,omitempty"`
+	ResponseBody         string      `json:"response_body,omitempty"`
+	ResponseBodyEncoding string      `json:"response_body_encoding,omitempty"`
+}
+
+// Summary 返回不包含头部及内容的记录, 用于列表展示
+func (r TrafficRecord) Summary() TrafficRecord {
+	r.Rules = append([]string{}, r.Rules...)
+	r.RequestHeader, r.RequestBody, r.RequestBodyEncoding, r.RequestBodyTruncated = nil, "", "", false
+	r.ResponseHeader, r.ResponseBody, r.ResponseBodyEncoding = nil, "", ""
+
+	return r
+}
+
+func (r TrafficRecord) MatchHost(host string) bool {
+	if "" == host {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	recordHost := strings.ToLower(r.Host)
+
+	return recordHost == host || strings.HasSuffix(recordHost, "."+strings.TrimPrefix(host, "."))
+}
+
+// TrafficInspector 保存最近的请求记录, 并将新记录推送给订阅者
+type TrafficInspector struct {
+	mutex    sync.Mutex
+	nextID   uint64
+	capacity int
+	bodySize int64
+
+	records     []*TrafficRecord
+	subscribers map[chan TrafficRecord]struct{}
+}
+
+var Inspector = NewTrafficInspector(DefaultInspectorRecords, DefaultInspectorBodySize)
+
+func NewTrafficInspector(capacity int, bodySize int64) *TrafficInspector {
+	return &TrafficInspector{
+		capacity:    capacity,
+		bodySize:    bodySize,
+		records:     make([]*TrafficRecord, 0, capacity),
+		subscribers: make(map[chan TrafficRecord]struct{}),
+	}
+}
+
+// Configure 调整保存的记录数及记录的内容大小, capacity 为 0 时关闭记录, bodySize 为 0 时不记录内容
+func (i *TrafficInspector) Configure(capacity int, bodySize int64) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if capacity < 0 {
+		capacity = 0
+	}
+	if bodySize < 0 {
+		bodySize = 0
+	}
+
+	if len(i.records) > capacity {
+		i.records = append([]*TrafficRecord{}, i.records[len(i.records)-capacity:]...)
+	}
+
+	i.capacity, i.bodySize = capacity, bodySize
+}
+
+func (i *TrafficInspector) settings() (int, int64) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return i.capacity, i.bodySize
+}
+
+func (i *TrafficInspector) Subscribe() chan TrafficRecord {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	ch := make(chan TrafficRecord, 64)
+	i.subscribers[ch] = struct{}{}
+
+	return ch
+}
+
+func (i *TrafficInspector) Unsubscribe(ch chan TrafficRecord) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	delete(i.subscribers, ch)
+}
+
+// Records 返回 host 对应的记录摘要, host 为空时返回全部
+func (i *TrafficInspector) Records(host string) []TrafficRecord {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	records := make([]TrafficRecord, 0, len(i.records))
+	for _, record := range i.records {
+		if record.MatchHost(host) {
+			records = append(records, record.Summary())
+		}
+	}
+
+	return records
+}
+
+func (i *TrafficInspector) Record(id uint64) (TrafficRecord, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, record := range i.records {
+		if id == record.ID {
+			detail := *record
+			detail.Rules = append([]string{}, record.Rules...)
+
+			return detail, true
+		}
+	}
+
+	return TrafficRecord{}, false
+}
+
+func (i *TrafficInspector) begin(record *TrafficRecord) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.nextID++
+	record.ID = i.nextID
+
+	if len(i.records) >= i.capacity && 0 != len(i.records) {
+		i.records = i.records[1:]
+	}
+	i.records = append(i.records, record)
+}
+
+// update 在持有 mutex 的情况下修改记录, 并将修改后的记录推送给订阅者
+func (i *TrafficInspector) update(record *TrafficRecord, change func(*TrafficRecord)) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	change(record)
+
+	for ch := range i.subscribers {
+		select {
+		case ch <- record.Summary():
+		default: // 订阅方处理过慢时丢弃
+		}
+	}
+}
+
+type trafficKey struct{}
+
+// trafficExchange 跟随请求 context 传递, 供规则处理过程补充记录信息
+type trafficExchange struct {
+	inspector *TrafficInspector
+	record    *TrafficRecord
+	started   time.Time
+	bodySize  int64
+}
+
+func trafficFromRequest(req *http.Request) *trafficExchange {
+	exchange, _ := req.Context().Value(trafficKey{}).(*trafficExchange)
+	return exchange
+}
+
+// markTrafficRule 记录命中的规则类型
+func markTrafficRule(req *http.Request, ruleType int) {
+	metricRuleHits.Add(1, RuleName(ruleType))
+
+	if match := ruleMatchOf(req); nil != match {
+		match.Rules = append(match.Rules, RuleName(ruleType))
+	}
+
+	if exchange := trafficFromRequest(req); nil != exchange {
+		exchange.inspector.update(exchange.record, func(record *TrafficRecord) {
+			record.Rules = append(record.Rules, RuleName(ruleType))
+		})
+	}
+}
+
+// Begin 开始记录请求, 记录关闭时返回 nil, 不复制请求头部及内容
+func (i *TrafficInspector) Begin(req *http.Request) (*http.Request, *trafficExchange) {
+	capacity, bodySize := i.settings()
+	if 0 == capacity {
+		return req, nil
+	}
+
+	exchange := &trafficExchange{
+		inspector: i,
+		bodySize:  bodySize,
+		started:   time.Now(),
+		record: &TrafficRecord{
+			RequestID:     RequestID(req.Context()),
+			Started:       time.Now(),
+			Method:        req.Method,
+			URL:           req.URL.String(),
+			Host:          req.URL.Hostname(),
+			Rules:         make([]string, 0),
+			RequestHeader: req.Header.Clone(),
+		},
+	}
+
+	var data []byte
+	if 0 != bodySize {
+		data = peekRequestBody(req, bodySize+1)
+	}
+
+	if nil != data {
+		if int64(len(data)) > bodySize {
+			data = data[:bodySize]
+			exchange.record.RequestBodyTruncated = true
+		}
+
+		exchange.record.RequestBody, exchange.record.RequestBodyEncoding = harBodyText(req.Header.Get("Content-Type"), data)
+	}
+
+	i.begin(exchange.record)
+
+	ctx := context.WithValue(req.Context(), trafficKey{}, exchange)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			i.update(exchange.record, func(record *TrafficRecord) {
+				record.Upstream = info.Conn.RemoteAddr().String()
+			})
+		},
+	})
+
+	return req.WithContext(ctx), exchange
+}
+
+// Transport 记录请求使用的传输方式
+func (e *trafficExchange) Transport(rules *SRules, tran *http.Transport) {
+	if nil == e {
+		return
+	}
+
+	e.inspector.update(e.record, func(record *TrafficRecord) {
+		record.Transport = rules.transportName(tran)
+	})
+}
+
+// Finish 记录响应头, 响应体读取完毕后更新记录
+func (e *trafficExchange) Finish(req *http.Request, resp *http.Response, err error) *http.Response {
+	if nil == e {
+		return resp
+	}
+
+	header := resp.Header.Clone()
+
+	e.inspector.update(e.record, func(record *TrafficRecord) {
+		if url := req.URL.String(); url != record.URL {
+			record.RewriteURL = url
+		}
+		if nil != err {
+			record.Error = err.Error()
+		}
+
+		record.Status = resp.StatusCode
+		record.ResponseHeader = header
+		record.Duration = harMilliseconds(time.Since(e.started))
+	})
+
+	resp.Body = newCaptureBody(resp.Body, e.bodySize, func(body *captureBody) {
+		content := harContent(header, body.data.Bytes(), body.size, body.truncated)
+
+		e.inspector.update(e.record, func(record *TrafficRecord) {
+			record.Finished = true
+			record.Size = body.size
+			record.Duration = harMilliseconds(time.Since(e.started))
+			record.ResponseBody, record.ResponseBodyEncoding = content.Text, content.Encoding
+		})
+	})
+
+	return resp
+}
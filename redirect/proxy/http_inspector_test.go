@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// inspectExchange 模拟一次完整的请求, 并读取全部响应内容
+func inspectExchange(inspector *TrafficInspector, method string, url string, body string, respBody string) *trafficExchange {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "text/plain")
+
+	req, exchange := inspector.Begin(req)
+	if nil != req.Body {
+		io.Copy(ioutil.Discard, req.Body) // 记录请求内容后仍然可以完整读取
+	}
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/plain"}}, Body: ioutil.NopCloser(strings.NewReader(respBody))}
+	resp = exchange.Finish(req, resp, nil)
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return exchange
+}
+
+func TestTrafficInspectorRing(t *testing.T) {
+	inspector := NewTrafficInspector(2, 4)
+	events := inspector.Subscribe()
+
+	for _, host := range []string{"a.example.com", "b.example.com", "other.com"} {
+		inspectExchange(inspector, http.MethodPost, "http://"+host+"/path", "request body", "response body")
+	}
+
+	records := inspector.Records("")
+	if 2 != len(records) || 2 != records[0].ID || 3 != records[1].ID { // 超出容量时丢弃最早的记录
+		t.Fatalf("records = %+v", records)
+	}
+
+	if nil != records[0].RequestHeader || "" != records[0].ResponseBody || false == records[0].Finished {
+		t.Fatalf("summary = %+v", records[0])
+	}
+
+	if matched := inspector.Records(".example.com"); 1 != len(matched) || "b.example.com" != matched[0].Host {
+		t.Fatalf("host records = %+v", matched)
+	}
+
+	if _, exist := inspector.Record(1); exist {
+		t.Fatal("expect dropped record to be missing")
+	}
+
+	detail, exist := inspector.Record(2)
+	if false == exist || "Bearer secret" != detail.RequestHeader.Get("Authorization") || "requ" != detail.RequestBody || false == detail.RequestBodyTruncated {
+		t.Fatalf("detail = %+v", detail)
+	}
+
+	if "resp" != detail.ResponseBody || int64(len("response body")) != detail.Size || http.StatusOK != detail.Status {
+		t.Fatalf("detail response = %+v", detail)
+	}
+
+	if 6 != len(events) { // 每次请求推送响应头及响应内容两次更新
+		t.Fatalf("events = %d", len(events))
+	}
+
+	inspector.Unsubscribe(events)
+	inspectExchange(inspector, http.MethodGet, "http://a.example.com/", "", "")
+	if 6 != len(events) {
+		t.Fatalf("events after unsubscribe = %d", len(events))
+	}
+
+	inspector.Configure(1, 0)
+	if records = inspector.Records(""); 1 != len(records) || 4 != records[0].ID {
+		t.Fatalf("records after configure = %+v", records)
+	}
+
+	inspectExchange(inspector, http.MethodPost, "http://a.example.com/", "request body", "response body")
+	if detail, _ = inspector.Record(5); "" != detail.RequestBody || "" != detail.ResponseBody || false == detail.Finished {
+		t.Fatalf("detail without body = %+v", detail)
+	}
+}
+
+func TestTrafficInspectorDisabled(t *testing.T) {
+	inspector := NewTrafficInspector(2, 4)
+	inspectExchange(inspector, http.MethodGet, "http://a.example.com/", "", "")
+
+	inspector.Configure(0, DefaultInspectorBodySize)
+	if exchange := inspectExchange(inspector, http.MethodPost, "http://a.example.com/", "request body", "response body"); nil != exchange {
+		t.Fatalf("exchange = %+v", exchange)
+	}
+
+	if records := inspector.Records(""); 0 != len(records) {
+		t.Fatalf("records = %+v", records)
+	}
+
+	var exchange *trafficExchange
+	exchange.Transport(nil, nil) // 关闭记录时 RoundTrip 使用 nil 记录
+}
@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssoor/tracksocks/log"
+)
+
+const (
+	tlsHandshakeRecord     = 0x16
+	peekClientHelloTimeout = 10 * time.Second
+	clientFirstTimeout     = 2 * time.Second // 超时没有收到客户端数据时认为是服务端先发送数据的协议
+)
+
+var errorClientHelloPeeked = errors.New("client hello peeked")
+
+// httpMethodPrefixes 用于识别明文 HTTP 请求, 其余非 TLS 连接直接转发到原始目标
+var httpMethodPrefixes = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "}
+
+// InterceptPolicy 决定 TLS 连接是否解密, 只有存在规则且不在不解密列表中的 host 才会解密
+type InterceptPolicy struct {
+	mutex sync.RWMutex
+	never map[string]bool // 与规则 host 格式相同, 以 . 开头的为模糊匹配
+}
+
+var Interception = &InterceptPolicy{never: make(map[string]bool)}
+
+func normalizeInterceptHost(host string) string {
+	return strings.TrimSpace(strings.ToLower(host))
+}
+
+func (p *InterceptPolicy) SetNeverIntercept(hosts []string) {
+	never := make(map[string]bool)
+	for _, host := range hosts {
+		if host = normalizeInterceptHost(host); "" != host {
+			never[host] = true
+		}
+	}
+
+	p.mutex.Lock()
+	p.never = never
+	p.mutex.Unlock()
+}
+
+func (p *InterceptPolicy) AddNeverIntercept(host string) error {
+	if host = normalizeInterceptHost(host); "" == host || "." == host {
+		return errors.New("invalid host")
+	}
+
+	p.mutex.Lock()
+	p.never[host] = true
+	p.mutex.Unlock()
+
+	return nil
+}
+
+func (p *InterceptPolicy) RemoveNeverIntercept(host string) bool {
+	host = normalizeInterceptHost(host)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, exist := p.never[host]
+	delete(p.never, host)
+
+	return exist
+}
+
+func (p *InterceptPolicy) NeverIntercept() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	hosts := make([]string, 0, len(p.never))
+	for host := range p.never {
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// isNeverIntercept 按绝对匹配及模糊匹配检查不解密列表, 规则同 compiler.URLMatch.MatchHost
+func (p *InterceptPolicy) isNeverIntercept(host string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.never[host] {
+		return true
+	}
+
+	host = "." + host
+	for i := 0; -1 != i; i = strings.IndexRune(host, '.') {
+		host = host[i+1:]
+		if p.never["."+host] {
+			return true
+		}
+	}
+
+	return p.never["."] // 全局规则
+}
+
+// ShouldIntercept 返回是否解密及原因, host 为空(客户端没有发送 SNI)时保持解密
+func (p *InterceptPolicy) ShouldIntercept(rules *SRules, host string) (bool, string) {
+	if host = normalizeInterceptHost(host); "" == host {
+		return true, "no_sni"
+	}
+
+	if p.isNeverIntercept(host) {
+		return false, "never"
+	}
+
+	if false == rules.MatchHost(host) {
+		return false, "no_rule"
+	}
+
+	return true, "rule"
+}
+
+// readOnlyConn 只用于读取 ClientHello, 握手失败时 tls 发送的告警被丢弃
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekClientHello 读取 ClientHello 中的 SNI, 返回已读取的数据供后续处理重放
+func peekClientHello(conn net.Conn) (serverName string, prefix []byte, err error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+
+	conn.SetReadDeadline(time.Now().Add(peekClientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err = tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errorClientHelloPeeked
+		},
+	}).Handshake()
+
+	if nil == hello {
+		return "", buf.Bytes(), err
+	}
+
+	return hello.ServerName, buf.Bytes(), nil
+}
+
+// selectiveListener 只将需要解密的 TLS 连接交给 http.Server, 其余连接直接转发到原始目标
+type selectiveListener struct {
+	net.Listener
+	rules *SRules
+	name  string
+
+	conns  chan net.Conn
+	errors chan error
+
+	done      chan struct{} // Close 时关闭, 之后不再交给 http.Server 的连接直接关闭
+	closeOnce sync.Once
+}
+
+func newSelectiveListener(listener net.Listener, name string, rules *SRules) *selectiveListener {
+	l := &selectiveListener{
+		Listener: listener,
+		rules:    rules,
+		name:     name,
+		conns:    make(chan net.Conn),
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+
+	go l.acceptLoop()
+	return l
+}
+
+func (l *selectiveListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+
+			l.errors <- err
+			return
+		}
+
+		go l.dispatch(conn)
+	}
+}
+
+func (l *selectiveListener) dispatch(conn net.Conn) {
+	serverName, prefix, err := peekClientHello(conn)
+	replay := &bufferedConn{Conn: conn, reader: bufio.NewReader(io.MultiReader(bytes.NewReader(prefix), conn))}
+
+	if nil != err { // 不是 TLS 连接, 交给 http.Server 返回错误
+		l.serve(replay)
+		return
+	}
+
+	intercept, reason := Interception.ShouldIntercept(l.rules, serverName)
+	metricTLSDecisions.Add(1, l.name, reason)
+
+	if intercept {
+		l.serve(replay)
+		return
+	}
+
+	log.WithFields(log.Fields{"listener": l.name, "host": serverName, "reason": reason}).Debug("Splice tls connection")
+	spliceConn(context.Background(), l.rules, replay, net.JoinHostPort(serverName, "443"))
+}
+
+// serve 将连接交给 http.Server, 监听已关闭时关闭连接
+func (l *selectiveListener) serve(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *selectiveListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errors:
+		l.errors <- err // 之后的调用同样返回错误
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *selectiveListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// serveInterceptedConn 在已建立的连接上处理请求, 首字节为 TLS 握手时使用伪造证书解密,
+// host 用于客户端没有发送 SNI 时签发证书
+func serveInterceptedConn(conn *bufferedConn, host string, httpHandler http.Handler, httpsHandler http.Handler) {
+	first, err := conn.reader.Peek(1)
+	if nil != err {
+		conn.Close()
+		return
+	}
+
+	handler, serveConn := httpHandler, net.Conn(conn)
+	if tlsHandshakeRecord == first[0] {
+		handler = httpsHandler
+		serveConn = tls.Server(conn, &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if "" == hello.ServerName {
+					hello.ServerName = host
+				}
+
+				return HTTPSGetCertificate(hello)
+			},
+		})
+	}
+
+	server := &http.Server{ErrorLog: log.Warn, Handler: handler}
+	server.Serve(newSingleConnListener(serveConn))
+}
+
+// isHTTPRequest 只在已读取的数据与方法前缀的开头相同时等待更多数据, 调用方需要设置读取超时
+func isHTTPRequest(reader *bufio.Reader) bool {
+	buffered, _ := reader.Peek(reader.Buffered())
+
+	for _, prefix := range httpMethodPrefixes {
+		size := len(prefix)
+		if size > len(buffered) {
+			size = len(buffered)
+		}
+
+		if prefix[:size] != string(buffered[:size]) {
+			continue
+		}
+
+		if data, _ := reader.Peek(len(prefix)); prefix == string(data) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveSniffedConn 根据连接的首个数据判断协议: TLS 按 SNI 决定解密或转发, 明文 HTTP 交给 http 处理, 其余数据直接转发到 addr.
+// firstTimeout 内没有收到客户端数据时按服务端先发送数据的协议转发
+func serveSniffedConn(listener string, rules *SRules, client *bufferedConn, addr string, firstTimeout time.Duration, httpHandler http.Handler, httpsHandler http.Handler) {
+	host, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		host = addr
+	}
+
+	fields := log.Fields{"listener": listener, "addr": addr}
+
+	client.SetReadDeadline(time.Now().Add(firstTimeout))
+	first, err := client.reader.Peek(1)
+	isHTTP := nil == err && tlsHandshakeRecord != first[0] && isHTTPRequest(client.reader)
+	client.SetReadDeadline(time.Time{})
+
+	if nil != err {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() { // 由服务端先发送数据的协议(SSH, SMTP 等)
+			log.WithFields(fields).Debug("Splice server first connection")
+			spliceConn(context.Background(), rules, client, addr)
+		} else {
+			client.Close()
+		}
+		return
+	}
+
+	if tlsHandshakeRecord != first[0] {
+		if false == isHTTP {
+			log.WithFields(fields).Debug("Splice non http connection")
+			spliceConn(context.Background(), rules, client, addr)
+			return
+		}
+
+		log.WithFields(fields).Debug("Intercept http connection")
+		serveInterceptedConn(client, host, httpHandler, httpsHandler)
+		return
+	}
+
+	serverName, prefix, err := peekClientHello(client)
+	replay := &bufferedConn{Conn: client.Conn, reader: bufio.NewReader(io.MultiReader(bytes.NewReader(prefix), client))}
+	if nil != err {
+		spliceConn(context.Background(), rules, replay, addr)
+		return
+	}
+
+	intercept, reason := Interception.ShouldIntercept(rules, serverName)
+	metricTLSDecisions.Add(1, listener, reason)
+
+	fields["host"], fields["reason"] = serverName, reason
+	if intercept {
+		log.WithFields(fields).Debug("Intercept tls connection")
+		serveInterceptedConn(replay, host, httpHandler, httpsHandler)
+	} else {
+		log.WithFields(fields).Debug("Splice tls connection")
+		spliceConn(context.Background(), rules, replay, addr)
+	}
+}
+
+// spliceConn 使用与无规则请求相同的出口连接 addr 并双向转发原始数据
+func spliceConn(ctx context.Context, rules *SRules, client net.Conn, addr string) {
+	defer client.Close()
+
+	addr, err := Hooks.resolveConnect(ctx, addr)
+	if nil != err {
+		return
+	}
+
+	server, err := rules.DialLocal(ctx, "tcp", addr)
+	if nil != err {
+		log.WithFields(log.Fields{"addr": addr, "error": err}).Warning("Dial splice target failed")
+		return
+	}
+	defer server.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+
+	go pipe(server, client)
+	go pipe(client, server)
+
+	<-done
+	<-done
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ssoor/socks"
+)
+
+func TestShouldIntercept(t *testing.T) {
+	rules := NewSRules(socks.Direct)
+	if err := rules.ResolveJson([]byte(`{"srules":[{"compilers":[{"type":0,"host":".example.com","url":"/","match":["s@a@a@i"]},{"type":0,"host":"api.example.org","url":"/","match":["s@a@a@i"]}]}]}`)); nil != err {
+		t.Fatal(err)
+	}
+
+	policy := &InterceptPolicy{never: make(map[string]bool)}
+	policy.SetNeverIntercept([]string{" Pay.Example.com ", ".bank.example.com", ""})
+
+	cases := []struct {
+		host      string
+		intercept bool
+		reason    string
+	}{
+		{"", true, "no_sni"},
+		{"www.example.com", true, "rule"},
+		{"WWW.EXAMPLE.COM", true, "rule"},
+		{"pay.example.com", false, "never"},
+		{"checkout.pay.example.com", true, "rule"}, // 绝对匹配不包含子域名
+		{"bank.example.com", false, "never"},
+		{"login.bank.example.com", false, "never"},
+		{"api.example.org", true, "rule"},
+		{"www.example.org", false, "no_rule"},
+	}
+
+	for _, c := range cases {
+		if intercept, reason := policy.ShouldIntercept(rules, c.host); c.intercept != intercept || c.reason != reason {
+			t.Fatalf("%s: intercept = %v, reason = %s", c.host, intercept, reason)
+		}
+	}
+
+	if hosts := policy.NeverIntercept(); false == reflect.DeepEqual([]string{".bank.example.com", "pay.example.com"}, hosts) {
+		t.Fatalf("never intercept = %v", hosts)
+	}
+
+	if err := policy.AddNeverIntercept("."); nil == err {
+		t.Fatal("expect error adding global host")
+	}
+
+	if err := policy.AddNeverIntercept(".EXAMPLE.org"); nil != err {
+		t.Fatal(err)
+	}
+
+	if intercept, reason := policy.ShouldIntercept(rules, "api.example.org"); intercept || "never" != reason {
+		t.Fatalf("api.example.org: intercept = %v, reason = %s", intercept, reason)
+	}
+
+	if false == policy.RemoveNeverIntercept(".example.org") || policy.RemoveNeverIntercept(".example.org") {
+		t.Fatal("expect remove to report existing host once")
+	}
+
+	policy.SetNeverIntercept([]string{"."}) // 全局规则不解密任何连接
+	if intercept, reason := policy.ShouldIntercept(rules, "www.example.com"); intercept || "never" != reason {
+		t.Fatalf("global: intercept = %v, reason = %s", intercept, reason)
+	}
+}
+
+func TestSelectiveListenerClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	selective := newSelectiveListener(listener, "test", NewSRules(socks.Direct))
+	selective.Close()
+
+	if _, err := selective.Accept(); nil == err {
+		t.Fatal("expect accept error after close")
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		selective.serve(server) // 没有 http.Server 读取时不能阻塞
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve blocked after close")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); io.EOF != err {
+		t.Fatalf("expect closed connection, err = %v", err)
+	}
+}
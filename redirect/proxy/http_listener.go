@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ListenerState 为代理监听端口的运行状态
+type ListenerState struct {
+	Name     string    `json:"name"`
+	Addr     string    `json:"addr"`
+	Up       bool      `json:"up"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type ListenerRegistry struct {
+	mutex  sync.Mutex
+	states map[string]*ListenerState
+}
+
+var Listeners = &ListenerRegistry{states: make(map[string]*ListenerState)}
+
+func (r *ListenerRegistry) up(name string, addr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state, exist := r.states[name]
+	if false == exist {
+		state = &ListenerState{Name: name}
+		r.states[name] = state
+	} else {
+		state.Restarts++
+	}
+
+	state.Up = true
+	state.Addr = addr
+	state.Error = ""
+	state.Since = time.Now()
+}
+
+func (r *ListenerRegistry) down(name string, addr string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state, exist := r.states[name]
+	if false == exist {
+		state = &ListenerState{Name: name}
+		r.states[name] = state
+	}
+
+	state.Up = false
+	state.Addr = addr
+	state.Since = time.Now()
+	if nil != err {
+		state.Error = err.Error()
+	}
+}
+
+func (r *ListenerRegistry) States() []ListenerState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	states := make([]ListenerState, 0, len(r.states))
+	for _, state := range r.states {
+		states = append(states, *state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
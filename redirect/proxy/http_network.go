@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrorNetworkReset = errors.New("connection reset by network simulation")
+
+// NetworkProfile 为模拟的网络状况, 速度为 0 时不限制
+type NetworkProfile struct {
+	Name         string  `json:"name"`
+	LatencyMS    int     `json:"latency_ms"` // 建立连接及发送每个请求前增加的延迟
+	JitterMS     int     `json:"jitter_ms"`  // 延迟随机增加 0 至该值
+	DownloadKbps int     `json:"download_kbps"`
+	UploadKbps   int     `json:"upload_kbps"`
+	ResetRate    float64 `json:"reset_rate"` // 响应在传输过程中被重置的概率, 0 至 1
+}
+
+// 内置的网络状况, 延迟及速度参考浏览器开发者工具的预设
+var builtinNetworkProfiles = []NetworkProfile{
+	{Name: "slow-3g", LatencyMS: 2000, DownloadKbps: 400, UploadKbps: 400},
+	{Name: "3g", LatencyMS: 563, DownloadKbps: 1440, UploadKbps: 675},
+	{Name: "4g", LatencyMS: 170, DownloadKbps: 9000, UploadKbps: 9000},
+	{Name: "flaky-wifi", LatencyMS: 40, JitterMS: 300, DownloadKbps: 5000, UploadKbps: 2000, ResetRate: 0.05},
+}
+
+// NetworkConditions 保存可用的网络状况及全局使用的网络状况, 规则可通过 network 字段单独指定
+type NetworkConditions struct {
+	mutex    sync.RWMutex
+	profiles map[string]NetworkProfile
+	global   string
+}
+
+var Networks = newNetworkConditions()
+
+func newNetworkConditions() *NetworkConditions {
+	conditions := &NetworkConditions{profiles: make(map[string]NetworkProfile)}
+	for _, profile := range builtinNetworkProfiles {
+		conditions.profiles[profile.Name] = profile
+	}
+
+	return conditions
+}
+
+// AddProfiles 添加自定义网络状况, 名称相同时覆盖内置的网络状况
+func (n *NetworkConditions) AddProfiles(profiles []NetworkProfile) error {
+	for _, profile := range profiles {
+		if "" == profile.Name || profile.LatencyMS < 0 || profile.JitterMS < 0 || profile.DownloadKbps < 0 || profile.UploadKbps < 0 || profile.ResetRate < 0 || profile.ResetRate > 1 {
+			return errors.New("invalid network profile " + profile.Name)
+		}
+	}
+
+	n.mutex.Lock()
+	for _, profile := range profiles {
+		n.profiles[profile.Name] = profile
+	}
+	n.mutex.Unlock()
+
+	return nil
+}
+
+// SetGlobal 设置所有请求使用的网络状况, 为空时不模拟
+func (n *NetworkConditions) SetGlobal(name string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, exist := n.profiles[name]; false == exist && "" != name {
+		return errors.New("unknown network profile " + name)
+	}
+
+	n.global = name
+	return nil
+}
+
+func (n *NetworkConditions) Global() string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.global
+}
+
+func (n *NetworkConditions) Profiles() []NetworkProfile {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	profiles := make([]NetworkProfile, 0, len(n.profiles))
+	for _, profile := range n.profiles {
+		profiles = append(profiles, profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+func (n *NetworkConditions) Profile(name string) (NetworkProfile, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	profile, exist := n.profiles[name]
+	return profile, exist
+}
+
+// resolve 返回请求使用的网络状况, 规则指定的优先于全局设置
+func (n *NetworkConditions) resolve(rule string) (NetworkProfile, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	name := rule
+	if "" == name {
+		name = n.global
+	}
+
+	profile, exist := n.profiles[name]
+	return profile, exist
+}
+
+type networkProfileKey struct{}
+
+func withNetworkProfile(ctx context.Context, profile NetworkProfile) context.Context {
+	return context.WithValue(ctx, networkProfileKey{}, profile)
+}
+
+func networkProfileOf(ctx context.Context) (NetworkProfile, bool) {
+	profile, ok := ctx.Value(networkProfileKey{}).(NetworkProfile)
+	return profile, ok
+}
+
+// delay 等待一次延迟, 请求被取消时返回错误
+func (p NetworkProfile) delay(ctx context.Context) error {
+	latency := time.Duration(p.LatencyMS) * time.Millisecond
+	if 0 < p.JitterMS {
+		latency += time.Duration(rand.Int63n(int64(p.JitterMS) * int64(time.Millisecond)))
+	}
+
+	if 0 == latency {
+		return nil
+	}
+
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// networkDial 在建立连接前按请求的网络状况增加延迟, 模拟握手耗时
+func networkDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if profile, ok := networkProfileOf(ctx); ok {
+			if err := profile.delay(ctx); nil != err {
+				return nil, err
+			}
+		}
+
+		return dial(ctx, network, addr)
+	}
+}
+
+// throttledBody 按速度限制读取, 设置 resetAfter 时读取该数量的字节 (或到达结尾) 后返回 ErrorNetworkReset
+type throttledBody struct {
+	io.ReadCloser
+	ctx        context.Context
+	rate       int64 // 字节/秒
+	resetAfter int64 // 小于 0 时不重置
+
+	started time.Time
+	total   int64
+}
+
+func newThrottledBody(ctx context.Context, body io.ReadCloser, kbps int, resetRate float64) io.ReadCloser {
+	resetAfter := int64(-1)
+	if 0 < resetRate && rand.Float64() < resetRate {
+		resetAfter = rand.Int63n(64 * 1024)
+	}
+
+	if 0 == kbps && 0 > resetAfter {
+		return body
+	}
+
+	return &throttledBody{ReadCloser: body, ctx: ctx, rate: int64(kbps) * 1000 / 8, resetAfter: resetAfter, started: time.Now()}
+}
+
+func (b *throttledBody) Read(data []byte) (int, error) {
+	if 0 <= b.resetAfter {
+		if b.total >= b.resetAfter {
+			contextLog(b.ctx).With("bytes", b.total).Info("Reset connection by network simulation")
+			return 0, ErrorNetworkReset
+		}
+
+		if remain := b.resetAfter - b.total; int64(len(data)) > remain {
+			data = data[:remain]
+		}
+	}
+
+	if 0 < b.rate { // 每次最多读取 100ms 的数据量, 使速度平滑
+		if chunk := b.rate/10 + 1; int64(len(data)) > chunk {
+			data = data[:chunk]
+		}
+	}
+
+	n, err := b.ReadCloser.Read(data)
+	b.total += int64(n)
+
+	if io.EOF == err && 0 <= b.resetAfter { // 响应比重置位置短时在结束前重置
+		contextLog(b.ctx).With("bytes", b.total).Info("Reset connection by network simulation")
+		err = ErrorNetworkReset
+	}
+
+	if 0 < b.rate {
+		wait := time.Duration(b.total*int64(time.Second)/b.rate) - time.Since(b.started)
+		if 0 < wait {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-b.ctx.Done():
+				timer.Stop()
+				return n, b.ctx.Err()
+			}
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ssoor/socks"
+)
+
+func TestThrottledBodyRate(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 3000)
+	body := newThrottledBody(context.Background(), io.NopCloser(bytes.NewReader(data)), 80, 0) // 10000 字节/秒
+
+	started := time.Now()
+	out, err := io.ReadAll(body)
+	if nil != err || false == bytes.Equal(data, out) {
+		t.Fatalf("read %d bytes, err = %v", len(out), err)
+	}
+
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("elapsed = %v, want about 300ms", elapsed)
+	}
+}
+
+func TestThrottledBodyReset(t *testing.T) {
+	for _, size := range []int{10, 256 * 1024} {
+		body := newThrottledBody(context.Background(), io.NopCloser(bytes.NewReader(make([]byte, size))), 0, 1)
+
+		out, err := io.ReadAll(body)
+		if ErrorNetworkReset != err {
+			t.Fatalf("size %d: err = %v, want ErrorNetworkReset", size, err)
+		}
+
+		if len(out) > size || len(out) > 64*1024 {
+			t.Fatalf("size %d: read %d bytes before reset", size, len(out))
+		}
+	}
+
+	body := io.NopCloser(bytes.NewReader(nil))
+	if body != newThrottledBody(context.Background(), body, 0, 0) {
+		t.Fatal("expect body unchanged without limits")
+	}
+}
+
+func TestNetworkProfileResolve(t *testing.T) {
+	rules := NewSRules(socks.Direct)
+	if err := rules.ResolveJson([]byte(`{"srules":[{"compilers":[{"type":0,"host":"m.example.com","url":"/api/","match":["s@a@a@i"],"network":"slow-3g"}]}]}`)); nil != err {
+		t.Fatal(err)
+	}
+
+	defer func(global string) { Networks.SetGlobal(global) }(Networks.Global())
+
+	api, _ := url.Parse("http://m.example.com/api/list")
+	page, _ := url.Parse("http://m.example.com/index.html")
+
+	if _, simulated := rules.networkProfile(page); simulated {
+		t.Fatal("expect no simulation without global profile")
+	}
+
+	if err := Networks.SetGlobal("3g"); nil != err {
+		t.Fatal(err)
+	}
+
+	if profile, _ := rules.networkProfile(api); "slow-3g" != profile.Name {
+		t.Fatalf("rule profile = %s", profile.Name)
+	}
+
+	if profile, _ := rules.networkProfile(page); "3g" != profile.Name {
+		t.Fatalf("global profile = %s", profile.Name)
+	}
+
+	if err := Networks.SetGlobal("unknown"); nil == err {
+		t.Fatal("expect unknown profile error")
+	}
+}
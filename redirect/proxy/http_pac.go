@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ssoor/tracksocks/log"
+)
+
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+var pacTemplate = template.Must(template.New("pac").Parse(`// generated by tracksocks at {{.Generated}}
+var exactHosts = {{.Exact}};
+var suffixHosts = {{.Suffix}};
+var globalRule = {{.Global}};
+
+function matchRule(host) {
+	host = host.toLowerCase();
+	if (globalRule || exactHosts.hasOwnProperty(host)) {
+		return true;
+	}
+
+	var domain = "." + host;
+	while (true) {
+		if (suffixHosts.hasOwnProperty(domain)) {
+			return true;
+		}
+
+		var next = domain.indexOf(".", 1);
+		if (-1 == next) {
+			return false;
+		}
+		domain = domain.substring(next);
+	}
+}
+
+function FindProxyForURL(url, host) {
+	if (!matchRule(host)) {
+		return "DIRECT";
+	}
+
+	if ("https:" == url.substring(0, 6).toLowerCase()) {
+		return {{.HTTPS}};
+	}
+
+	return {{.HTTP}};
+}
+`))
+
+// PACServer 根据当前规则及代理监听地址生成 /proxy.pac, 只有存在规则的 host 经过代理
+type PACServer struct {
+	Rules *SRules
+
+	// HTTPListener 与 HTTPSListener 为 Listeners 中的监听名称, 为空或未运行时使用 DIRECT
+	HTTPListener  string
+	HTTPSListener string
+}
+
+// listenerProxy 返回 PAC 中使用的代理描述, 监听 0.0.0.0 时使用请求 PAC 的地址
+func (p *PACServer) listenerProxy(name string, requestHost string) string {
+	if "" == name {
+		return "DIRECT"
+	}
+
+	for _, state := range Listeners.States() {
+		if state.Name != name || false == state.Up {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(state.Addr)
+		if nil != err {
+			return "DIRECT"
+		}
+
+		if ip := net.ParseIP(host); "" == host || (nil != ip && ip.IsUnspecified()) {
+			if host, _, err = net.SplitHostPort(requestHost); nil != err {
+				host = "127.0.0.1"
+			}
+		}
+
+		return "PROXY " + net.JoinHostPort(host, port)
+	}
+
+	return "DIRECT"
+}
+
+// Generate 生成 PAC 脚本, 每次均使用当前规则, 规则变化后无需重启
+func (p *PACServer) Generate(requestHost string) ([]byte, error) {
+	exact, suffix, global := make(map[string]bool), make(map[string]bool), false
+	for _, host := range p.Rules.Hosts() {
+		switch {
+		case "." == host:
+			global = true
+		case strings.HasPrefix(host, "."):
+			suffix[host] = true
+		default:
+			exact[host] = true
+		}
+	}
+
+	marshal := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+
+	var buf bytes.Buffer
+	err := pacTemplate.Execute(&buf, map[string]string{
+		"Generated": time.Now().Format(time.RFC3339),
+		"Exact":     marshal(exact),
+		"Suffix":    marshal(suffix),
+		"Global":    marshal(global),
+		"HTTP":      marshal(p.listenerProxy(p.HTTPListener, requestHost)),
+		"HTTPS":     marshal(p.listenerProxy(p.HTTPSListener, requestHost)),
+	})
+
+	return buf.Bytes(), err
+}
+
+func (p *PACServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if "/proxy.pac" != r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := p.Generate(r.Host)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 生成时间不参与 ETag 计算, 规则及地址不变时客户端可以使用缓存
+	content := data[bytes.IndexByte(data, '\n')+1:]
+	sum := sha1.Sum(content)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("Content-Type", PACContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if etag == r.Header.Get("If-None-Match") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Write(data)
+}
+
+func StartPACServer(addr string, server *PACServer) {
+	listener, err := net.Listen("tcp", addr)
+	if nil == err {
+		Listeners.up("pac", addr)
+		err = http.Serve(listener, server)
+	}
+
+	Listeners.down("pac", addr, err)
+	if nil != err {
+		log.Error("Start PAC server at ", addr, " failed, err:", err)
+	}
+}
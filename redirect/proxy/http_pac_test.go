@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/socks"
+)
+
+// pacValue 读取生成脚本中的变量或返回值
+func pacValue(t *testing.T, script string, pattern string, v interface{}) {
+	match := regexp.MustCompile(pattern).FindStringSubmatch(script)
+	if nil == match {
+		t.Fatalf("%s not found in:\n%s", pattern, script)
+	}
+
+	if err := json.Unmarshal([]byte(match[1]), v); nil != err {
+		t.Fatalf("%s: %v", pattern, err)
+	}
+}
+
+func newPACRules(t *testing.T, hosts ...string) *SRules {
+	compilers := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		compilers = append(compilers, `{"type":0,"host":"`+host+`","url":"/","match":["s@a@a@i"]}`)
+	}
+
+	rules := NewSRules(socks.Direct)
+	if err := rules.ResolveJson([]byte(`{"srules":[{"compilers":[` + strings.Join(compilers, ",") + `]}]}`)); nil != err {
+		t.Fatal(err)
+	}
+
+	return rules
+}
+
+func TestPACGenerate(t *testing.T) {
+	Listeners.up("pac-test-http", "127.0.0.1:8080")
+	Listeners.up("pac-test-any", "0.0.0.0:8888")
+	Listeners.up("pac-test-any6", "[::]:8888")
+	Listeners.down("pac-test-down", "127.0.0.1:8443", errors.New("address in use"))
+
+	cases := []struct {
+		name        string
+		hosts       []string
+		http        string
+		https       string
+		requestHost string
+		exact       map[string]bool
+		suffix      map[string]bool
+		global      bool
+		httpProxy   string
+		httpsProxy  string
+	}{
+		{"hosts", []string{"API.example.com", ".example.org"}, "pac-test-http", "pac-test-down", "127.0.0.1:44366",
+			map[string]bool{"api.example.com": true}, map[string]bool{".example.org": true}, false, "PROXY 127.0.0.1:8080", "DIRECT"},
+		{"global", []string{".", "api.example.com"}, "pac-test-http", "pac-test-http", "127.0.0.1:44366",
+			map[string]bool{"api.example.com": true}, map[string]bool{}, true, "PROXY 127.0.0.1:8080", "PROXY 127.0.0.1:8080"},
+		{"no listener", []string{"api.example.com"}, "", "pac-test-missing", "127.0.0.1:44366",
+			map[string]bool{"api.example.com": true}, map[string]bool{}, false, "DIRECT", "DIRECT"},
+		{"unspecified", nil, "pac-test-any", "pac-test-any6", "192.168.1.5:44366",
+			map[string]bool{}, map[string]bool{}, false, "PROXY 192.168.1.5:8888", "PROXY 192.168.1.5:8888"}, // 使用请求 PAC 的地址
+		{"unspecified ipv6", nil, "pac-test-any", "pac-test-any6", "[fe80::1]:44366",
+			map[string]bool{}, map[string]bool{}, false, "PROXY [fe80::1]:8888", "PROXY [fe80::1]:8888"},
+		{"request host without port", nil, "pac-test-any", "", "localhost",
+			map[string]bool{}, map[string]bool{}, false, "PROXY 127.0.0.1:8888", "DIRECT"},
+	}
+
+	for _, c := range cases {
+		server := &PACServer{Rules: newPACRules(t, c.hosts...), HTTPListener: c.http, HTTPSListener: c.https}
+
+		data, err := server.Generate(c.requestHost)
+		if nil != err {
+			t.Fatal(err)
+		}
+		script := string(data)
+
+		var exact, suffix map[string]bool
+		var global bool
+		var httpProxy, httpsProxy string
+		pacValue(t, script, `var exactHosts = (.*);`, &exact)
+		pacValue(t, script, `var suffixHosts = (.*);`, &suffix)
+		pacValue(t, script, `var globalRule = (.*);`, &global)
+		pacValue(t, script, `return (".*");\n\t}\n\n\treturn`, &httpsProxy)
+		pacValue(t, script, `return (".*");\n}\n$`, &httpProxy)
+
+		if false == reflect.DeepEqual(c.exact, exact) || false == reflect.DeepEqual(c.suffix, suffix) || c.global != global {
+			t.Fatalf("%s: exact = %v, suffix = %v, global = %v", c.name, exact, suffix, global)
+		}
+
+		if c.httpProxy != httpProxy || c.httpsProxy != httpsProxy {
+			t.Fatalf("%s: http = %s, https = %s", c.name, httpProxy, httpsProxy)
+		}
+	}
+}
+
+func TestPACServeHTTP(t *testing.T) {
+	Listeners.up("pac-test-serve", "127.0.0.1:8080")
+	server := &PACServer{Rules: newPACRules(t, "api.example.com"), HTTPListener: "pac-test-serve"}
+
+	get := func(path string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:44366"+path, nil)
+		if "" != etag {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := get("/proxy.pac", "")
+	etag := first.Header().Get("ETag")
+	if http.StatusOK != first.Code || PACContentType != first.Header().Get("Content-Type") || "" == etag {
+		t.Fatalf("status = %d, header = %v", first.Code, first.Header())
+	}
+
+	body, _ := ioutil.ReadAll(first.Body)
+	if false == strings.HasPrefix(string(body), "// generated by tracksocks at ") || false == strings.Contains(string(body), "function FindProxyForURL(url, host)") {
+		t.Fatalf("script = %s", body)
+	}
+
+	sum := sha1.Sum(body[bytes.IndexByte(body, '\n')+1:]) // 第一行的生成时间不参与计算
+	if `"`+hex.EncodeToString(sum[:8])+`"` != etag {
+		t.Fatalf("etag = %s", etag)
+	}
+
+	cached := get("/proxy.pac", etag)
+	if http.StatusNotModified != cached.Code || 0 != cached.Body.Len() {
+		t.Fatalf("cached status = %d, body = %q", cached.Code, cached.Body.String())
+	}
+
+	Listeners.down("pac-test-serve", "127.0.0.1:8080", nil)
+	if changed := get("/proxy.pac", etag); http.StatusOK != changed.Code || etag == changed.Header().Get("ETag") { // 监听状态变化后重新下载
+		t.Fatalf("changed status = %d, etag = %s", changed.Code, changed.Header().Get("ETag"))
+	}
+
+	if missing := get("/other.pac", ""); http.StatusNotFound != missing.Code {
+		t.Fatalf("missing status = %d", missing.Code)
+	}
+}
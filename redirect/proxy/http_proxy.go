@@ -2,17 +2,25 @@ package proxy
 
 import (
 	"time"
+	"net"
 	"crypto/tls"
 	"net/http"
 
 	"github.com/ssoor/socks"
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 )
 
 func StartHTTPProxy(addr string, router socks.Dialer, tran *HTTPTransport) {
 	handler := socks.NewHTTPProxyHandler("http", router, tran)
 
-	if err := http.ListenAndServe(addr, handler); nil != err {
+	listener, err := net.Listen("tcp", addr)
+	if nil == err {
+		Listeners.up("http", addr)
+		err = http.Serve(newMetricsListener(listener, "http"), handler)
+	}
+
+	Listeners.down("http", addr, err)
+	if nil != err {
 		log.Error("Start HTTP proxy at ", addr, " failed, err:", err)
 	}
 }
@@ -21,6 +29,7 @@ func StartEncodeHTTPProxy(addr string, router socks.Dialer, tran *HTTPTransport)
 	if addr != "" {
 		listener, err := NewEncodeListener(addr)
 		if err != nil {
+			Listeners.down("http", addr, err)
 			log.Error("NewEncodeListener at ", addr, " failed, err:", err)
 			return
 		}
@@ -29,8 +38,11 @@ func StartEncodeHTTPProxy(addr string, router socks.Dialer, tran *HTTPTransport)
 
 		handler := socks.NewHTTPProxyHandler("http", router, tran)
 
+		Listeners.up("http", addr)
+		err = http.Serve(newMetricsListener(listener, "http"), handler)
+		Listeners.down("http", addr, err)
 
-		if err := http.Serve(listener, handler); nil != err {
+		if nil != err {
 			log.Error("Start HTTP encode proxy at ", addr, " failed, err:", err)
 		}
 		
@@ -40,9 +52,13 @@ func StartEncodeHTTPProxy(addr string, router socks.Dialer, tran *HTTPTransport)
 
 func HTTPSGetCertificate(clientHello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
 	if cert, err = QueryTlsCertificate(clientHello.ServerName); nil == err {
+		metricCertCache.Add(1, "hit")
 		return cert, err
 	}
 
+	metricCertCache.Add(1, "miss")
+	defer metricCertIssue.ObserveSince(time.Now())
+
 	return CreateTlsCertificate(nil, clientHello.ServerName, -(365 * 24 * time.Hour), 200)
 }
 
@@ -50,6 +66,7 @@ func StartEncodeHTTPSProxy(addr string, router socks.Dialer, tran *HTTPTransport
 	if addr != "" {
 		listener, err := NewEncodeListener(addr)
 		if err != nil {
+			Listeners.down("https", addr, err)
 			log.Error("NewEncodeListener at ", addr, " failed, err:", err)
 			return
 		}
@@ -65,7 +82,11 @@ func StartEncodeHTTPSProxy(addr string, router socks.Dialer, tran *HTTPTransport
 			Handler: socks.NewHTTPProxyHandler("https", router, tran),
 		}
 
-	if err := serverHTTPS.ServeTLS(listener, "", ""); nil != err {
+	Listeners.up("https", addr)
+	err = serverHTTPS.ServeTLS(newSelectiveListener(newMetricsListener(listener, "https"), "https", tran.Rules), "", "")
+	Listeners.down("https", addr, err)
+
+	if nil != err {
 		log.Error("Start HTTPS encode proxy at ", addr, " failed, err:", err)
 	}
 	}
@@ -82,7 +103,14 @@ func StartHTTPSProxy(addr string, router socks.Dialer, tran *HTTPTransport) {
 		Handler: socks.NewHTTPProxyHandler("https", router, tran),
 	}
 
-	if err := serverHTTPS.ListenAndServeTLS("", ""); nil != err {
+	listener, err := net.Listen("tcp", addr)
+	if nil == err {
+		Listeners.up("https", addr)
+		err = serverHTTPS.ServeTLS(newSelectiveListener(newMetricsListener(listener, "https"), "https", tran.Rules), "", "")
+	}
+
+	Listeners.down("https", addr, err)
+	if nil != err {
 		log.Error("Start HTTP proxy at ", addr, " failed, err:", err)
 	}
 }
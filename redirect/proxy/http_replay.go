@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MaxReplayRepeat      = 10000
+	MaxReplayConcurrency = 100
+	MaxReplayBodySize    = 1 << 20
+)
+
+var (
+	ErrorReplayNoTransport = errors.New("replay transport is not ready")
+	ErrorReplayNotFound    = errors.New("replay record not found")
+	ErrorReplayTruncated   = errors.New("recorded request body is truncated, provide body to replay")
+)
+
+// ReplayRequest 描述需要重新发送的请求, ID 不为 0 时以对应记录为模板, 其余字段覆盖记录内容
+type ReplayRequest struct {
+	ID           uint64      `json:"id"`
+	Method       string      `json:"method,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         *string     `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"` // base64 或空
+	Repeat       int         `json:"repeat,omitempty"`
+	Concurrency  int         `json:"concurrency,omitempty"`
+}
+
+type ReplayResult struct {
+	RequestID    string      `json:"request_id,omitempty"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	Size         int64       `json:"size"`
+	Duration     float64     `json:"duration"` // 毫秒
+	Error        string      `json:"error,omitempty"`
+}
+
+type ReplaySummary struct {
+	Count       int         `json:"count"`
+	Concurrency int         `json:"concurrency"`
+	Errors      int         `json:"errors"`
+	Status      map[int]int `json:"status"`
+	Duration    float64     `json:"duration"` // 全部请求完成的总耗时, 毫秒
+	Min         float64     `json:"min"`
+	Avg         float64     `json:"avg"`
+	Max         float64     `json:"max"`
+	P50         float64     `json:"p50"`
+	P95         float64     `json:"p95"`
+
+	First ReplayResult `json:"first"` // 第一个请求的完整响应
+}
+
+// Replayer 通过与代理相同的 SRules 路由重新发送请求
+type Replayer struct {
+	mutex     sync.Mutex
+	transport http.RoundTripper
+}
+
+var Replay = &Replayer{}
+
+func (r *Replayer) SetTransport(transport http.RoundTripper) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.transport = transport
+}
+
+type replayTemplate struct {
+	method string
+	url    string
+	header http.Header
+	body   []byte
+}
+
+func (r *Replayer) template(request ReplayRequest) (template replayTemplate, err error) {
+	if 0 != request.ID {
+		record, exist := Inspector.Record(request.ID)
+		if false == exist {
+			return template, ErrorReplayNotFound
+		}
+
+		if record.RequestBodyTruncated && nil == request.Body {
+			return template, ErrorReplayTruncated
+		}
+
+		template.method = record.Method
+		template.url = record.URL
+		template.header = record.RequestHeader
+
+		if template.body, err = decodeReplayBody(record.RequestBody, record.RequestBodyEncoding); nil != err {
+			return template, err
+		}
+	}
+
+	if "" != request.Method {
+		template.method = request.Method
+	}
+	if "" != request.URL {
+		template.url = request.URL
+	}
+	if nil != request.Header {
+		template.header = request.Header
+	}
+	if nil != request.Body {
+		if template.body, err = decodeReplayBody(*request.Body, request.BodyEncoding); nil != err {
+			return template, err
+		}
+	}
+
+	if "" == template.method {
+		template.method = http.MethodGet
+	}
+	if nil == template.header {
+		template.header = http.Header{}
+	}
+
+	return template, nil
+}
+
+func decodeReplayBody(body string, encoding string) ([]byte, error) {
+	if "base64" == encoding {
+		return base64.StdEncoding.DecodeString(body)
+	}
+
+	return []byte(body), nil
+}
+
+func (r *Replayer) send(transport http.RoundTripper, template replayTemplate, full bool) (result ReplayResult) {
+	started := time.Now()
+	defer func() {
+		result.Duration = harMilliseconds(time.Since(started))
+	}()
+
+	req, err := http.NewRequest(template.method, template.url, bytes.NewReader(template.body))
+	if nil != err {
+		result.Error = err.Error()
+		return result
+	}
+
+	req.Header = template.header.Clone()
+	req.Header.Del("Content-Length")
+	if 0 == len(template.body) {
+		req.Body = http.NoBody
+	}
+
+	req, result.RequestID = withRequestID(req)
+	resp, err := transport.RoundTrip(req)
+	if nil != err {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if errorText := resp.Header.Get("X-Request-Error"); "" != errorText {
+		result.Error = errorText
+	}
+
+	if false == full {
+		result.Size, _ = io.Copy(ioutil.Discard, resp.Body)
+		return result
+	}
+
+	body := newCaptureBody(resp.Body, MaxReplayBodySize, nil)
+	io.Copy(ioutil.Discard, body)
+
+	content := harContent(resp.Header, body.data.Bytes(), body.size, body.truncated)
+
+	result.Size = body.size
+	result.Header = resp.Header
+	result.Body, result.BodyEncoding = content.Text, content.Encoding
+
+	return result
+}
+
+// Replay 发送请求 Repeat 次, 同时最多 Concurrency 个, 并返回统计结果
+func (r *Replayer) Replay(request ReplayRequest) (summary ReplaySummary, err error) {
+	r.mutex.Lock()
+	transport := r.transport
+	r.mutex.Unlock()
+
+	if nil == transport {
+		return summary, ErrorReplayNoTransport
+	}
+
+	template, err := r.template(request)
+	if nil != err {
+		return summary, err
+	}
+
+	summary.Count, summary.Concurrency = request.Repeat, request.Concurrency
+	if 0 >= summary.Count {
+		summary.Count = 1
+	} else if summary.Count > MaxReplayRepeat {
+		summary.Count = MaxReplayRepeat
+	}
+	if 0 >= summary.Concurrency {
+		summary.Concurrency = 1
+	} else if summary.Concurrency > MaxReplayConcurrency {
+		summary.Concurrency = MaxReplayConcurrency
+	}
+
+	started := time.Now()
+	results := make([]ReplayResult, summary.Count)
+
+	var wait sync.WaitGroup
+	indexs := make(chan int)
+	for i := 0; i < summary.Concurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			for index := range indexs {
+				results[index] = r.send(transport, template, 0 == index)
+			}
+		}()
+	}
+
+	for i := 0; i < summary.Count; i++ {
+		indexs <- i
+	}
+	close(indexs)
+	wait.Wait()
+
+	summary.Duration = harMilliseconds(time.Since(started))
+	summary.First = results[0]
+	summary.Status = make(map[int]int)
+
+	durations := make([]float64, 0, len(results))
+	for _, result := range results {
+		if "" != result.Error {
+			summary.Errors++
+		}
+
+		summary.Status[result.Status]++
+		summary.Avg += result.Duration
+		durations = append(durations, result.Duration)
+	}
+
+	sort.Float64s(durations)
+	summary.Min = durations[0]
+	summary.Max = durations[len(durations)-1]
+	summary.Avg /= float64(len(durations))
+	summary.P50 = durations[len(durations)*50/100]
+	summary.P95 = durations[len(durations)*95/100]
+
+	return summary, nil
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ssoor/socks"
+)
+
+// newReplayUpstream 返回请求的方法、路径、X-Test 头部及内容
+func newReplayUpstream(count *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s x=%s body=%s", r.Method, r.URL.Path, r.Header.Get("X-Test"), body)
+	}))
+}
+
+func TestReplayRecord(t *testing.T) {
+	var count int32
+	server := newReplayUpstream(&count)
+	defer server.Close()
+
+	Inspector.Configure(DefaultInspectorRecords, DefaultInspectorBodySize)
+	defer Inspector.Configure(DefaultInspectorRecords, DefaultInspectorBodySize)
+
+	transport := NewHTTPTransport(socks.Direct, []byte(`{}`))
+	if _, err := Replay.Replay(ReplayRequest{URL: server.URL}); ErrorReplayNoTransport != err {
+		t.Fatalf("err = %v", err)
+	}
+
+	Replay.SetTransport(transport)
+	defer Replay.SetTransport(nil)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/orig", strings.NewReader("recorded"))
+	req.Header.Set("X-Test", "1")
+	resp, _ := transport.RoundTrip(req)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	records := Inspector.Records("")
+	id := records[len(records)-1].ID
+
+	body, encoded := "edited", "ZGVjb2RlZA=="
+	cases := []struct {
+		name    string
+		request ReplayRequest
+		result  string
+		count   int
+		err     error
+	}{
+		{"recorded", ReplayRequest{ID: id}, "POST /orig x=1 body=recorded", 1, nil},
+		{"edited", ReplayRequest{ID: id, Method: http.MethodPut, Header: http.Header{"X-Test": {"2"}}, Body: &body, Repeat: 5, Concurrency: 2},
+			"PUT /orig x=2 body=edited", 5, nil},
+		{"url", ReplayRequest{ID: id, URL: server.URL + "/other"}, "POST /other x=1 body=recorded", 1, nil},
+		{"base64", ReplayRequest{URL: server.URL + "/new", Body: &encoded, BodyEncoding: "base64"}, "GET /new x= body=decoded", 1, nil},
+		{"not found", ReplayRequest{ID: id + 1000}, "", 0, ErrorReplayNotFound},
+	}
+
+	for _, c := range cases {
+		atomic.StoreInt32(&count, 0)
+
+		summary, err := Replay.Replay(c.request)
+		if c.err != err {
+			t.Fatalf("%s: err = %v", c.name, err)
+		}
+
+		if sent := atomic.LoadInt32(&count); int32(c.count) != sent {
+			t.Fatalf("%s: upstream count = %d", c.name, sent)
+		}
+
+		if nil != err {
+			continue
+		}
+
+		if c.count != summary.Count || c.count != summary.Status[http.StatusOK] || c.result != summary.First.Body || "" == summary.First.RequestID {
+			t.Fatalf("%s: summary = %+v", c.name, summary)
+		}
+	}
+
+	Inspector.Configure(DefaultInspectorRecords, 4)
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/orig", strings.NewReader("recorded"))
+	resp, _ = transport.RoundTrip(req)
+	resp.Body.Close()
+
+	records = Inspector.Records("")
+	if _, err := Replay.Replay(ReplayRequest{ID: records[len(records)-1].ID}); ErrorReplayTruncated != err { // 不完整的内容不能直接重新发送
+		t.Fatalf("truncated err = %v", err)
+	}
+}
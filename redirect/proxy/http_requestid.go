@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ssoor/tracksocks/log"
+)
+
+const DefaultRequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+var requestIDSequence uint64
+
+// newRequestID 生成随机请求编号, 随机数不可用时使用启动时间加序号
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); nil == err {
+		return hex.EncodeToString(buf)
+	}
+
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&requestIDSequence, 1), 36)
+}
+
+// withRequestID 为请求分配编号并写入 context, 已分配时保持不变
+func withRequestID(req *http.Request) (*http.Request, string) {
+	if id := RequestID(req.Context()); "" != id {
+		return req, id
+	}
+
+	id := newRequestID()
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)), id
+}
+
+// RequestID 返回 context 中的请求编号, 不存在时返回空
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextLog 返回附带请求编号的日志记录器, 用于只能拿到 context 的地方(如建立上游连接)
+func contextLog(ctx context.Context) *log.Entry {
+	if id := RequestID(ctx); "" != id {
+		return log.With("request_id", id)
+	}
+
+	return log.WithFields(nil)
+}
+
+// requestLog 返回附带请求编号及请求信息的日志记录器
+func requestLog(req *http.Request) *log.Entry {
+	return contextLog(req.Context()).WithFields(log.Fields{"host": req.URL.Hostname(), "url": req.URL.String()})
+}
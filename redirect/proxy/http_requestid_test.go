@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/socks"
+
+	"github.com/ssoor/tracksocks/log"
+)
+
+// readRequestLogs 按请求编号汇总日志消息
+func readRequestLogs(t *testing.T, fileName string) map[string][]string {
+	file, err := os.Open(fileName)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	messages := make(map[string][]string)
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var record struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+
+		if err = json.Unmarshal(scanner.Bytes(), &record); nil == err && "" != record.RequestID {
+			messages[record.RequestID] = append(messages[record.RequestID], record.Msg)
+		}
+	}
+
+	return messages
+}
+
+func TestRequestIDRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "proxy.log")
+	if err := log.Setup(log.Setting{File: fileName, Level: "info"}); nil != err {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<p>hello</p>"))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	transport := NewHTTPTransport(socks.Direct, []byte(`{"limits":{"max_response_content_len":65536},"srules":[{"compilers":[
+		{"type":0,"host":"`+host+`","url":"/old","match":["s@/old@/new@i"]},
+		{"type":2,"host":"`+host+`","url":"/new","match":["s@hello@bye@i"]}]}]}`))
+
+	send := func(ctx context.Context) string {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/old", nil)
+		resp, _ := transport.RoundTrip(req)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		return resp.Header.Get(DefaultRequestIDHeader)
+	}
+
+	if id := send(context.Background()); "" != id {
+		t.Fatalf("request id header = %s without RequestIDHeader", id)
+	}
+
+	transport.RequestIDHeader = DefaultRequestIDHeader
+	first, second := send(context.Background()), send(context.Background())
+	if false == regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(first) || first == second {
+		t.Fatalf("request ids = %s, %s", first, second)
+	}
+
+	if id := send(context.WithValue(context.Background(), requestIDKey{}, "replay-1")); "replay-1" != id { // 已分配的编号保持不变
+		t.Fatalf("request id = %s, want replay-1", id)
+	}
+
+	messages := readRequestLogs(t, fileName)
+	for _, id := range []string{first, second, "replay-1"} {
+		if joined := strings.Join(messages[id], ","); "Rewrite request,Injection html successed,Resolve response" != joined {
+			t.Fatalf("%s: messages = %s", id, joined)
+		}
+	}
+}
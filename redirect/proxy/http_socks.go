@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ssoor/socks"
+	"github.com/ssoor/tracksocks/log"
+)
+
+const SocksListenerName = "socks"
+
+const socksHandshakeTimeout = 30 * time.Second
+
+// SOCKS5 (RFC 1928, RFC 1929) 及 SOCKS4/4a 协议常量
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socks5MethodNone     = 0x00
+	socks5MethodPassword = 0x02
+	socks5MethodNoAccept = 0xFF
+	socks5PasswordVer    = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5ReplySucceeded        = 0x00
+	socks5ReplyCmdNotSupported  = 0x07
+	socks5ReplyAtypNotSupported = 0x08
+
+	socks4ReplyGranted  = 0x5A
+	socks4ReplyRejected = 0x5B
+)
+
+var (
+	errorSocksVersion = errors.New("unsupported socks version")
+	errorSocksAuth    = errors.New("socks authentication failed")
+	errorSocksCommand = errors.New("unsupported socks command")
+)
+
+// SocksProxy 为 SOCKS5/SOCKS4a 入站代理, 只支持 CONNECT. 隧道中的 HTTP 及需要解密的 TLS 数据
+// 交给与其他监听端口相同的处理流程, 其余数据直接转发. 设置 Username 后只接受 SOCKS5 用户名密码认证.
+type SocksProxy struct {
+	Transport *HTTPTransport
+	Username  string
+	Password  string
+
+	http  http.Handler
+	https http.Handler
+}
+
+func NewSocksProxy(router socks.Dialer, tran *HTTPTransport) *SocksProxy {
+	return &SocksProxy{
+		Transport: tran,
+		http:      socks.NewHTTPProxyHandler("http", router, tran),
+		https:     socks.NewHTTPProxyHandler("https", router, tran),
+	}
+}
+
+func (s *SocksProxy) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go s.dispatch(conn)
+	}
+}
+
+func (s *SocksProxy) dispatch(conn net.Conn) {
+	client := &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, err := s.handshake(client)
+	conn.SetDeadline(time.Time{})
+
+	if nil != err {
+		log.WithFields(log.Fields{"listener": SocksListenerName, "client": conn.RemoteAddr().String(), "error": err}).Debug("Socks handshake failed")
+		conn.Close()
+		return
+	}
+
+	serveSniffedConn(SocksListenerName, s.Transport.Rules, client, addr, clientFirstTimeout, s.http, s.https)
+}
+
+// handshake 完成 SOCKS 握手并返回 CONNECT 的目标地址
+func (s *SocksProxy) handshake(client *bufferedConn) (string, error) {
+	version, err := client.reader.ReadByte()
+	if nil != err {
+		return "", err
+	}
+
+	switch version {
+	case socks5Version:
+		return s.handshake5(client)
+	case socks4Version:
+		if "" != s.Username { // SOCKS4 无法携带密码
+			client.Write([]byte{0x00, socks4ReplyRejected, 0, 0, 0, 0, 0, 0})
+			return "", errorSocksAuth
+		}
+
+		return s.handshake4(client)
+	}
+
+	return "", errorSocksVersion
+}
+
+func (s *SocksProxy) handshake5(client *bufferedConn) (string, error) {
+	count, err := client.reader.ReadByte()
+	if nil != err {
+		return "", err
+	}
+
+	methods := make([]byte, count)
+	if _, err = io.ReadFull(client.reader, methods); nil != err {
+		return "", err
+	}
+
+	method := byte(socks5MethodNone)
+	if "" != s.Username {
+		method = socks5MethodPassword
+	}
+
+	if false == containsByte(methods, method) {
+		client.Write([]byte{socks5Version, socks5MethodNoAccept})
+		return "", errorSocksAuth
+	}
+
+	if _, err = client.Write([]byte{socks5Version, method}); nil != err {
+		return "", err
+	}
+
+	if socks5MethodPassword == method {
+		if err = s.authenticate5(client); nil != err {
+			return "", err
+		}
+	}
+
+	// VER CMD RSV ATYP
+	var request [4]byte
+	if _, err = io.ReadFull(client.reader, request[:]); nil != err {
+		return "", err
+	}
+
+	if socks5Version != request[0] {
+		return "", errorSocksVersion
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if socks5AtypIPv6 == request[3] {
+			ip = make(net.IP, net.IPv6len)
+		}
+
+		if _, err = io.ReadFull(client.reader, ip); nil != err {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		if host, err = readSocksString(client.reader); nil != err {
+			return "", err
+		}
+	default:
+		client.Write(socks5Reply(socks5ReplyAtypNotSupported))
+		return "", errorSocksCommand
+	}
+
+	var port [2]byte
+	if _, err = io.ReadFull(client.reader, port[:]); nil != err {
+		return "", err
+	}
+
+	if socksCmdConnect != request[1] {
+		client.Write(socks5Reply(socks5ReplyCmdNotSupported))
+		return "", errorSocksCommand
+	}
+
+	if _, err = client.Write(socks5Reply(socks5ReplySucceeded)); nil != err {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// authenticate5 为 RFC 1929 用户名密码认证
+func (s *SocksProxy) authenticate5(client *bufferedConn) error {
+	version, err := client.reader.ReadByte()
+	if nil != err {
+		return err
+	}
+
+	if socks5PasswordVer != version {
+		return errorSocksVersion
+	}
+
+	username, err := readSocksString(client.reader)
+	if nil != err {
+		return err
+	}
+
+	password, err := readSocksString(client.reader)
+	if nil != err {
+		return err
+	}
+
+	userOK := 1 == subtle.ConstantTimeCompare([]byte(username), []byte(s.Username))
+	passOK := 1 == subtle.ConstantTimeCompare([]byte(password), []byte(s.Password))
+	if false == userOK || false == passOK {
+		client.Write([]byte{socks5PasswordVer, 0x01})
+		return errorSocksAuth
+	}
+
+	_, err = client.Write([]byte{socks5PasswordVer, 0x00})
+	return err
+}
+
+func (s *SocksProxy) handshake4(client *bufferedConn) (string, error) {
+	// CMD DSTPORT DSTIP
+	var request [7]byte
+	if _, err := io.ReadFull(client.reader, request[:]); nil != err {
+		return "", err
+	}
+
+	if _, err := client.reader.ReadString(0); nil != err { // USERID
+		return "", err
+	}
+
+	host := net.IP(request[3:7]).String()
+	if 0 == request[3] && 0 == request[4] && 0 == request[5] && 0 != request[6] { // SOCKS4a, 0.0.0.x 后为域名
+		domain, err := client.reader.ReadString(0)
+		if nil != err {
+			return "", err
+		}
+		host = domain[:len(domain)-1]
+	}
+
+	if socksCmdConnect != request[0] {
+		client.Write([]byte{0x00, socks4ReplyRejected, 0, 0, 0, 0, 0, 0})
+		return "", errorSocksCommand
+	}
+
+	if _, err := client.Write([]byte{0x00, socks4ReplyGranted, 0, 0, 0, 0, 0, 0}); nil != err {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(request[1:3])))), nil
+}
+
+func readSocksString(reader *bufio.Reader) (string, error) {
+	size, err := reader.ReadByte()
+	if nil != err {
+		return "", err
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	return string(data), err
+}
+
+// socks5Reply 返回的绑定地址固定为 0.0.0.0:0, 客户端不使用该地址
+func socks5Reply(reply byte) []byte {
+	return []byte{socks5Version, reply, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+func containsByte(data []byte, value byte) bool {
+	for _, b := range data {
+		if value == b {
+			return true
+		}
+	}
+
+	return false
+}
+
+func StartSocksProxy(addr string, username string, password string, router socks.Dialer, tran *HTTPTransport) {
+	server := NewSocksProxy(router, tran)
+	server.Username, server.Password = username, password
+
+	listener, err := net.Listen("tcp", addr)
+	if nil == err {
+		Listeners.up(SocksListenerName, addr)
+		err = server.Serve(newMetricsListener(listener, SocksListenerName))
+	}
+
+	Listeners.down(SocksListenerName, addr, err)
+	if nil != err {
+		log.Error("Start socks proxy at ", addr, " failed, err:", err)
+	}
+}
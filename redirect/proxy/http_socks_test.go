@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	succeeded := socks5Reply(socks5ReplySucceeded)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	cases := []struct {
+		name     string
+		username string
+		request  []byte
+		reply    []byte
+		addr     string
+		err      error
+	}{
+		{"ipv4", "", []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80}, join([]byte{5, 0}, succeeded), "127.0.0.1:80", nil},
+		{"ipv6", "", join([]byte{5, 1, 0, 5, 1, 0, 4}, net.ParseIP("2001:db8::1"), []byte{1, 187}), join([]byte{5, 0}, succeeded), "[2001:db8::1]:443", nil},
+		{"domain", "", join([]byte{5, 2, 2, 0, 5, 1, 0, 3, 11}, []byte("example.com"), []byte{1, 187}), join([]byte{5, 0}, succeeded), "example.com:443", nil},
+		{"password", "user", join([]byte{5, 2, 0, 2, 1, 4}, []byte("user"), []byte{4}, []byte("pass"), []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}),
+			join([]byte{5, 2, 1, 0}, succeeded), "10.0.0.1:80", nil},
+		{"wrong password", "user", join([]byte{5, 1, 2, 1, 4}, []byte("user"), []byte{5}, []byte("wrong")), []byte{5, 2, 1, 1}, "", errorSocksAuth},
+		{"wrong username", "user", join([]byte{5, 1, 2, 1, 5}, []byte("admin"), []byte{4}, []byte("pass")), []byte{5, 2, 1, 1}, "", errorSocksAuth},
+		{"no password method", "user", []byte{5, 1, 0}, []byte{5, 0xFF}, "", errorSocksAuth},
+		{"bind", "", []byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80}, join([]byte{5, 0}, socks5Reply(socks5ReplyCmdNotSupported)), "", errorSocksCommand},
+		{"udp associate", "", []byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0}, join([]byte{5, 0}, socks5Reply(socks5ReplyCmdNotSupported)), "", errorSocksCommand},
+		{"unknown atyp", "", []byte{5, 1, 0, 5, 1, 0, 5}, join([]byte{5, 0}, socks5Reply(socks5ReplyAtypNotSupported)), "", errorSocksCommand},
+		{"socks4", "", join([]byte{4, 1, 0, 80, 192, 168, 1, 1}, []byte("id\x00")), []byte{0, 0x5A, 0, 0, 0, 0, 0, 0}, "192.168.1.1:80", nil},
+		{"socks4a", "", join([]byte{4, 1, 1, 187, 0, 0, 0, 1}, []byte("id\x00example.com\x00")), []byte{0, 0x5A, 0, 0, 0, 0, 0, 0}, "example.com:443", nil},
+		{"socks4 bind", "", join([]byte{4, 2, 0, 80, 192, 168, 1, 1}, []byte("\x00")), []byte{0, 0x5B, 0, 0, 0, 0, 0, 0}, "", errorSocksCommand},
+		{"socks4 with auth", "user", join([]byte{4, 1, 0, 80, 192, 168, 1, 1}, []byte("user\x00")), []byte{0, 0x5B, 0, 0, 0, 0, 0, 0}, "", errorSocksAuth},
+		{"version", "", []byte{6, 1, 0}, nil, "", errorSocksVersion},
+	}
+
+	for _, c := range cases {
+		proxy := &SocksProxy{Username: c.username, Password: "pass"}
+		clientConn, serverConn := net.Pipe()
+
+		type result struct {
+			addr string
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			addr, err := proxy.handshake(&bufferedConn{Conn: serverConn, reader: bufio.NewReader(serverConn)})
+			serverConn.Close()
+			done <- result{addr, err}
+		}()
+
+		go clientConn.Write(c.request)
+
+		reply, _ := io.ReadAll(clientConn)
+		r := <-done
+		clientConn.Close()
+
+		if c.addr != r.addr || c.err != r.err {
+			t.Fatalf("%s: addr = %s, err = %v", c.name, r.addr, r.err)
+		}
+
+		if false == bytes.Equal(c.reply, reply) {
+			t.Fatalf("%s: reply = % x, want % x", c.name, reply, c.reply)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ssoor/socks"
+	"github.com/ssoor/tracksocks/log"
+)
+
+const TransparentListenerName = "transparent"
+
+const (
+	TransparentRedirect = "redirect" // iptables/nftables REDIRECT, 通过 SO_ORIGINAL_DST 获取原始目标
+	TransparentTProxy   = "tproxy"   // TPROXY, 连接的本地地址即原始目标, 支持 IPv6
+)
+
+var (
+	ErrorTransparentUnsupported = errors.New("transparent proxy is only supported on linux")
+	ErrorTransparentLoop        = errors.New("connection not redirected by firewall")
+)
+
+// TransparentProxy 处理被防火墙重定向到本机的连接, 按原始目标及 SNI/Host 交给与其他监听端口相同的处理流程
+type TransparentProxy struct {
+	Transport *HTTPTransport
+	Mode      string
+	Addr      *net.TCPAddr // 监听地址, 原始目标为该地址的连接会转发回自身, Serve 时设置
+
+	http        http.Handler
+	https       http.Handler
+	originalDst func(conn net.Conn, mode string) (*net.TCPAddr, error)
+}
+
+func NewTransparentProxy(mode string, router socks.Dialer, tran *HTTPTransport) *TransparentProxy {
+	if "" == mode {
+		mode = TransparentRedirect
+	}
+
+	return &TransparentProxy{
+		Transport:   tran,
+		Mode:        mode,
+		http:        socks.NewHTTPProxyHandler("http", router, tran),
+		https:       socks.NewHTTPProxyHandler("https", router, tran),
+		originalDst: originalDst,
+	}
+}
+
+func (t *TransparentProxy) Serve(listener net.Listener) error {
+	t.Addr, _ = listener.Addr().(*net.TCPAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go t.dispatch(conn)
+	}
+}
+
+// destination 返回连接的原始目标, 直接连接到监听端口(转发会回到自身)时返回 ErrorTransparentLoop.
+// tproxy 模式下连接的本地地址即原始目标, 因此只能与监听地址比较
+func (t *TransparentProxy) destination(conn net.Conn) (*net.TCPAddr, error) {
+	dst, err := t.originalDst(conn, t.Mode)
+	if nil != err {
+		return nil, err
+	}
+
+	if nil == t.Addr || dst.Port != t.Addr.Port {
+		return dst, nil
+	}
+
+	if t.Addr.IP.IsUnspecified() { // 监听所有地址时检查目标是否为本机地址
+		if isLocalIP(dst.IP) {
+			return nil, ErrorTransparentLoop
+		}
+	} else if t.Addr.IP.Equal(dst.IP) {
+		return nil, ErrorTransparentLoop
+	}
+
+	return dst, nil
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if nil != err {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *TransparentProxy) dispatch(conn net.Conn) {
+	dst, err := t.destination(conn)
+	if ErrorTransparentLoop == err {
+		log.WithFields(log.Fields{"listener": TransparentListenerName, "client": conn.RemoteAddr().String()}).Warning("Refuse connection not redirected by firewall")
+		conn.Close()
+		return
+	}
+
+	if nil != err {
+		log.WithFields(log.Fields{"listener": TransparentListenerName, "client": conn.RemoteAddr().String(), "error": err}).Warning("Get original destination failed")
+		conn.Close()
+		return
+	}
+
+	serveSniffedConn(TransparentListenerName, t.Transport.Rules, &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}, dst.String(), peekClientHelloTimeout, t.http, t.https)
+}
+
+// tcpConnOf 去除 metricsConn 等包装, 获取底层 TCP 连接
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *metricsConn:
+			conn = c.Conn
+		case *bufferedConn:
+			conn = c.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+func StartTransparentProxy(addr string, mode string, router socks.Dialer, tran *HTTPTransport) {
+	transparent := NewTransparentProxy(mode, router, tran)
+
+	listener, err := listenTransparent(addr, transparent.Mode)
+	if nil == err {
+		Listeners.up(TransparentListenerName, addr)
+		err = transparent.Serve(newMetricsListener(listener, TransparentListenerName))
+	}
+
+	Listeners.down(TransparentListenerName, addr, err)
+	if nil != err {
+		log.Error("Start transparent proxy at ", addr, " failed, err:", err)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST, linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST, linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT, linux/in6.h
+)
+
+// listenTransparent 在 tproxy 模式下设置 IP_TRANSPARENT, 允许接收目标地址不属于本机的连接(需要 CAP_NET_ADMIN)
+func listenTransparent(addr string, mode string) (net.Listener, error) {
+	switch mode {
+	case TransparentRedirect:
+		return net.Listen("tcp", addr)
+	case TransparentTProxy:
+	default:
+		return nil, errors.New("unknown transparent mode " + mode)
+	}
+
+	config := net.ListenConfig{
+		Control: func(network, address string, raw syscall.RawConn) error {
+			var err error
+			control := raw.Control(func(fd uintptr) {
+				if strings.HasSuffix(network, "6") {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+
+			if nil != control {
+				return control
+			}
+
+			return err
+		},
+	}
+
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst 返回连接被重定向前的目标地址
+func originalDst(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	tcp, ok := tcpConnOf(conn)
+	if false == ok {
+		return nil, errors.New("not a tcp connection")
+	}
+
+	if TransparentTProxy == mode { // TPROXY 不修改目标地址
+		return tcp.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	raw, err := tcp.SyscallConn()
+	if nil != err {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	ipv4 := nil != tcp.LocalAddr().(*net.TCPAddr).IP.To4()
+
+	control := raw.Control(func(fd uintptr) {
+		if ipv4 {
+			var mreq *syscall.IPv6Mreq // 与 sockaddr_in 大小相同, 只用于接收数据
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); nil == err {
+				addr := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+				dst = &net.TCPAddr{IP: net.IP(addr.Addr[:]).To16(), Port: int(ntohs(addr.Port))}
+			}
+		} else {
+			var info *syscall.IPv6MTUInfo // 第一个字段为 sockaddr_in6
+			if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst); nil == err {
+				dst = &net.TCPAddr{IP: append(net.IP{}, info.Addr.Addr[:]...), Port: int(ntohs(info.Addr.Port))}
+			}
+		}
+	})
+
+	if nil != control {
+		return nil, control
+	}
+
+	if nil != err {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+func ntohs(port uint16) uint16 {
+	data := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(data[0])<<8 | uint16(data[1])
+}
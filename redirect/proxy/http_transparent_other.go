@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+func listenTransparent(addr string, mode string) (net.Listener, error) {
+	return nil, ErrorTransparentUnsupported
+}
+
+func originalDst(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	return nil, ErrorTransparentUnsupported
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ssoor/socks"
+)
+
+func TestTransparentDestination(t *testing.T) {
+	listenAny := &net.TCPAddr{IP: net.IPv4zero, Port: 8889}
+	listenLocal := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8889}
+
+	cases := []struct {
+		name   string
+		mode   string
+		listen *net.TCPAddr
+		dst    string
+		err    error
+	}{
+		{"tproxy foreign target", TransparentTProxy, listenAny, "93.184.216.34:443", nil},
+		{"tproxy ipv6 target", TransparentTProxy, &net.TCPAddr{IP: net.IPv6unspecified, Port: 8889}, "[2606:2800:220:1::1]:443", nil},
+		{"tproxy same port foreign target", TransparentTProxy, listenAny, "93.184.216.34:8889", nil},
+		{"tproxy direct connection", TransparentTProxy, listenAny, "127.0.0.1:8889", ErrorTransparentLoop},
+		{"redirect target", TransparentRedirect, listenLocal, "10.0.0.1:80", nil},
+		{"redirect same port other host", TransparentRedirect, listenLocal, "10.0.0.1:8889", nil},
+		{"redirect direct connection", TransparentRedirect, listenLocal, "127.0.0.1:8889", ErrorTransparentLoop},
+		{"unknown listen address", TransparentRedirect, nil, "127.0.0.1:8889", nil},
+	}
+
+	for _, c := range cases {
+		dst, _ := net.ResolveTCPAddr("tcp", c.dst)
+
+		transparent := NewTransparentProxy(c.mode, socks.Direct, nil)
+		transparent.Addr = c.listen
+		transparent.originalDst = func(conn net.Conn, mode string) (*net.TCPAddr, error) {
+			if c.mode != mode {
+				t.Fatalf("%s: mode = %s", c.name, mode)
+			}
+
+			return dst, nil
+		}
+
+		result, err := transparent.destination(nil)
+		if c.err != err {
+			t.Fatalf("%s: err = %v, want %v", c.name, err, c.err)
+		}
+
+		if nil == c.err && dst != result {
+			t.Fatalf("%s: dst = %v", c.name, result)
+		}
+	}
+
+	failed := errors.New("getsockopt failed")
+	transparent := NewTransparentProxy("", socks.Direct, nil)
+	transparent.originalDst = func(conn net.Conn, mode string) (*net.TCPAddr, error) { return nil, failed }
+
+	if TransparentRedirect != transparent.Mode {
+		t.Fatalf("default mode = %s", transparent.Mode)
+	}
+
+	if _, err := transparent.destination(nil); failed != err {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -3,14 +3,18 @@ package proxy
 import (
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/ssoor/socks"
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 )
 
 type HTTPTransport struct {
-	Rules *SRules
+	Rules   *SRules
+	Capture *Capturer // 为 nil 时不记录流量
+
+	RequestIDHeader string // 不为空时在响应中返回请求编号
 }
 
 func (this *HTTPTransport) create502Response(req *http.Request, err error) (resp *http.Response) {
@@ -45,26 +49,96 @@ func NewHTTPTransport(forward socks.Dialer, jsondata []byte) *HTTPTransport {
 }
 
 func (this *HTTPTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	var traffic *trafficExchange
+	var capture *captureExchange
+
+	var match *RuleMatch
+
+	req, requestID := withRequestID(req)
+	req, match = withRuleMatch(req)
+	req, traffic = Inspector.Begin(req)
+	if nil != this.Capture {
+		req, capture = this.Capture.Begin(req)
+	}
+
+	resp, err = this.roundTrip(req, match, traffic, capture)
+
+	hostClass := "other"
+	if this.Rules.MatchHost(req.URL.Host) {
+		hostClass = "rule"
+	}
+	metricRequests.Add(1, req.Method, strconv.Itoa(resp.StatusCode), hostClass)
+
+	if "" != this.RequestIDHeader {
+		resp.Header.Set(this.RequestIDHeader, requestID)
+	}
 
+	if nil != capture {
+		resp = capture.Finish(req, resp)
+	}
+
+	return traffic.Finish(req, resp, err), nil
+}
+
+// roundTrip 总是返回可用的响应, 请求失败时返回 502 响应及失败原因
+func (this *HTTPTransport) roundTrip(req *http.Request, match *RuleMatch, traffic *trafficExchange, capture *captureExchange) (resp *http.Response, err error) {
+	srcurl := *req.URL
 	tranpoort, resp := this.Rules.ResolveRequest(req)
 
 	if nil != resp {
 		return resp, nil
 	}
 
+	traffic.Transport(this.Rules, tranpoort)
+
 	req.Header.Del("X-Forwarded-For")
-	req.Header.Set("Accept-Encoding", "gzip") // golang http response once support gzip
+	req.Header.Set("Accept-Encoding", "gzip") // golang http response once support gzip, 扩展及断点可以再次修改
 
-	if resp, err = tranpoort.RoundTrip(req); err != nil {
-		if resp, err = tranpoort.RoundTrip(req); err != nil {
-			log.Warning("tranpoort round trip:", req.URL.String(), ", err:", err)
+	match.Upstream = this.Rules.transportName(tranpoort)
+	if resp, err = Hooks.resolveRequest(req, match.snapshot()); nil != err {
+		return this.create502Response(req, err), err
+	} else if nil != resp {
+		return resp, nil
+	}
+
+	if err = Breakpoints.PauseRequest(req); nil != err {
+		return this.create502Response(req, err), err
+	}
 
-			return this.create502Response(req, err), nil
+	profile, simulated := this.Rules.networkProfile(&srcurl) // 模拟网络状况, 建立连接时同样增加延迟
+	if simulated {
+		req = req.WithContext(withNetworkProfile(req.Context(), profile))
+		if err = profile.delay(req.Context()); nil != err {
+			return this.create502Response(req, err), err
+		}
+
+		if nil != req.Body && http.NoBody != req.Body {
+			req.Body = newThrottledBody(req.Context(), req.Body, profile.UploadKbps, 0)
 		}
 	}
 
+	traced, upstream := Upstreams.trace(req) // 请求结果计入使用的上游
+	if resp, err = tranpoort.RoundTrip(traced); err != nil {
+		if resp, err = tranpoort.RoundTrip(traced); err != nil {
+			upstream.report(err)
+			requestLog(req).WithFields(log.Fields{"upstream": this.Rules.transportName(tranpoort), "error": err}).Warning("Tranpoort round trip failed")
+
+			return this.create502Response(req, err), err
+		}
+	}
+	upstream.report(nil)
+
+	if nil != capture {
+		capture.Upstream(resp)
+	}
+
 	resp = this.Rules.ResolveResponse(req, resp)
 
+	if resp, err = Hooks.resolveResponse(req, resp, match.snapshot()); nil != err {
+		resp.Body.Close()
+		return this.create502Response(req, err), err
+	}
+
 	resp.Header.Del("Content-Security-Policy")
 
 	resp.Header.Del("X-Webkit-CSP")
@@ -77,5 +151,18 @@ func (this *HTTPTransport) RoundTrip(req *http.Request) (resp *http.Response, er
 	resp.Header.Add("X-Webkit-CSP", contentSecurityPolicy)
 	resp.Header.Add("X-Content-Security-Policy", contentSecurityPolicy)
 
-	return
+	if resp, err = Breakpoints.PauseResponse(req, resp); nil != err {
+		return this.create502Response(req, err), err
+	}
+
+	if resp, err = this.Rules.ResolveFault(req, &srcurl, resp); nil != err {
+		resp.Body.Close()
+		return this.create502Response(req, err), err
+	}
+
+	if simulated {
+		resp.Body = newThrottledBody(req.Context(), resp.Body, profile.DownloadKbps, profile.ResetRate)
+	}
+
+	return resp, nil
 }
@@ -3,11 +3,13 @@ package proxy
 import (
 	"crypto/tls"
 	"errors"
-	"log"
+	"io/ioutil"
 	"time"
 
 	"github.com/ssoor/certstrap/pkix"
-	"github.com/ssoor/fundadore/assistant"
+
+	"github.com/ssoor/tracksocks/log"
+	"github.com/ssoor/tracksocks/platform"
 )
 
 const (
@@ -181,15 +183,15 @@ type certKeyPair struct {
 func (p *certKeyPair) toX509Pair() tls.Certificate {
 	cb, err := p.cert.Export()
 	if err != nil {
-		log.Fatalln("Export cert failed:", err)
+		log.Fatal("Export cert failed:", err)
 	}
 	kb, err := p.key.ExportPrivate()
 	if err != nil {
-		log.Fatalln("Export private failed:", err)
+		log.Fatal("Export private failed:", err)
 	}
 	cert, err := tls.X509KeyPair(cb, kb)
 	if err != nil {
-		log.Fatalln("Make X509 KeyPair failed:", err)
+		log.Fatal("Make X509 KeyPair failed:", err)
 	}
 	return cert
 }
@@ -219,37 +221,64 @@ func QueryTlsCertificate(host string) (tlsCert *tls.Certificate, err error) {
 }
 
 var (
-	tlsCertsKey *pkix.Key
-	tlsCerts    map[string]tls.Certificate = make(map[string]tls.Certificate)
+	caRootCert         = CARootCert
+	caIntermediateCert = CAIntermediateCert
+	caIntermediateKey  = CAIntermediateKey
 )
 
-func AddCertificateToSystemStore() (err error) {
-	if isOK, err := assistant.AddCertificateCryptContextToStore("Root", CARootCert); nil != err || 0 == isOK {
-		if nil == err {
-			err = errors.New("not install certificate")
-		}
+// LoadCA 使用本地证书文件替换内置证书, rootFile 为空时 certFile 即为根证书
+func LoadCA(rootFile string, certFile string, keyFile string) error {
+	cert, err := ioutil.ReadFile(certFile)
+	if nil != err {
+		return err
+	}
+
+	key, err := ioutil.ReadFile(keyFile)
+	if nil != err {
 		return err
 	}
 
-	if isOK, err := assistant.AddCertificateCryptContextToStore("CA", CAIntermediateCert); nil != err || 0 == isOK {
-		if nil == err {
-			err = errors.New("not install certificate")
+	root := cert
+	if "" != rootFile {
+		if root, err = ioutil.ReadFile(rootFile); nil != err {
+			return err
 		}
+	}
+
+	if _, err = pkix.NewKeyFromPrivateKeyPEM(key); nil != err {
+		return err
+	}
+
+	if _, err = pkix.NewCertificateFromPEM(cert); nil != err {
 		return err
 	}
 
+	caRootCert, caIntermediateCert, caIntermediateKey = string(root), string(cert), string(key)
 	return nil
 }
 
+var (
+	tlsCertsKey *pkix.Key
+	tlsCerts    map[string]tls.Certificate = make(map[string]tls.Certificate)
+)
+
+func AddCertificateToSystemStore() (err error) {
+	if err = platform.Current.InstallCertificate(platform.StoreRoot, caRootCert); nil != err {
+		return err
+	}
+
+	return platform.Current.InstallCertificate(platform.StoreCA, caIntermediateCert)
+}
+
 func GetCAIntermediatePair() (certPair *certKeyPair, err error) {
 	var key *pkix.Key
 	var cert *pkix.Certificate
 
-	if key, err = pkix.NewKeyFromPrivateKeyPEM([]byte(CAIntermediateKey)); nil != err {
+	if key, err = pkix.NewKeyFromPrivateKeyPEM([]byte(caIntermediateKey)); nil != err {
 		return nil, err
 	}
 
-	if cert, err = pkix.NewCertificateFromPEM([]byte(CAIntermediateCert)); nil != err {
+	if cert, err = pkix.NewCertificateFromPEM([]byte(caIntermediateCert)); nil != err {
 		return nil, err
 	}
 
@@ -261,7 +290,7 @@ func CreateTlsCertificate(key *pkix.Key, host string, startTimeOffset time.Durat
 
 	if nil == key {
 		if tlsCertsKey, err = pkix.CreateRSAKey(1024); err != nil {
-			log.Println("Create RSA key failed:", err)
+			log.Error("Create RSA key failed:", err)
 			return nil, err
 		}
 
@@ -270,17 +299,17 @@ func CreateTlsCertificate(key *pkix.Key, host string, startTimeOffset time.Durat
 
 	csr, err := pkix.CreateCertificateSigningRequest(key, "Youniverse Trust Network", nil, []string{host}, "Youniverse Redemption", "CN", "China", "Beijing", host)
 	if err != nil {
-		log.Println("Create CSR failed:", err)
+		log.Error("Create CSR failed:", err)
 		return nil, err
 	}
 	var certPair *certKeyPair
 	if certPair, err = GetCAIntermediatePair(); nil != err {
-		log.Println("Get CA Intermediate failed:", err)
+		log.Error("Get CA Intermediate failed:", err)
 		return nil, err
 	}
 
 	if cert, err = pkix.CreateCertificateHost(certPair.cert, certPair.key, csr, startTimeOffset, 200); err != nil {
-		log.Println("Create cert failed:", err)
+		log.Error("Create cert failed:", err)
 		return nil, err
 	}
 
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 以 Prometheus 文本格式(0.0.4)输出的运行指标
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var DefaultMetricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	writeText(w io.Writer)
+}
+
+type MetricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+var Metrics = &MetricsRegistry{}
+
+func (r *MetricsRegistry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *MetricsRegistry) WriteText(w io.Writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, m := range r.metrics {
+		m.writeText(w)
+	}
+}
+
+type labeledValue struct {
+	labels []string
+	value  float64
+
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec 保存按标签区分的指标值
+type metricVec struct {
+	name   string
+	help   string
+	typeof string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]*labeledValue
+}
+
+func newMetricVec(name string, help string, typeof string, labels []string) metricVec {
+	return metricVec{
+		name:   name,
+		help:   help,
+		typeof: typeof,
+		labels: labels,
+		values: make(map[string]*labeledValue),
+	}
+}
+
+// value 调用方需持有 mutex
+func (v *metricVec) value(labels []string) *labeledValue {
+	key := strings.Join(labels, "\xff")
+
+	value, exist := v.values[key]
+	if false == exist {
+		value = &labeledValue{labels: append([]string{}, labels...)}
+		v.values[key] = value
+	}
+
+	return value
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (v *metricVec) labelText(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range v.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	pairs = append(pairs, extra...)
+
+	if 0 == len(pairs) {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sorted 调用方需持有 mutex
+func (v *metricVec) sorted() []*labeledValue {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]*labeledValue, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, v.values[key])
+	}
+
+	return values
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type CounterVec struct {
+	metricVec
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{newMetricVec(name, help, "counter", labels)}
+	Metrics.register(counter)
+
+	return counter
+}
+
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.value(labels).value += delta
+}
+
+func (c *CounterVec) writeText(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.typeof)
+	for _, value := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelText(value.labels), formatMetricValue(value.value))
+	}
+}
+
+type GaugeVec struct {
+	CounterVec
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	gauge := &GaugeVec{CounterVec{newMetricVec(name, help, "gauge", labels)}}
+	Metrics.register(gauge)
+
+	return gauge
+}
+
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.value(labels).value = value
+}
+
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{metricVec: newMetricVec(name, help, "histogram", labels), buckets: buckets}
+	Metrics.register(histogram)
+
+	return histogram
+}
+
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	labeled := h.value(labels)
+	if nil == labeled.buckets {
+		labeled.buckets = make([]uint64, len(h.buckets))
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			labeled.buckets[i]++
+		}
+	}
+
+	labeled.count++
+	labeled.value += value
+}
+
+func (h *HistogramVec) ObserveSince(started time.Time, labels ...string) {
+	h.Observe(time.Since(started).Seconds(), labels...)
+}
+
+func (h *HistogramVec) writeText(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", h.name, h.help, h.name, h.typeof)
+	for _, value := range h.sorted() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelText(value.labels, `le="`+formatMetricValue(bound)+`"`), value.buckets[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelText(value.labels, `le="+Inf"`), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelText(value.labels), formatMetricValue(value.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelText(value.labels), value.count)
+	}
+}
+
+var (
+	metricRequests          = NewCounterVec("tracksocks_requests_total", "Proxied HTTP requests by method, status code and host class.", "method", "status", "host_class")
+	metricRuleHits          = NewCounterVec("tracksocks_rule_hits_total", "Requests and responses changed by each rule type.", "rule")
+	metricDialSeconds       = NewHistogramVec("tracksocks_upstream_dial_seconds", "Time spent dialing upstream connections.", DefaultMetricsBuckets, "transport", "result")
+	metricBytes             = NewCounterVec("tracksocks_bytes_total", "Bytes read from (in) and written to (out) proxy clients.", "listener", "direction")
+	metricConnections       = NewGaugeVec("tracksocks_active_connections", "Client connections currently open on each listener.", "listener")
+	metricCertCache         = NewCounterVec("tracksocks_cert_cache_total", "Forged certificate cache lookups by result.", "result")
+	metricCertIssue         = NewHistogramVec("tracksocks_cert_issue_seconds", "Time spent issuing forged certificates.", DefaultMetricsBuckets)
+	metricTLSDecisions      = NewCounterVec("tracksocks_tls_decisions_total", "TLS connections intercepted (rule, no_sni) or spliced (never, no_rule) by listener.", "listener", "reason")
+	metricUpstreamUp        = NewGaugeVec("tracksocks_upstream_up", "Whether the upstream circuit is closed (1) or open (0).", "upstream")
+	metricEncodeConnections = NewCounterVec("tracksocks_encode_connections_total", "Encode listener connections by protocol (auth, legacy) or failure (failed, rejected).", "result")
+)
+
+// metricsListener 统计监听端口上的活动连接及流量
+type metricsListener struct {
+	net.Listener
+	name string
+}
+
+func newMetricsListener(listener net.Listener, name string) net.Listener {
+	return &metricsListener{Listener: listener, name: name}
+}
+
+func (l *metricsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+
+	metricConnections.Add(1, l.name)
+	return &metricsConn{Conn: conn, name: l.name}, nil
+}
+
+type metricsConn struct {
+	net.Conn
+	name   string
+	closed int32
+}
+
+func (c *metricsConn) Read(data []byte) (n int, err error) {
+	n, err = c.Conn.Read(data)
+	if 0 < n {
+		metricBytes.Add(float64(n), c.name, "in")
+	}
+
+	return n, err
+}
+
+func (c *metricsConn) Write(data []byte) (n int, err error) {
+	n, err = c.Conn.Write(data)
+	if 0 < n {
+		metricBytes.Add(float64(n), c.name, "out")
+	}
+
+	return n, err
+}
+
+func (c *metricsConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		metricConnections.Add(-1, c.name)
+	}
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	counter := &CounterVec{newMetricVec("test_requests_total", "Test requests.", "counter", []string{"method", "path"})}
+	counter.Add(1, "GET", "/b")
+	counter.Add(2, "GET", "/a\"\n")
+	counter.Add(0.5, "GET", "/b")
+
+	gauge := &GaugeVec{CounterVec{newMetricVec("test_connections", "Test connections.", "gauge", []string{"listener"})}}
+	gauge.Add(3, "http")
+	gauge.Set(1, "http")
+
+	histogram := &HistogramVec{metricVec: newMetricVec("test_seconds", "Test durations.", "histogram", nil), buckets: []float64{0.1, 1}}
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+
+	var out bytes.Buffer
+	registry := &MetricsRegistry{}
+	registry.register(counter)
+	registry.register(gauge)
+	registry.register(histogram)
+	registry.WriteText(&out)
+
+	expected := `# HELP test_requests_total Test requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/a\"\n"} 2
+test_requests_total{method="GET",path="/b"} 1.5
+# HELP test_connections Test connections.
+# TYPE test_connections gauge
+test_connections{listener="http"} 1
+# HELP test_seconds Test durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+`
+	if expected != out.String() {
+		t.Fatalf("metrics =\n%s\nwant\n%s", out.String(), expected)
+	}
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssoor/tracksocks/log"
+)
+
+const DefaultDNSTimeout = 5 * time.Second
+
+const dnsCacheSweepInterval = time.Minute // 清理过期缓存的最小间隔
+
+// 解析结果的来源
+const (
+	ResolveSourceRule   = "rule"   // 规则中的 hosts 覆盖
+	ResolveSourceHosts  = "hosts"  // 全局 hosts 覆盖
+	ResolveSourceCache  = "cache"  // DNS 服务器应答的缓存
+	ResolveSourceSystem = "system" // 没有配置 DNS 服务器, 由系统解析
+)
+
+type dnsServerEntry struct {
+	name   string
+	server dnsServer
+}
+
+type dnsCacheEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+// DNSCacheState 为缓存的解析结果
+type DNSCacheState struct {
+	Host      string   `json:"host"`
+	Addresses []string `json:"addresses"`
+	TTL       int      `json:"ttl"` // 剩余秒数
+}
+
+// DNSResolver 在建立连接前解析域名, 依次使用规则中的 hosts 覆盖、全局 hosts 覆盖、缓存及配置的 DNS 服务器,
+// 没有配置 DNS 服务器时由系统解析
+type DNSResolver struct {
+	mutex   sync.RWMutex
+	hosts   map[string][]string // 与规则 host 格式相同, 以 . 开头的为模糊匹配
+	servers []dnsServerEntry
+	timeout time.Duration
+	cache   map[string]dnsCacheEntry
+
+	nextSweep time.Time
+}
+
+var Resolver = &DNSResolver{
+	hosts:   make(map[string][]string),
+	timeout: DefaultDNSTimeout,
+	cache:   make(map[string]dnsCacheEntry),
+}
+
+// ParseHostsOverride 将 host -> 地址 (多个地址以逗号分隔) 转换为解析使用的格式
+func ParseHostsOverride(hosts map[string]string) (map[string][]string, error) {
+	overrides := make(map[string][]string, len(hosts))
+	for host, text := range hosts {
+		host = strings.TrimSpace(strings.ToLower(host))
+		for _, address := range strings.Split(text, ",") {
+			address = strings.TrimSpace(address)
+			if nil == net.ParseIP(address) {
+				return nil, errors.New("invalid address " + address + " for host " + host)
+			}
+
+			overrides[host] = append(overrides[host], address)
+		}
+	}
+
+	return overrides, nil
+}
+
+func (r *DNSResolver) SetHosts(hosts map[string]string) error {
+	overrides, err := ParseHostsOverride(hosts)
+	if nil != err {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.hosts = overrides
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// SetServers 设置依次尝试的 DNS 服务器, 格式见 newDNSServer, timeout 为 0 时使用 DefaultDNSTimeout
+func (r *DNSResolver) SetServers(servers []string, timeout time.Duration) error {
+	entries := make([]dnsServerEntry, 0, len(servers))
+	for _, name := range servers {
+		server, err := newDNSServer(name)
+		if nil != err {
+			return errors.New("invalid dns server " + name + ": " + err.Error())
+		}
+
+		entries = append(entries, dnsServerEntry{name: name, server: server})
+	}
+
+	if 0 == timeout {
+		timeout = DefaultDNSTimeout
+	}
+
+	r.mutex.Lock()
+	r.servers, r.timeout = entries, timeout
+	r.cache = make(map[string]dnsCacheEntry)
+	r.mutex.Unlock()
+
+	return nil
+}
+
+func (r *DNSResolver) Servers() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	servers := make([]string, 0, len(r.servers))
+	for _, entry := range r.servers {
+		servers = append(servers, entry.name)
+	}
+
+	return servers
+}
+
+func (r *DNSResolver) Hosts() map[string][]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	hosts := make(map[string][]string, len(r.hosts))
+	for host, addresses := range r.hosts {
+		hosts[host] = addresses
+	}
+
+	return hosts
+}
+
+// CacheStates 返回未过期的缓存, 同时删除已过期的缓存
+func (r *DNSResolver) CacheStates() []DNSCacheState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	states := make([]DNSCacheState, 0, len(r.cache))
+	for host, entry := range r.cache {
+		if false == now.Before(entry.expires) {
+			delete(r.cache, host)
+			continue
+		}
+
+		states = append(states, DNSCacheState{Host: host, Addresses: entry.addresses, TTL: int(entry.expires.Sub(now) / time.Second)})
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+func (r *DNSResolver) FlushCache() {
+	r.mutex.Lock()
+	r.cache = make(map[string]dnsCacheEntry)
+	r.mutex.Unlock()
+}
+
+// sweepCache 删除 host 过期的缓存, 并定期清理其他不再查询的域名的过期缓存, 调用方需要持有写锁
+func (r *DNSResolver) sweepCache(host string, now time.Time) {
+	if entry, exist := r.cache[host]; exist && false == now.Before(entry.expires) {
+		delete(r.cache, host)
+	}
+
+	if now.Before(r.nextSweep) {
+		return
+	}
+
+	r.nextSweep = now.Add(dnsCacheSweepInterval)
+	for host, entry := range r.cache {
+		if false == now.Before(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+}
+
+// lookupHosts 按绝对匹配及模糊匹配查找 hosts 覆盖, 规则同 compiler.URLMatch.MatchHost
+func lookupHosts(hosts map[string][]string, host string) ([]string, bool) {
+	if addresses, exist := hosts[host]; exist {
+		return addresses, true
+	}
+
+	host = "." + host
+	for i := 0; -1 != i; i = strings.IndexRune(host, '.') {
+		host = host[i+1:]
+		if addresses, exist := hosts["."+host]; exist {
+			return addresses, true
+		}
+	}
+
+	return nil, false
+}
+
+// Resolve 返回 host 的地址及来源, overrides 为命中规则的 hosts 覆盖. useServers 为 false 时只使用 hosts 覆盖,
+// 用于由上游代理解析的连接. 返回的地址为空时由调用方直接使用 host
+func (r *DNSResolver) Resolve(ctx context.Context, host string, overrides map[string][]string, useServers bool) ([]string, string, error) {
+	if nil != net.ParseIP(host) {
+		return nil, "", nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addresses, exist := lookupHosts(overrides, host); exist {
+		return addresses, ResolveSourceRule, nil
+	}
+
+	r.mutex.RLock()
+	addresses, exist := lookupHosts(r.hosts, host)
+	servers, timeout, cached := r.servers, r.timeout, r.cache[host]
+	r.mutex.RUnlock()
+
+	if exist {
+		return addresses, ResolveSourceHosts, nil
+	}
+
+	if false == useServers || 0 == len(servers) {
+		return nil, ResolveSourceSystem, nil
+	}
+
+	now := time.Now()
+	if now.Before(cached.expires) {
+		return cached.addresses, ResolveSourceCache, nil
+	}
+
+	r.mutex.Lock()
+	r.sweepCache(host, now)
+	r.mutex.Unlock()
+
+	var err error
+	for _, entry := range servers {
+		var ttl uint32
+		if addresses, ttl, err = r.query(ctx, entry.server, host, timeout); nil != err {
+			contextLog(ctx).WithFields(log.Fields{"host": host, "dns": entry.name, "error": err}).Debug("DNS query failed")
+			if errors.Is(err, errorDNSNoSuchHost) {
+				break
+			}
+			continue
+		}
+
+		if 0 != ttl {
+			r.mutex.Lock()
+			r.cache[host] = dnsCacheEntry{addresses: addresses, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+			r.mutex.Unlock()
+		}
+
+		return addresses, entry.name, nil
+	}
+
+	return nil, "", &net.DNSError{Err: err.Error(), Name: host, IsNotFound: errors.Is(err, errorDNSNoSuchHost)}
+}
+
+// query 同时查询 A 及 AAAA 记录, IPv4 地址在前, 返回所有记录中最小的 TTL
+func (r *DNSResolver) query(ctx context.Context, server dnsServer, host string, timeout time.Duration) ([]string, uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type answer struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+
+	var answers [2]answer
+	var wait sync.WaitGroup
+	for i, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		wait.Add(1)
+		go func(i int, qtype uint16) {
+			defer wait.Done()
+			answers[i].ips, answers[i].ttl, answers[i].err = exchangeDNS(ctx, server, host, qtype)
+		}(i, qtype)
+	}
+	wait.Wait()
+
+	if nil != answers[0].err && nil != answers[1].err {
+		return nil, 0, answers[0].err
+	}
+
+	ttl := uint32(dnsMaxTTL)
+	var addresses []string
+	for _, answer := range answers {
+		if nil != answer.err {
+			continue
+		}
+
+		if answer.ttl < ttl {
+			ttl = answer.ttl
+		}
+
+		for _, ip := range answer.ips {
+			addresses = append(addresses, ip.String())
+		}
+	}
+
+	if 0 == len(addresses) {
+		return nil, 0, errorDNSNoAddresses
+	}
+
+	return addresses, ttl, nil
+}
+
+// dialContext 返回先解析地址再建立连接的拨号函数, 依次尝试解析到的地址. remote 为 true 时目标地址由上游代理解析,
+// 只应用 hosts 覆盖
+func (r *DNSResolver) dialContext(dial func(network, addr string) (net.Conn, error), remote bool, overrides map[string][]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if nil != err {
+			return dial(network, addr)
+		}
+
+		addresses, source, err := r.Resolve(ctx, host, overrides, false == remote)
+		if nil != err {
+			contextLog(ctx).WithFields(log.Fields{"host": host, "error": err}).Warning("Resolve host failed")
+			return nil, err
+		}
+
+		if 0 == len(addresses) {
+			return dial(network, addr)
+		}
+
+		contextLog(ctx).WithFields(log.Fields{"host": host, "addresses": addresses, "source": source}).Info("Resolve host")
+
+		var conn net.Conn
+		for _, address := range addresses {
+			if conn, err = dial(network, net.JoinHostPort(address, port)); nil == err {
+				return conn, nil
+			}
+		}
+
+		return nil, err
+	}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DNS 报文 (RFC 1035), 只支持查询 A 及 AAAA 记录
+const (
+	dnsTypeA         = 1
+	dnsTypeAAAA      = 28
+	dnsClassIN       = 1
+	dnsRcodeNXDomain = 3
+	dnsMaxTTL        = 3600
+	dnsMaxSize       = 65535
+)
+
+var (
+	errorDNSMessage      = errors.New("invalid dns message")
+	errorDNSNoSuchHost   = errors.New("no such host")
+	errorDNSNoAddresses  = errors.New("no dns records")
+	errorDNSServerScheme = errors.New("dns server must be udp://, tcp://, tls:// or https://")
+)
+
+func buildDNSQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	msg[2] = 0x01                          // RD
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if 0 == len(label) || len(label) > 63 {
+			return nil, errors.New("invalid dns name " + host)
+		}
+
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	return msg, nil
+}
+
+// skipDNSName 返回 offset 处名称之后的位置, 名称可能以压缩指针结束
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errorDNSMessage
+		}
+
+		size := int(msg[offset])
+		switch {
+		case 0 == size:
+			return offset + 1, nil
+		case 0xC0 == size&0xC0:
+			if offset+2 > len(msg) {
+				return 0, errorDNSMessage
+			}
+			return offset + 2, nil
+		}
+
+		offset += 1 + size
+	}
+}
+
+// parseDNSResponse 返回应答中类型为 qtype 的地址及所有应答记录 (包括 CNAME) 中最小的 TTL
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) (ips []net.IP, ttl uint32, err error) {
+	if len(msg) < 12 || id != binary.BigEndian.Uint16(msg[0:]) || 0 == msg[2]&0x80 {
+		return nil, 0, errorDNSMessage
+	}
+
+	switch rcode := msg[3] & 0x0F; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return nil, 0, errorDNSNoSuchHost
+	default:
+		return nil, 0, fmt.Errorf("dns server returned rcode %d", rcode)
+	}
+
+	offset := 12
+	for i := binary.BigEndian.Uint16(msg[4:]); 0 < i; i-- {
+		if offset, err = skipDNSName(msg, offset); nil != err {
+			return nil, 0, err
+		}
+		offset += 4
+	}
+
+	ttl = dnsMaxTTL
+	for i := binary.BigEndian.Uint16(msg[6:]); 0 < i; i-- {
+		if offset, err = skipDNSName(msg, offset); nil != err {
+			return nil, 0, err
+		}
+
+		if offset+10 > len(msg) {
+			return nil, 0, errorDNSMessage
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		rttl := binary.BigEndian.Uint32(msg[offset+4:])
+		size := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+
+		if offset+size > len(msg) {
+			return nil, 0, errorDNSMessage
+		}
+
+		if rttl < ttl {
+			ttl = rttl
+		}
+
+		if rtype == qtype && ((dnsTypeA == qtype && net.IPv4len == size) || (dnsTypeAAAA == qtype && net.IPv6len == size)) {
+			ips = append(ips, net.IP(append([]byte{}, msg[offset:offset+size]...)))
+		}
+		offset += size
+	}
+
+	return ips, ttl, nil
+}
+
+// dnsServer 发送查询并返回应答报文
+type dnsServer interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// newDNSServer 解析 DNS 服务器地址, 没有 scheme 时使用 udp, 如 8.8.8.8、tls://1.1.1.1、https://dns.google/dns-query
+func newDNSServer(rawurl string) (dnsServer, error) {
+	if false == strings.Contains(rawurl, "://") {
+		rawurl = "udp://" + rawurl
+	}
+
+	serverURL, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, err
+	}
+
+	address := serverURL.Host
+	if "" == serverURL.Port() {
+		port := "53"
+		if "tls" == serverURL.Scheme {
+			port = "853"
+		}
+		address = net.JoinHostPort(serverURL.Hostname(), port)
+	}
+
+	switch serverURL.Scheme {
+	case "udp":
+		return &udpDNSServer{address: address}, nil
+	case "tcp":
+		return &streamDNSServer{address: address}, nil
+	case "tls": // DNS over TLS (RFC 7858)
+		return &streamDNSServer{address: address, tls: &tls.Config{ServerName: serverURL.Hostname()}}, nil
+	case "https": // DNS over HTTPS (RFC 8484)
+		return &httpsDNSServer{url: rawurl, client: &http.Client{}}, nil
+	}
+
+	return nil, errorDNSServerScheme
+}
+
+type udpDNSServer struct {
+	address string
+}
+
+func (s *udpDNSServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", s.address)
+	if nil != err {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write(query); nil != err {
+		return nil, err
+	}
+
+	msg := make([]byte, dnsMaxSize)
+	for {
+		n, err := conn.Read(msg)
+		if nil != err {
+			return nil, err
+		}
+
+		if n < 12 || false == bytes.Equal(msg[:2], query[:2]) { // 忽略不属于本次查询的应答
+			continue
+		}
+
+		if 0 != msg[2]&0x02 { // 应答被截断, 改用 TCP
+			return (&streamDNSServer{address: s.address}).Exchange(ctx, query)
+		}
+
+		return msg[:n], nil
+	}
+}
+
+// streamDNSServer 为 TCP 及 DNS over TLS, 报文前有两个字节的长度
+type streamDNSServer struct {
+	address string
+	tls     *tls.Config
+}
+
+func (s *streamDNSServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if nil != s.tls {
+		conn, err = (&tls.Dialer{Config: s.tls}).DialContext(ctx, "tcp", s.address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", s.address)
+	}
+
+	if nil != err {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); nil != err {
+		return nil, err
+	}
+
+	if _, err = conn.Write(query); nil != err {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err = io.ReadFull(conn, size[:]); nil != err {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(conn, msg)
+	return msg, err
+}
+
+type httpsDNSServer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpsDNSServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(query))
+	if nil != err {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		return nil, errors.New("dns over https returned " + resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxSize))
+}
+
+// exchangeDNS 查询 host 的 qtype 记录
+func exchangeDNS(ctx context.Context, server dnsServer, host string, qtype uint16) ([]net.IP, uint32, error) {
+	var random [2]byte
+	if _, err := rand.Read(random[:]); nil != err {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(random[:])
+
+	query, err := buildDNSQuery(id, host, qtype)
+	if nil != err {
+		return nil, 0, err
+	}
+
+	msg, err := server.Exchange(ctx, query)
+	if nil != err {
+		return nil, 0, err
+	}
+
+	return parseDNSResponse(msg, id, qtype)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsAnswer 返回 query 的应答, A 查询应答 CNAME 及 10.0.0.1, AAAA 查询没有记录
+func dnsAnswer(query []byte, ttl uint32) []byte {
+	msg := append([]byte{}, query...)
+	msg[2], msg[3] = 0x81, 0x80
+
+	if dnsTypeA != binary.BigEndian.Uint16(query[len(query)-4:]) {
+		return msg
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], 2)
+
+	cname := append([]byte{0xC0, 0x0C}, 0, 5, 0, 1) // CNAME IN
+	cname = binary.BigEndian.AppendUint32(cname, ttl+100)
+	cname = append(cname, 0, 6, 4, 'e', 'd', 'g', 'e', 0)
+	msg = append(msg, cname...)
+
+	a := append([]byte{byte(0xC0), byte(len(msg) - 6)}, 0, dnsTypeA, 0, dnsClassIN) // 指向 CNAME 中的 edge
+	a = binary.BigEndian.AppendUint32(a, ttl)
+	a = append(a, 0, 4, 10, 0, 0, 1)
+
+	return append(msg, a...)
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	query, err := buildDNSQuery(0x1234, "api.example.com", dnsTypeA)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ips, ttl, err := parseDNSResponse(dnsAnswer(query, 60), 0x1234, dnsTypeA)
+	if nil != err || 1 != len(ips) || "10.0.0.1" != ips[0].String() || 60 != ttl {
+		t.Fatalf("ips = %v, ttl = %d, err = %v", ips, ttl, err)
+	}
+
+	if _, _, err = parseDNSResponse(dnsAnswer(query, 60), 0x4321, dnsTypeA); nil == err {
+		t.Fatal("expect id mismatch error")
+	}
+
+	nxdomain := append([]byte{}, query...)
+	nxdomain[2], nxdomain[3] = 0x81, 0x83
+	if _, _, err = parseDNSResponse(nxdomain, 0x1234, dnsTypeA); errorDNSNoSuchHost != err {
+		t.Fatalf("err = %v, want no such host", err)
+	}
+
+	if _, _, err = parseDNSResponse(dnsAnswer(query, 60)[:len(query)+8], 0x1234, dnsTypeA); nil == err {
+		t.Fatal("expect truncated message error")
+	}
+}
+
+func startUDPDNSServer(t *testing.T, queries *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+
+			atomic.AddInt32(queries, 1)
+			conn.WriteTo(dnsAnswer(buf[:n], 60), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestResolverResolve(t *testing.T) {
+	var queries int32
+	resolver := &DNSResolver{cache: make(map[string]dnsCacheEntry)}
+	if err := resolver.SetServers([]string{"udp://127.0.0.1:1", startUDPDNSServer(t, &queries)}, time.Second); nil != err {
+		t.Fatal(err)
+	}
+
+	if err := resolver.SetHosts(map[string]string{".internal.example.com": "192.168.1.1, 192.168.1.2"}); nil != err {
+		t.Fatal(err)
+	}
+
+	overrides, _ := ParseHostsOverride(map[string]string{"api.example.com": "127.0.0.1"})
+	cases := []struct {
+		host      string
+		overrides map[string][]string
+		addresses []string
+		source    string
+	}{
+		{"api.example.com", overrides, []string{"127.0.0.1"}, ResolveSourceRule},
+		{"db.internal.example.com", overrides, []string{"192.168.1.1", "192.168.1.2"}, ResolveSourceHosts},
+		{"api.example.com", nil, []string{"10.0.0.1"}, resolver.servers[1].name}, // 第一个服务器不可用
+		{"API.example.com.", nil, []string{"10.0.0.1"}, ResolveSourceCache},
+		{"10.1.1.1", nil, nil, ""},
+	}
+
+	for _, c := range cases {
+		addresses, source, err := resolver.Resolve(context.Background(), c.host, c.overrides, true)
+		if nil != err || false == reflect.DeepEqual(c.addresses, addresses) || c.source != source {
+			t.Fatalf("%s: addresses = %v, source = %s, err = %v", c.host, addresses, source, err)
+		}
+	}
+
+	if 2 != atomic.LoadInt32(&queries) { // A 及 AAAA 各一次, 之后使用缓存
+		t.Fatalf("queries = %d, want 2", queries)
+	}
+
+	if addresses, source, _ := resolver.Resolve(context.Background(), "www.example.com", nil, false); nil != addresses || ResolveSourceSystem != source {
+		t.Fatalf("remote resolve = %v, %s", addresses, source)
+	}
+}
+
+func TestResolverDNSOverHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if "application/dns-message" != r.Header.Get("Content-Type") || len(query) < 12 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, 0))
+	}))
+	defer server.Close()
+
+	resolver := &DNSResolver{cache: make(map[string]dnsCacheEntry)}
+	if err := resolver.SetServers([]string{server.URL + "/dns-query"}, time.Second); nil != err {
+		t.Fatal(err)
+	}
+	resolver.servers[0].server.(*httpsDNSServer).client = server.Client()
+
+	addresses, _, err := resolver.Resolve(context.Background(), "api.example.com", nil, true)
+	if nil != err || false == reflect.DeepEqual([]string{"10.0.0.1"}, addresses) {
+		t.Fatalf("addresses = %v, err = %v", addresses, err)
+	}
+
+	if 0 != len(resolver.CacheStates()) { // TTL 为 0 时不缓存
+		t.Fatal("expect no cache entry")
+	}
+}
+
+func TestResolverCacheExpire(t *testing.T) {
+	var queries int32
+	resolver := &DNSResolver{cache: make(map[string]dnsCacheEntry)}
+	if err := resolver.SetServers([]string{startUDPDNSServer(t, &queries)}, time.Second); nil != err {
+		t.Fatal(err)
+	}
+
+	expired, live := time.Now().Add(-time.Second), time.Now().Add(time.Minute)
+	resolver.cache["api.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.9"}, expires: expired}
+	resolver.cache["stale.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.8"}, expires: expired}
+	resolver.cache["live.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.7"}, expires: live}
+
+	if addresses, source, err := resolver.Resolve(context.Background(), "api.example.com", nil, true); nil != err || false == reflect.DeepEqual([]string{"10.0.0.1"}, addresses) || ResolveSourceCache == source {
+		t.Fatalf("addresses = %v, source = %s, err = %v", addresses, source, err)
+	}
+
+	if _, exist := resolver.cache["stale.example.com"]; exist || 2 != len(resolver.cache) { // 不再查询的域名同样被清理
+		t.Fatalf("cache = %v", resolver.cache)
+	}
+
+	resolver.cache["old.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.6"}, expires: expired}
+	if states := resolver.CacheStates(); 2 != len(states) || "api.example.com" != states[0].Host || "live.example.com" != states[1].Host {
+		t.Fatalf("states = %+v", states)
+	}
+
+	if _, exist := resolver.cache["old.example.com"]; exist {
+		t.Fatal("expect CacheStates to delete expired entries")
+	}
+
+	// 查询失败时同样删除过期的缓存, 其他域名等到下一次定期清理
+	resolver.SetServers([]string{"udp://127.0.0.1:1"}, 100*time.Millisecond)
+	resolver.cache["gone.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.5"}, expires: expired}
+	resolver.cache["other.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.4"}, expires: expired}
+
+	if _, _, err := resolver.Resolve(context.Background(), "gone.example.com", nil, true); nil == err {
+		t.Fatal("expect query error")
+	}
+
+	if _, exist := resolver.cache["gone.example.com"]; exist {
+		t.Fatal("expect expired entry to be deleted on lookup")
+	}
+
+	if _, exist := resolver.cache["other.example.com"]; false == exist {
+		t.Fatal("expect periodic sweep to wait for the interval")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -14,11 +15,14 @@ import (
 	"net/http"
 	//	"net/http/httputil"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ssoor/socks"
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 	
 	"github.com/ssoor/tracksocks/redirect/proxy/compiler"
 )
@@ -29,11 +33,41 @@ const (
 	Rewrite_HTML
 	Rewrite_JaveScript
 	FastRedirect_URL
+	Fault_Status      // 直接返回指定的状态码
+	Fault_Truncate    // 响应体传输过程中提前结束
+	Fault_Delay       // 延迟返回响应头
+	Fault_CorruptGzip // 破坏 gzip 压缩的响应体
+	Fault_Drop        // 响应体传输指定字节数后断开连接
 )
 
+var ruleNames = map[int]string{
+	Rewrite_URL:        "rewrite_url",
+	Redirect_URL:       "redirect_url",
+	Rewrite_HTML:       "rewrite_html",
+	Rewrite_JaveScript: "rewrite_javascript",
+	FastRedirect_URL:   "fast_redirect_url",
+	Fault_Status:       "fault_status",
+	Fault_Truncate:     "fault_truncate",
+	Fault_Delay:        "fault_delay",
+	Fault_CorruptGzip:  "fault_corrupt_gzip",
+	Fault_Drop:         "fault_drop",
+}
+
+func RuleName(ruleType int) string {
+	if name, exist := ruleNames[ruleType]; exist {
+		return name
+	}
+
+	return strconv.Itoa(ruleType)
+}
+
 type internalJSONURLMatch struct {
 	compiler.JSONURLMatch
-	Type int `json:"type"`
+	Type     int               `json:"type"`
+	Upstream string            `json:"upstream"` // 命中规则的请求使用的上游代理名称, 为空时使用默认上游
+	Hosts    map[string]string `json:"hosts"`    // 只对命中规则的请求生效的 hosts 覆盖, 多个地址以逗号分隔
+	Network  string            `json:"network"`  // 命中规则的请求模拟的网络状况, 为空时使用全局设置
+	Fault    JSONFault         `json:"fault"`    // 故障注入规则的参数
 }
 
 type JSONSRule struct {
@@ -57,24 +91,60 @@ type SRules struct {
 
 	tranpoort_local  *http.Transport
 	tranpoort_remote *http.Transport
+
+	forward         socks.Dialer
+	forwardRemote   bool // forward 为上游代理, 目标地址由上游代理解析
+	routes          []*ruleRoute
+	routeMutex      sync.Mutex
+	routeTransports map[string]*http.Transport
+
+	faults []*faultRule
+}
+
+// ruleRoute 为规则指定的上游代理、hosts 覆盖及网络状况. 指定了上游代理或 hosts 覆盖时命中规则的请求使用独立的出口,
+// 连接不会被其他请求复用
+type ruleRoute struct {
+	key      string
+	upstream string
+	hosts    map[string][]string
+	network  string
+	match    *compiler.URLMatch
+}
+
+// metricsDial 记录建立上游连接的耗时, 失败时输出附带请求编号的日志
+func metricsDial(transport string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		started := time.Now()
+		conn, err := dial(ctx, network, addr)
+
+		if nil != err {
+			metricDialSeconds.ObserveSince(started, transport, "error")
+			contextLog(ctx).WithFields(log.Fields{"upstream": transport, "addr": addr, "error": err}).Warning("Dial upstream failed")
+		} else {
+			metricDialSeconds.ObserveSince(started, transport, "success")
+			contextLog(ctx).WithFields(log.Fields{"upstream": transport, "addr": addr, "remote": conn.RemoteAddr().String()}).Debug("Dial upstream")
+		}
+
+		return conn, err
+	}
 }
 
 func NewSRules(forward socks.Dialer) *SRules {
+	forwardRemote := forward != socks.Direct
 
 	return &SRules{
 		tranpoort_remote: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return forward.Dial(network, addr)
-			},
+			DialContext:     metricsDial("remote", networkDial(Resolver.dialContext(forward.Dial, forwardRemote, nil))),
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		},
 		tranpoort_local: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return socks.Direct.Dial(network, addr)
-			},
+			DialContext:     metricsDial("local", networkDial(Resolver.dialContext(socks.Direct.Dial, false, nil))),
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		},
-		urlMatch: make(map[int]*compiler.URLMatch),
+		urlMatch:        make(map[int]*compiler.URLMatch),
+		forward:         forward,
+		forwardRemote:   forwardRemote,
+		routeTransports: make(map[string]*http.Transport),
 	}
 }
 
@@ -115,7 +185,22 @@ func (s *SRules) Add(internalMatch internalJSONURLMatch) (err error) {
 		s.urlMatch[internalMatch.Type] = compiler.NewURLMatch()
 	}
 
-	err = s.urlMatch[internalMatch.Type].AddMatchs(match)
+	var fault *faultRule
+	if isFaultRule(internalMatch.Type) {
+		fault, err = newFaultRule(internalMatch, match)
+	}
+
+	if nil == err {
+		err = s.urlMatch[internalMatch.Type].AddMatchs(match)
+	}
+
+	if nil != fault && nil == err {
+		s.addFault(fault)
+	}
+
+	if ("" != internalMatch.Upstream || 0 != len(internalMatch.Hosts) || "" != internalMatch.Network) && nil == err {
+		err = s.addRoute(internalMatch, match)
+	}
 
 	for i := 0; i < len(match.Match); i++ {
 		log.Info("Sign up routing:", err, internalMatch.Type, fmt.Sprintf("%s(%s)", match.Host, match.Url), match.Match[i])
@@ -126,6 +211,35 @@ func (s *SRules) Add(internalMatch internalJSONURLMatch) (err error) {
 	return err
 }
 
+// MatchHost 检查 host 是否存在任意类型的规则
+func (s *SRules) MatchHost(host string) bool {
+	for _, match := range s.urlMatch {
+		if match.MatchHost(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Hosts 返回所有规则类型中出现的 host, 格式同 compiler.URLMatch.Hosts
+func (s *SRules) Hosts() []string {
+	unique := make(map[string]bool)
+	for _, match := range s.urlMatch {
+		for _, host := range match.Hosts() {
+			unique[host] = true
+		}
+	}
+
+	hosts := make([]string, 0, len(unique))
+	for host := range unique {
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+	return hosts
+}
+
 func (s *SRules) Replace(matchType int, url *url.URL, src []byte) (dst []byte, err error) {
 	if nil == s.urlMatch[matchType] {
 		return src, errors.New("Rule not found.")
@@ -178,49 +292,184 @@ func (s *SRules) GetFastRedirectURL(req *http.Request) (dst *url.URL, err error)
 	return url.Parse(string(dststr))
 }
 
+// OverrideLimits 使用本地配置中不为 0 的限制替换规则中的限制
+func (s *SRules) OverrideLimits(limits JSONLimits) {
+	if 0 != limits.MaxResponseContentLen {
+		s.limits.MaxResponseContentLen = limits.MaxResponseContentLen
+	}
+}
+
+// DialLocal 使用无规则请求的出口建立连接, 用于不解密直接转发的隧道
+func (s *SRules) DialLocal(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.tranpoort_local.DialContext(ctx, network, addr)
+}
+
+// transportName 返回日志及统计中使用的出口名称
+func (s *SRules) transportName(tran *http.Transport) string {
+	if tran == s.tranpoort_remote {
+		return "remote"
+	}
+
+	s.routeMutex.Lock()
+	defer s.routeMutex.Unlock()
+
+	for _, route := range s.routes {
+		if tran == s.routeTransports[route.key] {
+			if "" == route.upstream {
+				return "remote"
+			}
+
+			return "upstream:" + route.upstream
+		}
+	}
+
+	return "local"
+}
+
+// addRoute 记录规则指定的上游代理及 hosts 覆盖, 设置相同的规则共用同一个出口
+func (s *SRules) addRoute(internalMatch internalJSONURLMatch, match compiler.JSONURLMatch) error {
+	hosts, err := ParseHostsOverride(internalMatch.Hosts)
+	if nil != err {
+		return err
+	}
+
+	if "" != internalMatch.Upstream {
+		if _, exist := ParentProxies.Get(internalMatch.Upstream); false == exist {
+			log.Warning("Routing upstream", internalMatch.Upstream, "is not configured, requests use the default upstream")
+		}
+	}
+
+	if "" != internalMatch.Network {
+		if _, exist := Networks.Profile(internalMatch.Network); false == exist {
+			log.Warning("Routing network profile", internalMatch.Network, "is not configured, requests use the global profile")
+		}
+	}
+
+	entries := make([]string, 0, len(hosts))
+	for host, addresses := range hosts {
+		entries = append(entries, host+"="+strings.Join(addresses, ","))
+	}
+	sort.Strings(entries)
+
+	key := internalMatch.Upstream + "|" + strings.Join(entries, ";") + "|" + internalMatch.Network
+	for _, route := range s.routes {
+		if key == route.key {
+			return route.match.AddMatchs(match)
+		}
+	}
+
+	route := &ruleRoute{key: key, upstream: internalMatch.Upstream, hosts: hosts, network: internalMatch.Network, match: compiler.NewURLMatch()}
+	s.routes = append(s.routes, route)
+
+	return route.match.AddMatchs(match)
+}
+
+// routeTransport 按改写前的 srcurl 返回命中规则指定的出口, 规则没有指定上游代理或 hosts 覆盖时返回 nil
+func (s *SRules) routeTransport(req *http.Request, srcurl *url.URL) *http.Transport {
+	for _, route := range s.routes {
+		if ("" == route.upstream && 0 == len(route.hosts)) || false == route.match.Match(srcurl) {
+			continue
+		}
+
+		dialer, remote, name := s.forward, s.forwardRemote, "remote"
+		if "" != route.upstream {
+			var exist bool
+			if dialer, exist = ParentProxies.Get(route.upstream); false == exist {
+				requestLog(req).With("upstream", route.upstream).Warning("Routing upstream is not configured")
+				dialer = s.forward
+			} else {
+				remote, name = true, "upstream:"+route.upstream
+			}
+		}
+
+		s.routeMutex.Lock()
+		defer s.routeMutex.Unlock()
+
+		if tran, exist := s.routeTransports[route.key]; exist {
+			return tran
+		}
+
+		tran := &http.Transport{
+			DialContext:     metricsDial(name, networkDial(Resolver.dialContext(dialer.Dial, remote, route.hosts))),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		s.routeTransports[route.key] = tran
+
+		return tran
+	}
+
+	return nil
+}
+
+// networkProfile 按改写前的 srcurl 返回请求模拟的网络状况, 命中规则指定的优先于全局设置
+func (s *SRules) networkProfile(srcurl *url.URL) (NetworkProfile, bool) {
+	for _, route := range s.routes {
+		if "" != route.network && route.match.Match(srcurl) {
+			return Networks.resolve(route.network)
+		}
+	}
+
+	return Networks.resolve("")
+}
+
 func (s *SRules) ResolveRequest(req *http.Request) (tran *http.Transport, resp *http.Response) {
 	var err error
 	var dsturl *url.URL
 	tran = s.tranpoort_local
+	srcurl := *req.URL
+
+	if resp = s.resolveStatusFault(req); nil != resp {
+		return nil, resp
+	}
 
 	if dsturl, err = s.GetFastRedirectURL(req); nil == err {
 		if false == strings.EqualFold(req.URL.String(), dsturl.String()) {
-			log.Info("Redirect request", req.URL, "to", dsturl)
+			requestLog(req).WithFields(log.Fields{"rule": RuleName(FastRedirect_URL), "target": dsturl.String()}).Info("Redirect request")
+			markTrafficRule(req, FastRedirect_URL)
 
 			req.URL = dsturl
 
 			tran = nil
 			resp = s.createRedirectResponse(dsturl.String(), req)
 		} else {
-			log.Info("Sending request", req.URL, "is remote.")
+			requestLog(req).With("upstream", "remote").Info("Sending request is remote")
 
 			resp = nil
 			tran = s.tranpoort_remote
 		}
 	} else if dsturl, err = s.GetRedirectURL(req); nil == err {
 		if false == strings.EqualFold(req.URL.String(), dsturl.String()) {
-			log.Info("Redirect request", req.URL, "to", dsturl)
+			requestLog(req).WithFields(log.Fields{"rule": RuleName(Redirect_URL), "target": dsturl.String()}).Info("Redirect request")
+			markTrafficRule(req, Redirect_URL)
 
 			req.URL = dsturl
 
 			tran = nil
 			resp = s.createRedirectResponse(dsturl.String(), req)
 		} else {
-			log.Info("Sending request", req.URL, "is remote.")
+			requestLog(req).With("upstream", "remote").Info("Sending request is remote")
 
 			resp = nil
 			tran = s.tranpoort_remote
 		}
 	} else if dsturl, err = s.GetRewriteURL(req); nil == err {
 		if strings.EqualFold(req.URL.Host, dsturl.Host) {
-			log.Info("Rewrite request", req.URL, "to", dsturl)
+			requestLog(req).WithFields(log.Fields{"rule": RuleName(Rewrite_URL), "target": dsturl.String(), "upstream": "remote"}).Info("Rewrite request")
+			markTrafficRule(req, Rewrite_URL)
 
 			req.URL = dsturl
 
 			resp = nil
 			tran = s.tranpoort_remote
 		} else {
-			log.Error("Rewrite request", req.URL, "to", dsturl, "failed: Unauthorized jump, the host does not match")
+			requestLog(req).WithFields(log.Fields{"rule": RuleName(Rewrite_URL), "target": dsturl.String()}).Error("Rewrite request failed: Unauthorized jump, the host does not match")
+		}
+	}
+
+	if tran == s.tranpoort_remote { // 命中规则的请求按规则指定的上游代理及 hosts 覆盖发送
+		if routeTran := s.routeTransport(req, &srcurl); nil != routeTran {
+			requestLog(req).With("upstream", s.transportName(routeTran)).Debug("Sending request through rule route")
+			tran = routeTran
 		}
 	}
 
@@ -230,7 +479,11 @@ func (s *SRules) ResolveRequest(req *http.Request) (tran *http.Transport, resp *
 func (s *SRules) GetResponseBody(resp *http.Response) (html []byte, err error) {
 	defer func() {
 		if nil != err {
-			log.Warning("Rewrite javescript failed, err:", err)
+			if nil != resp.Request {
+				requestLog(resp.Request).With("error", err).Warning("Read response body failed")
+			} else {
+				log.Warning("Rewrite javescript failed, err:", err)
+			}
 		}
 	}()
 
@@ -273,7 +526,7 @@ func (s *SRules) GetRewriteHTML(req *http.Request, resp *http.Response) (dst []b
 	resp.ContentLength = int64(len(newHTML))
 	if data, err := s.Replace(Rewrite_HTML, resp.Request.URL, newHTML); nil == err {
 		newHTML = data
-		log.Info("Injection html", resp.Request.URL.String(), " successed, old size", resp.ContentLength, ", new size", len(newHTML))
+		requestLog(req).WithFields(log.Fields{"rule": RuleName(Rewrite_HTML), "old_size": resp.ContentLength, "new_size": len(newHTML)}).Info("Injection html successed")
 	}
 
 	return newHTML, nil // 不能返回错误
@@ -292,7 +545,7 @@ func (s *SRules) GetRewriteJaveScript(req *http.Request, resp *http.Response) (d
 
 	if data, err := s.Replace(Rewrite_JaveScript, resp.Request.URL, newHTML); nil == err {
 		newHTML = data
-		log.Info("Injection html", resp.Request.URL.String(), " successed, old size is", resp.ContentLength)
+		requestLog(req).WithFields(log.Fields{"rule": RuleName(Rewrite_JaveScript), "old_size": resp.ContentLength, "new_size": len(newHTML)}).Info("Injection javascript successed")
 	}
 
 	return newHTML, nil // 不能返回错误
@@ -307,9 +560,11 @@ func (s *SRules) ResolveResponse(req *http.Request, resp *http.Response) *http.R
 	}
 
 	if html, err = s.GetRewriteHTML(req, resp); nil == err {
-		log.Info("Resolve response url(html):", resp.Request.URL)
+		requestLog(req).With("rule", RuleName(Rewrite_HTML)).Info("Resolve response")
+		markTrafficRule(req, Rewrite_HTML)
 	} else if html, err = s.GetRewriteJaveScript(req, resp); nil == err {
-		log.Info("Resolve response url(javascript):", resp.Request.URL)
+		requestLog(req).With("rule", RuleName(Rewrite_JaveScript)).Info("Resolve response")
+		markTrafficRule(req, Rewrite_JaveScript)
 	} else {
 		return resp
 	}
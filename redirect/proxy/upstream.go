@@ -0,0 +1,420 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ssoor/socks"
+	"github.com/ssoor/tracksocks/log"
+)
+
+// 上游选择策略
+const (
+	UpstreamFailover     = "failover"      // 按添加顺序使用第一个可用的上游
+	UpstreamRoundRobin   = "round-robin"   // 依次使用可用的上游
+	UpstreamLeastLatency = "least-latency" // 优先使用连接耗时最短的上游
+	UpstreamSticky       = "sticky"        // 同一目标 host 固定使用同一个上游, 不可用时使用下一个
+)
+
+// 熔断状态
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open" // 熔断超时后只允许一个试探连接
+)
+
+var ErrorNoUpstream = errors.New("no upstream available")
+
+type UpstreamPolicy struct {
+	Strategy         string
+	CheckInterval    time.Duration // 主动检查间隔
+	CheckTimeout     time.Duration
+	ProbeURL         string // 不为空时通过上游请求该地址, 5xx 或失败时认为上游不可用
+	FailureThreshold int    // 连续失败次数达到该值时熔断
+	OpenTimeout      time.Duration
+}
+
+var DefaultUpstreamPolicy = UpstreamPolicy{
+	Strategy:         UpstreamFailover,
+	CheckInterval:    30 * time.Second,
+	CheckTimeout:     5 * time.Second,
+	FailureThreshold: 3,
+	OpenTimeout:      30 * time.Second,
+}
+
+type UpstreamState struct {
+	Name      string    `json:"name"`
+	Address   string    `json:"address,omitempty"` // 为空时不进行 TCP 检查
+	Circuit   string    `json:"circuit"`
+	Failures  int       `json:"consecutive_failures"`
+	Latency   float64   `json:"latency_ms"` // 连接耗时的指数加权平均值
+	Requests  uint64    `json:"requests"`
+	Errors    uint64    `json:"errors"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	OpenUntil time.Time `json:"open_until,omitempty"`
+}
+
+type upstreamMember struct {
+	dialer   socks.Dialer
+	state    UpstreamState
+	trialing bool // 半开状态下已有试探连接
+}
+
+// UpstreamPool 在多个上游之间选择并自动切换, 通过主动检查及请求结果判断上游是否可用
+type UpstreamPool struct {
+	mutex   sync.Mutex
+	policy  UpstreamPolicy
+	members []*upstreamMember
+	next    int
+}
+
+var Upstreams = &UpstreamPool{policy: DefaultUpstreamPolicy}
+
+// SetPolicy 设置选择策略及检查参数, 为 0 的字段使用 DefaultUpstreamPolicy 中的值
+func (p *UpstreamPool) SetPolicy(policy UpstreamPolicy) error {
+	switch policy.Strategy {
+	case "":
+		policy.Strategy = DefaultUpstreamPolicy.Strategy
+	case UpstreamFailover, UpstreamRoundRobin, UpstreamLeastLatency, UpstreamSticky:
+	default:
+		return errors.New("unknown upstream strategy " + policy.Strategy)
+	}
+
+	if 0 == policy.CheckInterval {
+		policy.CheckInterval = DefaultUpstreamPolicy.CheckInterval
+	}
+	if 0 == policy.CheckTimeout {
+		policy.CheckTimeout = DefaultUpstreamPolicy.CheckTimeout
+	}
+	if 0 == policy.FailureThreshold {
+		policy.FailureThreshold = DefaultUpstreamPolicy.FailureThreshold
+	}
+	if 0 == policy.OpenTimeout {
+		policy.OpenTimeout = DefaultUpstreamPolicy.OpenTimeout
+	}
+
+	p.mutex.Lock()
+	p.policy = policy
+	p.mutex.Unlock()
+
+	return nil
+}
+
+// Add 添加上游, address 为上游代理的地址, 用于 TCP 检查
+func (p *UpstreamPool) Add(name string, address string, dialer socks.Dialer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.members = append(p.members, &upstreamMember{
+		dialer: dialer,
+		state:  UpstreamState{Name: name, Address: address, Circuit: CircuitClosed},
+	})
+	metricUpstreamUp.Set(1, name)
+}
+
+func (p *UpstreamPool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.members)
+}
+
+func (p *UpstreamPool) States() []UpstreamState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	states := make([]UpstreamState, 0, len(p.members))
+	for _, member := range p.members {
+		states = append(states, member.state)
+	}
+
+	return states
+}
+
+// candidates 按策略返回上游的尝试顺序
+func (p *UpstreamPool) candidates(addr string) []*upstreamMember {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	members := append([]*upstreamMember{}, p.members...)
+	switch p.policy.Strategy {
+	case UpstreamRoundRobin:
+		if 0 != len(members) {
+			p.next = (p.next + 1) % len(members)
+			members = append(members[p.next:], members[:p.next]...)
+		}
+	case UpstreamLeastLatency: // 还没有耗时记录的上游优先, 以便获取耗时
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].state.Latency < members[j].state.Latency
+		})
+	case UpstreamSticky: // rendezvous hashing, 上游变化时只影响原来使用该上游的 host
+		host, _, err := net.SplitHostPort(addr)
+		if nil != err {
+			host = addr
+		}
+
+		scores := make(map[*upstreamMember]uint64, len(members))
+		for _, member := range members {
+			hash := fnv.New64a()
+			hash.Write([]byte(host + "\x00" + member.state.Name))
+			scores[member] = hash.Sum64()
+		}
+
+		sort.SliceStable(members, func(i, j int) bool {
+			return scores[members[i]] > scores[members[j]]
+		})
+	}
+
+	return members
+}
+
+// acquire 检查上游是否允许建立连接, 熔断超时后转为半开状态并只允许一个试探连接
+func (p *UpstreamPool) acquire(member *upstreamMember) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch member.state.Circuit {
+	case CircuitOpen:
+		if time.Now().Before(member.state.OpenUntil) {
+			return false
+		}
+
+		member.state.Circuit = CircuitHalfOpen
+		member.trialing = false
+		fallthrough
+	case CircuitHalfOpen:
+		if member.trialing {
+			return false
+		}
+
+		member.trialing = true
+	}
+
+	return true
+}
+
+// report 记录上游的连接及请求结果
+func (p *UpstreamPool) report(member *upstreamMember, latency time.Duration, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state := &member.state
+	state.Requests++
+
+	if nil == err {
+		if CircuitClosed != state.Circuit {
+			log.WithFields(log.Fields{"upstream": state.Name}).Info("Upstream recovered")
+		}
+
+		state.Failures, state.Circuit, state.OpenUntil = 0, CircuitClosed, time.Time{}
+		member.trialing = false
+
+		if 0 < latency {
+			milliseconds := float64(latency) / float64(time.Millisecond)
+			if 0 == state.Latency {
+				state.Latency = milliseconds
+			} else {
+				state.Latency = 0.7*state.Latency + 0.3*milliseconds
+			}
+		}
+
+		metricUpstreamUp.Set(1, state.Name)
+		return
+	}
+
+	state.Errors++
+	state.Failures++
+	state.LastError = err.Error()
+
+	if CircuitHalfOpen == state.Circuit || (CircuitClosed == state.Circuit && state.Failures >= p.policy.FailureThreshold) {
+		state.Circuit, state.OpenUntil = CircuitOpen, time.Now().Add(p.policy.OpenTimeout)
+		member.trialing = false
+
+		log.WithFields(log.Fields{"upstream": state.Name, "failures": state.Failures, "error": err}).Warning("Upstream circuit opened")
+		metricUpstreamUp.Set(0, state.Name)
+	}
+}
+
+// Dial 按策略依次尝试可用的上游, 所有上游都被熔断时仍按顺序尝试, 避免误判导致完全无法访问
+func (p *UpstreamPool) Dial(network string, addr string) (net.Conn, error) {
+	members := p.candidates(addr)
+
+	tried, err := false, error(ErrorNoUpstream)
+	for _, member := range members {
+		if p.acquire(member) {
+			var conn net.Conn
+			if conn, err = p.dial(member, network, addr); nil == err {
+				return conn, nil
+			}
+			tried = true
+		}
+	}
+
+	if tried {
+		return nil, err
+	}
+
+	for _, member := range members {
+		var conn net.Conn
+		if conn, err = p.dial(member, network, addr); nil == err {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (p *UpstreamPool) dial(member *upstreamMember, network string, addr string) (net.Conn, error) {
+	started := time.Now()
+	conn, err := member.dialer.Dial(network, addr)
+
+	result := err
+	var target *UpstreamTargetError
+	if errors.As(err, &target) { // 上游代理正常应答, 只是无法连接目标, 不计入上游失败
+		result = nil
+	}
+	p.report(member, time.Since(started), result)
+
+	if nil != err {
+		log.WithFields(log.Fields{"upstream": member.state.Name, "addr": addr, "error": err}).Debug("Dial through upstream failed")
+		return nil, err
+	}
+
+	return &upstreamConn{Conn: conn, member: member}, nil
+}
+
+// Run 定期主动检查所有上游
+func (p *UpstreamPool) Run() {
+	for {
+		p.mutex.Lock()
+		interval := p.policy.CheckInterval
+		members := append([]*upstreamMember{}, p.members...)
+		p.mutex.Unlock()
+
+		for _, member := range members {
+			go p.check(member)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// check 进行 TCP 检查及 HTTP 检查, 都没有配置时只根据请求结果判断
+func (p *UpstreamPool) check(member *upstreamMember) {
+	p.mutex.Lock()
+	policy, address := p.policy, member.state.Address
+	p.mutex.Unlock()
+
+	if "" == address && "" == policy.ProbeURL {
+		return
+	}
+
+	started := time.Now()
+	err := checkUpstream(member.dialer, address, policy)
+
+	p.mutex.Lock()
+	member.state.LastCheck = time.Now()
+	p.mutex.Unlock()
+
+	if nil != err {
+		log.WithFields(log.Fields{"upstream": member.state.Name, "error": err}).Debug("Upstream check failed")
+	}
+
+	p.report(member, time.Since(started), err)
+}
+
+func checkUpstream(dialer socks.Dialer, address string, policy UpstreamPolicy) error {
+	if "" != address {
+		conn, err := net.DialTimeout("tcp", address, policy.CheckTimeout)
+		if nil != err {
+			return err
+		}
+		conn.Close()
+	}
+
+	if "" == policy.ProbeURL {
+		return nil
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+		DisableKeepAlives: true,
+	}
+
+	client := &http.Client{Transport: transport, Timeout: policy.CheckTimeout}
+	resp, err := client.Get(policy.ProbeURL)
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+
+	if http.StatusInternalServerError <= resp.StatusCode {
+		return errors.New("probe returned " + resp.Status)
+	}
+
+	return nil
+}
+
+// upstreamConn 记录连接所属的上游, 用于将请求结果归属到上游
+type upstreamConn struct {
+	net.Conn
+	member *upstreamMember
+}
+
+func upstreamMemberOf(conn net.Conn) *upstreamMember {
+	for {
+		switch c := conn.(type) {
+		case *upstreamConn:
+			return c.member
+		case *tls.Conn:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// upstreamTrace 通过 httptrace 获取请求使用的上游连接
+type upstreamTrace struct {
+	pool   *UpstreamPool
+	mutex  sync.Mutex
+	member *upstreamMember
+}
+
+func (p *UpstreamPool) trace(req *http.Request) (*http.Request, *upstreamTrace) {
+	trace := &upstreamTrace{pool: p}
+
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.mutex.Lock()
+			trace.member = upstreamMemberOf(info.Conn)
+			trace.mutex.Unlock()
+		},
+	})
+
+	return req.WithContext(ctx), trace
+}
+
+// report 记录请求结果. 上游代理的连接错误已在建立连接时记录, 获得连接后的错误来自目标服务器或客户端, 不计入上游失败
+func (t *upstreamTrace) report(err error) {
+	t.mutex.Lock()
+	member := t.member
+	t.mutex.Unlock()
+
+	if nil == member || nil != err {
+		return
+	}
+
+	t.pool.report(member, 0, nil)
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync/atomic"
+)
+
+// proxyChallenge 为代理 407 响应中 Proxy-Authenticate 的认证要求, 支持 Basic 及 Digest (RFC 7616, qop=auth)
+type proxyChallenge struct {
+	scheme string // basic 或 digest
+	params map[string]string
+	count  uint32 // Digest 的 nonce 使用次数
+}
+
+// parseProxyChallenge 从多个认证要求中选择支持的一个, Digest 优先. 每个头部只解析一个认证要求
+func parseProxyChallenge(values []string) (*proxyChallenge, error) {
+	var basic *proxyChallenge
+	for _, value := range values {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+		challenge := &proxyChallenge{scheme: strings.ToLower(scheme), params: parseAuthParams(rest)}
+
+		switch challenge.scheme {
+		case "digest":
+			if _, err := digestHash(challenge.params["algorithm"]); nil != err {
+				continue
+			}
+
+			if qop := challenge.params["qop"]; "" != qop && "" == challenge.qop() { // 只支持 auth-int 时无法使用
+				continue
+			}
+
+			return challenge, nil
+		case "basic":
+			basic = challenge
+		}
+	}
+
+	if nil == basic {
+		return nil, errors.New("unsupported proxy authentication: " + strings.Join(values, "; "))
+	}
+
+	return basic, nil
+}
+
+// parseAuthParams 解析 key=value 及 key="quoted value" 形式的认证参数, key 转换为小写
+func parseAuthParams(text string) map[string]string {
+	params := make(map[string]string)
+
+	for {
+		text = strings.TrimLeft(text, " \t,")
+		if "" == text {
+			return params
+		}
+
+		index := strings.IndexByte(text, '=')
+		if -1 == index {
+			return params
+		}
+
+		key := strings.ToLower(strings.TrimSpace(text[:index]))
+		text = strings.TrimLeft(text[index+1:], " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(text, "\"") {
+			text = text[1:]
+			for 0 != len(text) && '"' != text[0] {
+				if '\\' == text[0] && 1 < len(text) {
+					text = text[1:]
+				}
+				value.WriteByte(text[0])
+				text = text[1:]
+			}
+
+			if 0 != len(text) {
+				text = text[1:]
+			}
+		} else {
+			end := strings.IndexByte(text, ',')
+			if -1 == end {
+				end = len(text)
+			}
+			value.WriteString(strings.TrimSpace(text[:end]))
+			text = text[end:]
+		}
+
+		params[key] = value.String()
+	}
+}
+
+// qop 返回使用的 qop, 只支持 auth, 代理未要求 qop 时返回空字符串
+func (c *proxyChallenge) qop() string {
+	for _, qop := range strings.Split(c.params["qop"], ",") {
+		if "auth" == strings.TrimSpace(qop) {
+			return "auth"
+		}
+	}
+
+	return ""
+}
+
+// authorize 返回 Proxy-Authorization 头部, uri 对于 CONNECT 为目标地址
+func (c *proxyChallenge) authorize(auth *ProxyAuth, method string, uri string) string {
+	if "basic" == c.scheme {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))
+	}
+
+	var random [8]byte
+	rand.Read(random[:])
+	cnonce := hex.EncodeToString(random[:])
+
+	realm, nonce, algorithm, qop := c.params["realm"], c.params["nonce"], c.params["algorithm"], c.qop()
+	nc := fmt.Sprintf("%08x", atomic.AddUint32(&c.count, 1))
+	response := digestResponse(algorithm, auth.Username, auth.Password, realm, nonce, cnonce, nc, qop, method, uri)
+
+	fields := []string{
+		"username=" + quoteAuthParam(auth.Username),
+		"realm=" + quoteAuthParam(realm),
+		"nonce=" + quoteAuthParam(nonce),
+		"uri=" + quoteAuthParam(uri),
+		"response=" + quoteAuthParam(response),
+	}
+
+	if "" != algorithm {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+
+	if opaque, exist := c.params["opaque"]; exist {
+		fields = append(fields, "opaque="+quoteAuthParam(opaque))
+	}
+
+	if "" != qop {
+		fields = append(fields, "qop="+qop, "nc="+nc, "cnonce="+quoteAuthParam(cnonce))
+	}
+
+	return "Digest " + strings.Join(fields, ", ")
+}
+
+// digestHash 返回 Digest algorithm 对应的哈希函数, 为空时使用 MD5
+func digestHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New, nil
+	case "SHA-256":
+		return sha256.New, nil
+	}
+
+	return nil, errors.New("unsupported digest algorithm " + algorithm)
+}
+
+func digestResponse(algorithm, username, password, realm, nonce, cnonce, nc, qop, method, uri string) string {
+	newHash, _ := digestHash(algorithm)
+	h := func(text string) string {
+		sum := newHash()
+		sum.Write([]byte(text))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := h(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	if "" == qop {
+		return h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	return h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+}
+
+func quoteAuthParam(value string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+}
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ssoor/socks"
+	"github.com/ssoor/tracksocks/log"
+)
+
+var ErrorProxyAuthentication = errors.New("upstream proxy authentication failed")
+
+var (
+	upstreamDialTimeout      = 10 * time.Second
+	upstreamHandshakeTimeout = 30 * time.Second // TLS 握手, CONNECT 响应及 SOCKS5 协商的总时间
+)
+
+// UpstreamTargetError 为上游代理正常应答但拒绝或无法连接目标地址, 上游代理本身可用
+type UpstreamTargetError struct {
+	Reason string // CONNECT 响应状态或 SOCKS5 应答码
+}
+
+func (e *UpstreamTargetError) Error() string {
+	return e.Reason
+}
+
+// ProxyAuth 为上游代理的认证信息, HTTP 代理根据 407 响应选择 Basic 或 Digest 认证
+type ProxyAuth struct {
+	Username string
+	Password string
+}
+
+// NewProxyDialer 根据上游代理地址创建 Dialer, 支持 http:// 及 https:// (CONNECT) 和 socks5://,
+// auth 为空时使用地址中的用户名密码. 返回的 address 为上游代理自身的地址, 用于健康检查
+func NewProxyDialer(rawurl string, auth *ProxyAuth) (dialer socks.Dialer, address string, err error) {
+	proxyURL, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, "", err
+	}
+
+	if nil == auth && nil != proxyURL.User {
+		password, _ := proxyURL.User.Password()
+		auth = &ProxyAuth{Username: proxyURL.User.Username(), Password: password}
+	}
+
+	address = proxyURL.Host
+	if "" == proxyURL.Port() {
+		switch proxyURL.Scheme {
+		case "http":
+			address = net.JoinHostPort(proxyURL.Hostname(), "80")
+		case "https":
+			address = net.JoinHostPort(proxyURL.Hostname(), "443")
+		case "socks5":
+			address = net.JoinHostPort(proxyURL.Hostname(), "1080")
+		}
+	}
+
+	switch proxyURL.Scheme {
+	case "http":
+		return &httpConnectDialer{address: address, auth: auth}, address, nil
+	case "https":
+		return &httpConnectDialer{address: address, auth: auth, tls: &tls.Config{ServerName: proxyURL.Hostname()}}, address, nil
+	case "socks5":
+		if nil != auth && (len(auth.Username) > 255 || len(auth.Password) > 255) {
+			return nil, "", errors.New("socks5 username and password must not exceed 255 bytes")
+		}
+
+		return &socks5Dialer{address: address, auth: auth}, address, nil
+	}
+
+	return nil, "", errors.New("unsupported upstream proxy scheme " + proxyURL.Scheme)
+}
+
+// httpConnectDialer 通过 HTTP(S) 代理的 CONNECT 建立隧道
+type httpConnectDialer struct {
+	address string
+	auth    *ProxyAuth
+	tls     *tls.Config // 不为空时使用 TLS 连接代理
+
+	mutex     sync.Mutex
+	challenge *proxyChallenge // 最近一次 407 响应的认证要求, 之后的连接直接携带认证
+}
+
+func (d *httpConnectDialer) Dial(network string, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	challenge := d.challenge
+	d.mutex.Unlock()
+
+	conn, reader, resp, err := d.connect(addr, challenge)
+	if nil != err {
+		return nil, err
+	}
+
+	// 认证要求未知或 Digest nonce 过期时按新的要求重试一次
+	if http.StatusProxyAuthRequired == resp.StatusCode && nil != d.auth {
+		conn.Close()
+
+		if challenge, err = parseProxyChallenge(resp.Header.Values("Proxy-Authenticate")); nil != err {
+			return nil, fmt.Errorf("upstream proxy %s connect %s: %v", d.address, addr, err)
+		}
+
+		d.mutex.Lock()
+		d.challenge = challenge
+		d.mutex.Unlock()
+
+		if conn, reader, resp, err = d.connect(addr, challenge); nil != err {
+			return nil, err
+		}
+	}
+
+	if http.StatusOK != resp.StatusCode {
+		conn.Close()
+
+		if http.StatusProxyAuthRequired == resp.StatusCode {
+			return nil, fmt.Errorf("upstream proxy %s connect %s: %w", d.address, addr, ErrorProxyAuthentication)
+		}
+
+		return nil, fmt.Errorf("upstream proxy %s connect %s: %w", d.address, addr, &UpstreamTargetError{Reason: resp.Status})
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// connect 连接代理并发送 CONNECT 请求, 返回的连接需要由调用方关闭
+func (d *httpConnectDialer) connect(addr string, challenge *proxyChallenge) (net.Conn, *bufio.Reader, *http.Response, error) {
+	conn, err := (&net.Dialer{Timeout: upstreamDialTimeout}).Dial("tcp", d.address)
+	if nil != err {
+		return nil, nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+
+	if nil != d.tls {
+		tlsConn := tls.Client(conn, d.tls)
+		if err = tlsConn.Handshake(); nil != err {
+			conn.Close()
+			return nil, nil, nil, fmt.Errorf("upstream proxy %s tls handshake: %w", d.address, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if nil != challenge && nil != d.auth {
+		req.Header.Set("Proxy-Authorization", challenge.authorize(d.auth, http.MethodConnect, addr))
+	}
+
+	if err = req.Write(conn); nil != err {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if nil != err {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	resp.Body.Close()
+	conn.SetDeadline(time.Time{})
+
+	return conn, reader, resp, nil
+}
+
+// socks5Dialer 通过 SOCKS5 代理建立连接, 目标地址以域名形式发送, 由代理解析
+type socks5Dialer struct {
+	address string
+	auth    *ProxyAuth
+}
+
+func (d *socks5Dialer) Dial(network string, addr string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if nil != err {
+		return nil, err
+	}
+
+	if len(host) > 255 {
+		return nil, errors.New("socks5 target host is too long")
+	}
+
+	conn, err := (&net.Dialer{Timeout: upstreamDialTimeout}).Dial("tcp", d.address)
+	if nil != err {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if err = socks5Connect(conn, host, uint16(port), d.auth); nil != err {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s connect %s: %w", d.address, addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, host string, port uint16, auth *ProxyAuth) error {
+	methods := []byte{socks5Version, 1, socks5MethodNone}
+	if nil != auth {
+		methods = []byte{socks5Version, 2, socks5MethodNone, socks5MethodPassword}
+	}
+
+	if _, err := conn.Write(methods); nil != err {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); nil != err {
+		return err
+	}
+
+	if socks5Version != reply[0] {
+		return errorSocksVersion
+	}
+
+	switch {
+	case socks5MethodNone == reply[1]:
+	case socks5MethodPassword == reply[1] && nil != auth:
+		if err := socks5Authenticate(conn, auth); nil != err {
+			return err
+		}
+	default:
+		return ErrorProxyAuthentication
+	}
+
+	request := []byte{socks5Version, socksCmdConnect, 0x00, socks5AtypDomain, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, port)
+	if _, err := conn.Write(request); nil != err {
+		return err
+	}
+
+	return readSocks5Reply(conn)
+}
+
+// socks5Authenticate 为 RFC 1929 用户名密码认证
+func socks5Authenticate(conn net.Conn, auth *ProxyAuth) error {
+	request := []byte{socks5PasswordVer, byte(len(auth.Username))}
+	request = append(request, auth.Username...)
+	request = append(request, byte(len(auth.Password)))
+	request = append(request, auth.Password...)
+	if _, err := conn.Write(request); nil != err {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); nil != err {
+		return err
+	}
+
+	if 0x00 != reply[1] {
+		return ErrorProxyAuthentication
+	}
+
+	return nil
+}
+
+// readSocks5Reply 读取 CONNECT 的应答及绑定地址
+func readSocks5Reply(conn net.Conn) error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); nil != err {
+		return err
+	}
+
+	if socks5ReplySucceeded != header[1] {
+		return &UpstreamTargetError{Reason: fmt.Sprintf("socks5 reply %d", header[1])}
+	}
+
+	var size int
+	switch header[3] {
+	case socks5AtypIPv4:
+		size = net.IPv4len
+	case socks5AtypIPv6:
+		size = net.IPv6len
+	case socks5AtypDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); nil != err {
+			return err
+		}
+		size = int(length[0])
+	default:
+		return errorSocksCommand
+	}
+
+	_, err := io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+// ParentProxyRegistry 保存具名的上游代理, 规则通过 upstream 字段按名称引用, 规则中不包含认证信息
+type ParentProxyRegistry struct {
+	mutex   sync.RWMutex
+	dialers map[string]socks.Dialer
+}
+
+var ParentProxies = &ParentProxyRegistry{dialers: make(map[string]socks.Dialer)}
+
+func (r *ParentProxyRegistry) Set(name string, dialer socks.Dialer) {
+	r.mutex.Lock()
+	r.dialers[name] = dialer
+	r.mutex.Unlock()
+
+	log.WithFields(log.Fields{"upstream": name}).Info("Sign up parent proxy")
+}
+
+func (r *ParentProxyRegistry) Get(name string) (socks.Dialer, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	dialer, exist := r.dialers[name]
+	return dialer, exist
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDigestResponse(t *testing.T) {
+	// RFC 2617 3.5
+	response := digestResponse("", "Mufasa", "Circle Of Life", "testrealm@host.com", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "0a4f113b", "00000001", "auth", "GET", "/dir/index.html")
+	if "6629fae49393a05397450978507c4ef1" != response {
+		t.Fatalf("response = %s", response)
+	}
+}
+
+func TestParseProxyChallenge(t *testing.T) {
+	challenge, err := parseProxyChallenge([]string{`Basic realm="corp"`, `Digest realm="corp", qop="auth,auth-int", nonce="a\"b", algorithm=SHA-256`})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "digest" != challenge.scheme || `a"b` != challenge.params["nonce"] || "auth" != challenge.qop() {
+		t.Fatalf("challenge = %+v", challenge)
+	}
+
+	if challenge, err = parseProxyChallenge([]string{`Digest realm="corp", qop="auth-int", nonce="n"`, `Basic realm="corp"`}); nil != err || "basic" != challenge.scheme {
+		t.Fatalf("challenge = %+v, err = %v", challenge, err)
+	}
+
+	if _, err = parseProxyChallenge([]string{`NTLM`}); nil == err {
+		t.Fatal("expect unsupported challenge error")
+	}
+}
+
+// startAuthProxy 启动要求认证的 CONNECT 代理, 隧道内回显数据, 返回地址及建立的连接数
+func startAuthProxy(t *testing.T, scheme string) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	connections := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			atomic.AddInt32(connections, 1)
+
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if nil != err {
+					return
+				}
+
+				if false == checkProxyAuthorization(scheme, req) {
+					challenge := `Basic realm="corp"`
+					if "digest" == scheme {
+						challenge = `Digest realm="corp", nonce="abc", qop="auth", opaque="xyz"`
+					}
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: "+challenge+"\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				io.Copy(conn, reader)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), connections
+}
+
+func checkProxyAuthorization(scheme string, req *http.Request) bool {
+	authorization := req.Header.Get("Proxy-Authorization")
+	if "basic" == scheme {
+		return "Basic dXNlcjpwQHNz" == authorization // user:p@ss
+	}
+
+	if false == strings.HasPrefix(authorization, "Digest ") {
+		return false
+	}
+
+	params := parseAuthParams(strings.TrimPrefix(authorization, "Digest "))
+	expect := digestResponse("", "user", "p@ss", "corp", "abc", params["cnonce"], params["nc"], "auth", http.MethodConnect, req.Host)
+	return expect == params["response"] && req.Host == params["uri"] && "xyz" == params["opaque"]
+}
+
+func TestHTTPConnectDialerAuth(t *testing.T) {
+	for _, scheme := range []string{"basic", "digest"} {
+		address, connections := startAuthProxy(t, scheme)
+		dialer, _, err := NewProxyDialer("http://"+address, &ProxyAuth{Username: "user", Password: "p@ss"})
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			conn, err := dialer.Dial("tcp", "example.com:443")
+			if nil != err {
+				t.Fatalf("%s: %v", scheme, err)
+			}
+
+			conn.Write([]byte("ping"))
+			data := make([]byte, 4)
+			if _, err = io.ReadFull(conn, data); nil != err || "ping" != string(data) {
+				t.Fatalf("%s: tunnel data = %q, err = %v", scheme, data, err)
+			}
+			conn.Close()
+		}
+
+		if 3 != atomic.LoadInt32(connections) { // 首次连接收到 407 后重试, 之后直接携带认证
+			t.Fatalf("%s: connections = %d, want 3", scheme, atomic.LoadInt32(connections))
+		}
+	}
+
+	address, _ := startAuthProxy(t, "digest")
+	dialer, _, _ := NewProxyDialer("http://user:wrong@"+address, nil)
+	if _, err := dialer.Dial("tcp", "example.com:443"); false == errors.Is(err, ErrorProxyAuthentication) {
+		t.Fatalf("err = %v, want ErrorProxyAuthentication", err)
+	}
+}
+
+func TestSocks5DialerAuth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server := &SocksProxy{Username: "user", Password: "p@ss"}
+	targets := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+
+			addr, _ := server.handshake(&bufferedConn{Conn: conn, reader: bufio.NewReader(conn)})
+			targets <- addr
+			conn.Close()
+		}
+	}()
+
+	dialer, _, _ := NewProxyDialer("socks5://"+listener.Addr().String(), &ProxyAuth{Username: "user", Password: "p@ss"})
+	conn, err := dialer.Dial("tcp", "example.com:443")
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if addr := <-targets; "example.com:443" != addr {
+		t.Fatalf("target = %s", addr)
+	}
+
+	dialer, _, _ = NewProxyDialer("socks5://"+listener.Addr().String(), &ProxyAuth{Username: "user", Password: "wrong"})
+	if _, err = dialer.Dial("tcp", "example.com:443"); false == errors.Is(err, ErrorProxyAuthentication) {
+		t.Fatalf("err = %v, want ErrorProxyAuthentication", err)
+	}
+	<-targets
+}
+
+// startReplyProxy 启动读取请求后返回固定应答的代理
+func startReplyProxy(t *testing.T, reply []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+
+			conn.Read(make([]byte, 512))
+			conn.Write(reply)
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestUpstreamTargetError(t *testing.T) {
+	cases := []struct {
+		scheme string
+		reply  string
+		target bool
+	}{
+		{"http", "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n", true},
+		{"http", "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n", true},
+		{"http", "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", false},
+		{"http", "SSH-2.0-OpenSSH\r\n", false},
+		{"socks5", "\x05\x00\x05\x04\x00\x01\x00\x00\x00\x00\x00\x00", true}, // host unreachable
+		{"socks5", "\x05\x00\x05\x05\x00\x01\x00\x00\x00\x00\x00\x00", true}, // connection refused
+		{"socks5", "\x04\x5A", false},
+	}
+
+	for _, c := range cases {
+		dialer, _, _ := NewProxyDialer(c.scheme+"://"+startReplyProxy(t, []byte(c.reply)), nil)
+
+		var target *UpstreamTargetError
+		if _, err := dialer.Dial("tcp", "example.com:443"); nil == err || c.target != errors.As(err, &target) {
+			t.Fatalf("%s %q: err = %v", c.scheme, c.reply, err)
+		}
+	}
+}
+
+func TestUpstreamDialerHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { upstreamHandshakeTimeout = timeout }(upstreamHandshakeTimeout)
+	upstreamHandshakeTimeout = 50 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() { // 接受连接后不应答
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, scheme := range []string{"http", "https", "socks5"} {
+		dialer, _, _ := NewProxyDialer(scheme+"://"+listener.Addr().String(), nil)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := dialer.Dial("tcp", "example.com:443")
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			var ne net.Error
+			if false == errors.As(err, &ne) || false == ne.Timeout() {
+				t.Fatalf("%s: err = %v, want timeout", scheme, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: dial not returned", scheme)
+		}
+	}
+
+	address, _ := startAuthProxy(t, "basic")
+	dialer, _, _ := NewProxyDialer("http://user:p@ss@"+address, nil)
+	conn, err := dialer.Dial("tcp", "example.com:443")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	time.Sleep(2 * upstreamHandshakeTimeout) // 握手完成后清除超时
+	conn.Write([]byte("ping"))
+	data := make([]byte, 4)
+	if _, err = io.ReadFull(conn, data); nil != err || "ping" != string(data) {
+		t.Fatalf("tunnel data = %q, err = %v", data, err)
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeUpstream 按设置的错误返回连接结果, 并记录被尝试的顺序
+type fakeUpstream struct {
+	name   string
+	err    error
+	dialed *[]string
+}
+
+func (f *fakeUpstream) Dial(network string, addr string) (net.Conn, error) {
+	*f.dialed = append(*f.dialed, f.name)
+	if nil != f.err {
+		return nil, f.err
+	}
+
+	return &net.TCPConn{}, nil
+}
+
+func newTestUpstreamPool(t *testing.T, policy UpstreamPolicy, names ...string) (*UpstreamPool, map[string]*fakeUpstream, *[]string) {
+	pool := &UpstreamPool{}
+	if err := pool.SetPolicy(policy); nil != err {
+		t.Fatal(err)
+	}
+
+	dialed := new([]string)
+	upstreams := make(map[string]*fakeUpstream)
+	for _, name := range names {
+		upstreams[name] = &fakeUpstream{name: name, dialed: dialed}
+		pool.Add(name, "", upstreams[name])
+	}
+
+	return pool, upstreams, dialed
+}
+
+func TestUpstreamPoolCircuit(t *testing.T) {
+	pool, upstreams, dialed := newTestUpstreamPool(t, UpstreamPolicy{FailureThreshold: 2, OpenTimeout: time.Hour}, "a", "b")
+
+	failed := errors.New("connection refused")
+	refused := fmt.Errorf("upstream proxy b connect example.com:443: %w", &UpstreamTargetError{Reason: "502 Bad Gateway"})
+
+	steps := []struct {
+		name     string
+		errA     error
+		errB     error
+		expire   bool // 熔断超时
+		dialed   []string
+		served   string // 为空时应返回错误
+		circuits []string
+	}{
+		{"a fails once", failed, nil, false, []string{"a", "b"}, "b", []string{CircuitClosed, CircuitClosed}},
+		{"a reaches threshold", failed, nil, false, []string{"a", "b"}, "b", []string{CircuitOpen, CircuitClosed}},
+		{"open upstream skipped", nil, nil, false, []string{"b"}, "b", []string{CircuitOpen, CircuitClosed}},
+		{"target refused", nil, refused, false, []string{"b"}, "", []string{CircuitOpen, CircuitClosed}}, // 达到阈值也不熔断
+		{"target refused again", nil, refused, false, []string{"b"}, "", []string{CircuitOpen, CircuitClosed}},
+		{"half-open trial fails", failed, nil, true, []string{"a", "b"}, "b", []string{CircuitOpen, CircuitClosed}},
+		{"half-open trial recovers", nil, nil, true, []string{"a"}, "a", []string{CircuitClosed, CircuitClosed}},
+		{"all fail once", failed, failed, false, []string{"a", "b"}, "", []string{CircuitClosed, CircuitClosed}},
+		{"all open", failed, failed, false, []string{"a", "b"}, "", []string{CircuitOpen, CircuitOpen}},
+		{"all open fallback", failed, nil, false, []string{"a", "b"}, "b", []string{CircuitOpen, CircuitClosed}},
+	}
+
+	for _, step := range steps {
+		upstreams["a"].err, upstreams["b"].err = step.errA, step.errB
+		if step.expire {
+			for _, member := range pool.members {
+				member.state.OpenUntil = time.Now().Add(-time.Second)
+			}
+		}
+
+		*dialed = nil
+		conn, err := pool.Dial("tcp", "example.com:443")
+
+		if false == reflect.DeepEqual(step.dialed, *dialed) {
+			t.Fatalf("%s: dialed = %v, want %v", step.name, *dialed, step.dialed)
+		}
+
+		if "" == step.served {
+			if nil == err {
+				t.Fatalf("%s: expect error", step.name)
+			}
+		} else if member := upstreamMemberOf(conn); nil == member || step.served != member.state.Name {
+			t.Fatalf("%s: served by %v, err = %v", step.name, member, err)
+		}
+
+		for i, state := range pool.States() {
+			if step.circuits[i] != state.Circuit {
+				t.Fatalf("%s: %s circuit = %s, want %s", step.name, state.Name, state.Circuit, step.circuits[i])
+			}
+		}
+	}
+}
+
+func TestUpstreamPoolHalfOpen(t *testing.T) {
+	pool, _, _ := newTestUpstreamPool(t, UpstreamPolicy{FailureThreshold: 1, OpenTimeout: time.Hour}, "a")
+	member := pool.members[0]
+
+	pool.report(member, 0, errors.New("timeout"))
+	if CircuitOpen != member.state.Circuit || pool.acquire(member) {
+		t.Fatalf("circuit = %s, expect open circuit to refuse", member.state.Circuit)
+	}
+
+	member.state.OpenUntil = time.Now().Add(-time.Second)
+	if false == pool.acquire(member) || CircuitHalfOpen != member.state.Circuit {
+		t.Fatalf("circuit = %s, expect one trial", member.state.Circuit)
+	}
+
+	if pool.acquire(member) { // 试探连接完成前不允许其他连接
+		t.Fatal("expect only one trial in half-open state")
+	}
+
+	pool.report(member, 10*time.Millisecond, nil)
+	if CircuitClosed != member.state.Circuit || false == pool.acquire(member) || false == pool.acquire(member) {
+		t.Fatalf("circuit = %s, expect closed after recovery", member.state.Circuit)
+	}
+
+	empty := &UpstreamPool{}
+	if err := empty.SetPolicy(UpstreamPolicy{Strategy: "random"}); nil == err {
+		t.Fatal("expect unknown strategy error")
+	}
+
+	if _, err := empty.Dial("tcp", "example.com:443"); ErrorNoUpstream != err {
+		t.Fatalf("err = %v, want ErrorNoUpstream", err)
+	}
+}
+
+func candidateNames(members []*upstreamMember) []string {
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.state.Name)
+	}
+
+	return names
+}
+
+func TestUpstreamPoolCandidates(t *testing.T) {
+	cases := []struct {
+		strategy string
+		latency  []float64
+		want     [][]string // 连续调用的结果
+	}{
+		{UpstreamFailover, nil, [][]string{{"a", "b", "c"}, {"a", "b", "c"}}},
+		{UpstreamRoundRobin, nil, [][]string{{"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}, {"b", "c", "a"}}},
+		{UpstreamLeastLatency, []float64{30, 0, 10}, [][]string{{"b", "c", "a"}, {"b", "c", "a"}}}, // 没有耗时记录的上游优先
+		{UpstreamLeastLatency, []float64{20, 5, 20}, [][]string{{"b", "a", "c"}}},
+	}
+
+	for _, c := range cases {
+		pool, _, _ := newTestUpstreamPool(t, UpstreamPolicy{Strategy: c.strategy}, "a", "b", "c")
+		for i, latency := range c.latency {
+			pool.members[i].state.Latency = latency
+		}
+
+		for i, want := range c.want {
+			if names := candidateNames(pool.candidates("example.com:443")); false == reflect.DeepEqual(want, names) {
+				t.Fatalf("%s #%d: candidates = %v, want %v", c.strategy, i, names, want)
+			}
+		}
+	}
+
+	sticky, _, _ := newTestUpstreamPool(t, UpstreamPolicy{Strategy: UpstreamSticky}, "a", "b", "c")
+	reduced, _, _ := newTestUpstreamPool(t, UpstreamPolicy{Strategy: UpstreamSticky}, "a", "b")
+
+	used := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+
+		order := candidateNames(sticky.candidates(host + ":443"))
+		if again := candidateNames(sticky.candidates(host + ":80")); false == reflect.DeepEqual(order, again) {
+			t.Fatalf("%s: candidates = %v then %v", host, order, again)
+		}
+		used[order[0]] = true
+
+		if "c" != order[0] { // 移除其他上游不影响已有 host 的选择
+			if first := candidateNames(reduced.candidates(host))[0]; order[0] != first {
+				t.Fatalf("%s: first = %s after removing c, want %s", host, first, order[0])
+			}
+		}
+	}
+
+	if 3 != len(used) {
+		t.Fatalf("sticky hosts only use %v", used)
+	}
+}
@@ -1,19 +1,25 @@
 package redirect
 
 import (
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/ssoor/socks"
 	"github.com/ssoor/socks/upstream"
-	"github.com/ssoor/fundadore/log"
+	"github.com/ssoor/tracksocks/log"
 	"github.com/ssoor/fundadore/api"
 	"github.com/ssoor/fundadore/common"
-	"github.com/ssoor/fundadore/config"
-	"github.com/ssoor/fundadore/assistant"
 	
+	"github.com/ssoor/tracksocks/encode"
+	"github.com/ssoor/tracksocks/platform"
 	"github.com/ssoor/tracksocks/redirect/proxy"
+	"github.com/ssoor/tracksocks/settings"
 )
 
 const (
@@ -26,6 +32,102 @@ var (
 	ErrorStartEncodeModule error = errors.New("Start encode module failed")
 )
 
+// Options 为本地启动参数, 不由远程配置下发
+type Options struct {
+	CaptureFile       string        // 流量记录配置文件(JSON), 为空时不记录
+	BreakpointTimeout time.Duration // 断点暂停超时时间, 超时后自动放行
+	InspectorRecords  int           // 实时请求查看器保存的记录数, 为 0 时不记录
+	InspectorBodySize int64         // 实时请求查看器记录的请求及响应内容大小, 为 0 时不记录内容
+	RequestIDHeader   string        // 在响应中返回请求编号的头部名称, 为空时不返回
+	SystemProxy       bool          // 将系统代理设置为本程序提供的 PAC
+	EncodeKeyFile     string        // 加密端口的共享密钥文件, 为空时使用 platform.Dir()/encode.key
+	EncodeLegacy      bool          // 加密端口同时接受旧的异或协议, 用于兼容未升级的启动器
+}
+
+func loadCaptureSetting(fileName string) (setting proxy.CaptureSetting, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(fileName); nil != err {
+		return setting, err
+	}
+
+	err = json.Unmarshal(data, &setting)
+	return setting, err
+}
+
+// loadRules 读取规则内容, 本地文件优先于远程地址
+func loadRules(source settings.Source) (string, error) {
+	if "" != source.File {
+		data, err := ioutil.ReadFile(source.File)
+		return string(data), err
+	}
+
+	return api.GetURL(source.URL)
+}
+
+func runForwardProxy(addr string, streamRouter socks.Dialer, transport *proxy.HTTPTransport) {
+	waitTime := float32(1)
+
+	for {
+		proxy.StartForwardProxy(addr, streamRouter, transport)
+
+		waitTime += waitTime * 0.618
+		log.Warning("Start forward proxy unrecognized error, the terminal service will restart in", int(waitTime), "seconds ...")
+		time.Sleep(time.Duration(waitTime) * time.Second)
+	}
+}
+
+func runTransparentProxy(addr string, mode string, streamRouter socks.Dialer, transport *proxy.HTTPTransport) {
+	waitTime := float32(1)
+
+	for {
+		proxy.StartTransparentProxy(addr, mode, streamRouter, transport)
+
+		waitTime += waitTime * 0.618
+		log.Warning("Start transparent proxy unrecognized error, the terminal service will restart in", int(waitTime), "seconds ...")
+		time.Sleep(time.Duration(waitTime) * time.Second)
+	}
+}
+
+func runSocksProxy(addr string, auth settings.SocksAuth, streamRouter socks.Dialer, transport *proxy.HTTPTransport) {
+	waitTime := float32(1)
+
+	for {
+		proxy.StartSocksProxy(addr, auth.Username, auth.Password, streamRouter, transport)
+
+		waitTime += waitTime * 0.618
+		log.Warning("Start socks proxy unrecognized error, the terminal service will restart in", int(waitTime), "seconds ...")
+		time.Sleep(time.Duration(waitTime) * time.Second)
+	}
+}
+
+// startPACServer 提供根据规则生成的 /proxy.pac, 加密模式下代理端口无法被浏览器直接使用, 不提供 PAC
+func startPACServer(setting settings.Redirect, options Options, rules *proxy.SRules) {
+	addr := setting.Listen.PAC
+	if "off" == addr || setting.Encode {
+		return
+	}
+
+	if "" == addr {
+		addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(PACListenPort)))
+	}
+
+	server := &proxy.PACServer{Rules: rules, HTTPListener: "http"}
+	if "" != setting.Listen.Forward { // 正向代理支持 CONNECT, HTTPS 请求同样可以经过代理
+		server.HTTPListener, server.HTTPSListener = proxy.ForwardListenerName, proxy.ForwardListenerName
+	}
+
+	go proxy.StartPACServer(addr, server)
+
+	pacURL := "http://" + addr + "/proxy.pac"
+	log.Info("Serving proxy auto config at", pacURL)
+
+	if options.SystemProxy {
+		if err := platform.Current.SetPACProxy(pacURL); nil != err {
+			log.Warning("Set system pac proxy failed, err:", err)
+		}
+	}
+}
+
 func runHTTPProxy(addr string, streamRouter socks.Dialer, transport *proxy.HTTPTransport, encode bool) {
 	waitTime := float32(1)
 
@@ -62,7 +164,128 @@ func runHTTPSProxy(addr string, streamRouter socks.Dialer, transport *proxy.HTTP
 	}
 }
 
-func StartRedirect(account string, guid string, setting config.Redirect) (bool, error) {
+// setupEncodeAuth 读取加密端口的共享密钥, 不存在时生成, 启动器从同一文件读取密钥
+func setupEncodeAuth(options Options) error {
+	keyFile := options.EncodeKeyFile
+	if "" == keyFile {
+		keyFile = filepath.Join(platform.Dir(), "encode.key")
+	}
+
+	key, err := encode.LoadKey(keyFile)
+	if nil != err {
+		return err
+	}
+
+	proxy.SetEncodeAuth(key, options.EncodeLegacy)
+	log.Info("Encode key file:", keyFile, ", legacy protocol:", options.EncodeLegacy)
+
+	return nil
+}
+
+// setupResolver 设置连接使用的 DNS 服务器及全局 hosts 覆盖
+func setupResolver(dns settings.DNS) error {
+	if err := proxy.Resolver.SetHosts(dns.Hosts); nil != err {
+		return err
+	}
+
+	if err := proxy.Resolver.SetServers(dns.Servers, time.Duration(dns.Timeout)*time.Second); nil != err {
+		return err
+	}
+
+	if 0 != len(dns.Servers) || 0 != len(dns.Hosts) {
+		log.Info("DNS servers:", dns.Servers, ", hosts overrides:", len(dns.Hosts))
+	}
+
+	return nil
+}
+
+// setupNetwork 添加自定义网络状况并设置全局使用的网络状况
+func setupNetwork(network settings.Network) error {
+	profiles := make([]proxy.NetworkProfile, 0, len(network.Profiles))
+	for _, profile := range network.Profiles {
+		profiles = append(profiles, proxy.NetworkProfile(profile))
+	}
+
+	if err := proxy.Networks.AddProfiles(profiles); nil != err {
+		return err
+	}
+
+	if "" != network.Profile {
+		log.Info("Simulating network profile:", network.Profile)
+	}
+
+	return proxy.Networks.SetGlobal(network.Profile)
+}
+
+// newProxyDialer 读取上游代理的认证信息并创建 Dialer
+func newProxyDialer(upstreamProxy settings.Upstream) (socks.Dialer, string, error) {
+	username, password, exist, err := upstreamProxy.Credentials()
+	if nil != err {
+		return nil, "", err
+	}
+
+	var auth *proxy.ProxyAuth
+	if exist {
+		auth = &proxy.ProxyAuth{Username: username, Password: password}
+	}
+
+	return proxy.NewProxyDialer(upstreamProxy.URL, auth)
+}
+
+// newUpstreamRouter 将 upstreams_url 及 upstream_pool 中的代理加入 proxy.Upstreams, 没有上游时直接连接.
+// parent_proxies 中的代理加入 proxy.ParentProxies, 只用于指定了 upstream 的规则
+func newUpstreamRouter(setting settings.Redirect) (socks.Dialer, error) {
+	pool := setting.UpstreamPool
+	policy := proxy.UpstreamPolicy{
+		Strategy:         pool.Strategy,
+		CheckInterval:    time.Duration(pool.CheckInterval) * time.Second,
+		CheckTimeout:     time.Duration(pool.CheckTimeout) * time.Second,
+		ProbeURL:         pool.ProbeURL,
+		FailureThreshold: pool.FailureThreshold,
+		OpenTimeout:      time.Duration(pool.OpenTimeout) * time.Second,
+	}
+
+	if err := proxy.Upstreams.SetPolicy(policy); nil != err {
+		return nil, err
+	}
+
+	if "" != setting.Upstreams {
+		proxy.Upstreams.Add("upstreams_url", "", upstream.NewUpstreamDialerByURL(setting.Upstreams, 1*60*60))
+	}
+
+	for _, upstreamProxy := range pool.Proxies {
+		dialer, address, err := newProxyDialer(upstreamProxy)
+		if nil != err {
+			return nil, err
+		}
+
+		name := upstreamProxy.Name
+		if "" == name {
+			name = upstreamProxy.URL
+		}
+		proxy.Upstreams.Add(name, address, dialer)
+	}
+
+	for _, parent := range setting.ParentProxies {
+		dialer, _, err := newProxyDialer(parent)
+		if nil != err {
+			return nil, err
+		}
+
+		proxy.ParentProxies.Set(parent.Name, dialer)
+	}
+
+	if 0 == proxy.Upstreams.Len() {
+		return socks.Direct, nil
+	}
+
+	go proxy.Upstreams.Run()
+	log.Info("Upstream pool:", proxy.Upstreams.Len(), "upstreams, strategy:", pool.Strategy)
+
+	return proxy.Upstreams, nil
+}
+
+func StartRedirect(account string, guid string, setting settings.Redirect, options Options) (bool, error) {
 	var err error = nil
 
 	var connInternalIP string = "127.0.0.1"
@@ -74,21 +297,114 @@ func StartRedirect(account string, guid string, setting config.Redirect) (bool,
 		return false, ErrorStartEncodeModule
 	}
 
-	srules, err := api.GetURL(setting.RulesURL)
+	srules, err := loadRules(setting.Rules)
 	if err != nil {
 		log.Errorf("Query srules interface failed, err: %s\n", err)
 		return false, ErrorSettingQuery
 	}
 
-	router := upstream.NewUpstreamDialerByURL(setting.UpstreamsURL, 1 * 60 * 60)
+	if "" != setting.CA.Cert {
+		if err = proxy.LoadCA(setting.CA.Root, setting.CA.Cert, setting.CA.Key); nil != err {
+			log.Error("Load ca certificate failed:", err)
+			return false, err
+		}
+		log.Info("Using ca certificate", setting.CA.Cert)
+	}
+
+	router, err := newUpstreamRouter(setting)
+	if nil != err {
+		log.Error("Create upstream router failed, err:", err)
+		return false, err
+	}
+
+	if err = setupResolver(setting.DNS); nil != err {
+		log.Error("Setup dns resolver failed, err:", err)
+		return false, err
+	}
+
+	if err = setupNetwork(setting.Network); nil != err {
+		log.Error("Setup network simulation failed, err:", err)
+		return false, err
+	}
+
 	httpTransport := proxy.NewHTTPTransport(router, []byte(srules))
+	proxy.Interception.SetNeverIntercept(setting.NeverIntercept)
+	httpTransport.Rules.OverrideLimits(proxy.JSONLimits{MaxResponseContentLen: setting.Limits.MaxResponseContentLen})
+	httpTransport.RequestIDHeader = options.RequestIDHeader
+
+	proxy.Replay.SetTransport(httpTransport)
+
+	proxy.Inspector.Configure(options.InspectorRecords, options.InspectorBodySize)
+	if 0 == options.InspectorRecords {
+		log.Info("Traffic inspector is disabled")
+	}
+
+	if 0 != options.BreakpointTimeout {
+		proxy.Breakpoints.SetTimeout(options.BreakpointTimeout)
+	}
+
+	if "" != options.CaptureFile {
+		if captureSetting, err := loadCaptureSetting(options.CaptureFile); nil != err {
+			log.Warning("Load capture setting", options.CaptureFile, "failed, err:", err)
+		} else if httpTransport.Capture, err = proxy.NewCapturer(captureSetting); nil != err {
+			log.Warning("Create traffic capture failed, err:", err)
+		} else {
+			log.Info("Traffic capture is writing HAR files to", captureSetting.Dir)
+		}
+	}
 
-	addrHTTP, _ := common.SocketSelectAddr("tcp", connInternalIP)
+	if setting.Encode {
+		if err = setupEncodeAuth(options); nil != err {
+			log.Error("Load encode key failed, err:", err)
+			return false, ErrorStartEncodeModule
+		}
+	}
+
+	addrHTTP := setting.Listen.HTTP
+	if "" == addrHTTP {
+		addrHTTP, _ = common.SocketSelectAddr("tcp", connInternalIP)
+	}
 	go runHTTPProxy(addrHTTP, router, httpTransport, setting.Encode)
 
-	addrHTTPS, _ := common.SocketSelectAddr("tcp", connInternalIP)
+	addrHTTPS := setting.Listen.HTTPS
+	if "" == addrHTTPS {
+		addrHTTPS, _ = common.SocketSelectAddr("tcp", connInternalIP)
+	}
 	go runHTTPSProxy(addrHTTPS, router, httpTransport, setting.Encode)
 
+	if "" != setting.Listen.Forward {
+		if setting.Encode {
+			log.Warning("Forward proxy is not available in encode mode")
+		} else {
+			go runForwardProxy(setting.Listen.Forward, router, httpTransport)
+			log.Info("\tForward Protocol:", setting.Listen.Forward)
+
+			if host, port, err := common.SocketGetPortFormAddr(setting.Listen.Forward); nil == err {
+				platform.Current.ShareProxyAddr(platform.ShareForward, host, port)
+			}
+		}
+	}
+
+	if "" != setting.Listen.Transparent {
+		if setting.Encode {
+			log.Warning("Transparent proxy is not available in encode mode")
+		} else {
+			go runTransparentProxy(setting.Listen.Transparent, setting.Listen.TransparentMode, router, httpTransport)
+			log.Info("\tTransparent Protocol:", setting.Listen.Transparent)
+		}
+	}
+
+	if "" != setting.Listen.Socks {
+		if setting.Encode {
+			log.Warning("Socks proxy is not available in encode mode")
+		} else {
+			go runSocksProxy(setting.Listen.Socks, setting.Listen.SocksAuth, router, httpTransport)
+			log.Info("\tSocks Protocol:", setting.Listen.Socks, ", authentication:", "" != setting.Listen.SocksAuth.Username)
+		}
+	}
+
+	startPACServer(setting, options, httpTransport.Rules)
+
 	log.Info("Creating an internal server:")
 
 	log.Info("\tHTTP Protocol:", addrHTTP)
@@ -99,25 +415,26 @@ func StartRedirect(account string, guid string, setting config.Redirect) (bool,
 		return false, ErrorSocksdCreate
 	}
 
+	// HTTPS 端口在任何模式下都会解密命中规则的连接, 非 Windows 系统只导出证书并在日志中给出安装步骤
+	if err = proxy.AddCertificateToSystemStore(); nil != err {
+		log.Warning("Add certificate to system store failed, err:", err)
+	}
+
 	if setting.Encode {
-		if err = proxy.AddCertificateToSystemStore(); nil != err {
-			log.Warning("Add certificate to system stroe failed, err:", err)
-		}
-		
 		log.Info("Setting redirect data share:")
 
 		if host, port, err := common.SocketGetPortFormAddr(addrHTTP); nil != err {
 			log.Warning("\tHTTP port parse failed, err:", err)
 		}else{
-			handle, err := assistant.SetBusinessData(1, 1, host, port)
-			log.Info("\tHTTP handle:", handle, ", err:", err)
+			err := platform.Current.ShareProxyAddr(platform.ShareHTTP, host, port)
+			log.Info("\tHTTP share:", host, port, ", err:", err)
 		}
 		
 		if host, port, err := common.SocketGetPortFormAddr(addrHTTPS); nil != err {
 			log.Warning("\tHTTPS port parse failed, err:", err)
 		}else{
-			handle, err := assistant.SetBusinessData(2, 1, host, port)
-			log.Info("\tHTTPS handle:", handle, ", err:", err)
+			err := platform.Current.ShareProxyAddr(platform.ShareHTTPS, host, port)
+			log.Info("\tHTTPS share:", host, port, ", err:", err)
 		}
 	}
 
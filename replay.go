@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/ssoor/tracksocks/internest"
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+// runReplay 通过 internest 接口重新发送记录中的请求:
+//
+//	tracksocks replay -api 127.0.0.1:port -id 12 -n 100 -c 10
+func runReplay(args []string) int {
+	var api, editFile, tokenFile string
+	var replay proxy.ReplayRequest
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.StringVar(&api, "api", "", "internest api address, e.g. 127.0.0.1:8080")
+	flags.Uint64Var(&replay.ID, "id", 0, "traffic record id to replay, 0 to compose a new request")
+	flags.StringVar(&replay.Method, "X", "", "override request method")
+	flags.StringVar(&replay.URL, "url", "", "override request url")
+	flags.StringVar(&editFile, "edit", "", "json file with request overrides (method, url, header, body)")
+	flags.StringVar(&tokenFile, "token-file", internest.DefaultTokenFile(), "internest access token file")
+	flags.IntVar(&replay.Repeat, "n", 1, "repeat the request n times")
+	flags.IntVar(&replay.Concurrency, "c", 1, "number of concurrent requests")
+	flags.Parse(args)
+
+	if "" == api {
+		fmt.Fprintln(os.Stderr, "internest api address is required")
+		return 2
+	}
+
+	if "" != editFile {
+		data, err := ioutil.ReadFile(editFile)
+		if nil == err {
+			err = json.Unmarshal(data, &replay)
+		}
+
+		if nil != err {
+			fmt.Fprintln(os.Stderr, "load edit file failed:", err)
+			return 2
+		}
+	}
+
+	token, err := internest.ReadTokenFile(tokenFile)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, "read internest token failed:", err)
+		return 2
+	}
+
+	data, _ := json.Marshal(replay)
+	req, _ := http.NewRequest(http.MethodPost, "http://"+api+"/traffic/replay", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(internest.TokenHeader, token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, "replay request failed:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if http.StatusOK != resp.StatusCode {
+		fmt.Fprintln(os.Stderr, "replay failed:", resp.Status, string(body))
+		return 1
+	}
+
+	var out bytes.Buffer
+	if nil != json.Indent(&out, body, "", "  ") {
+		out.Write(body)
+	}
+
+	fmt.Println(out.String())
+	return 0
+}
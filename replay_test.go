@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/socks"
+
+	"github.com/ssoor/tracksocks/internest"
+	"github.com/ssoor/tracksocks/redirect/proxy"
+)
+
+func TestRunReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + r.Header.Get("X-Edit") + " " + string(body)))
+	}))
+	defer upstream.Close()
+
+	proxy.Replay.SetTransport(proxy.NewHTTPTransport(socks.Direct, []byte(`{}`)))
+	defer proxy.Replay.SetTransport(nil)
+
+	const token = "replay-token"
+	var replayed proxy.ReplaySummary
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/traffic/replay" != r.URL.Path || token != r.Header.Get(internest.TokenHeader) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		status, body, header := internest.NewTrafficReplayAPI().Post(nil, r)
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(status)
+		w.Write(body.([]byte))
+
+		json.Unmarshal(body.([]byte), &replayed)
+	}))
+	defer api.Close()
+
+	dir := t.TempDir()
+	tokenFile, editFile := filepath.Join(dir, "internest.token"), filepath.Join(dir, "edit.json")
+	os.WriteFile(tokenFile, []byte(token+"\n"), 0600)
+	os.WriteFile(editFile, []byte(`{"header":{"X-Edit":["yes"]},"body":"edited"}`), 0600)
+
+	addr := strings.TrimPrefix(api.URL, "http://")
+	if code := runReplay([]string{"-api", addr, "-token-file", tokenFile, "-url", upstream.URL + "/path", "-X", "POST", "-edit", editFile, "-n", "3", "-c", "2"}); 0 != code {
+		t.Fatalf("exit code = %d", code)
+	}
+
+	if 3 != replayed.Count || 3 != replayed.Status[http.StatusOK] || "POST /path yes edited" != replayed.First.Body {
+		t.Fatalf("summary = %+v", replayed)
+	}
+
+	os.WriteFile(tokenFile, []byte("wrong"), 0600)
+	if code := runReplay([]string{"-api", addr, "-token-file", tokenFile, "-url", upstream.URL}); 1 != code {
+		t.Fatalf("exit code with wrong token = %d", code)
+	}
+
+	if code := runReplay([]string{"-token-file", tokenFile}); 2 != code {
+		t.Fatalf("exit code without api = %d", code)
+	}
+}
@@ -0,0 +1,373 @@
+// Package settings 为本地配置文件, 支持 JSON、YAML 及 TOML 格式.
+// 启用远程配置时, 远程下发的内容合并到本地配置之上.
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ssoor/fundadore/config"
+)
+
+// Remote 为远程配置来源, 未启用时完全使用本地配置
+type Remote struct {
+	Enable  bool   `json:"enable" yaml:"enable" toml:"enable"`
+	Account string `json:"account" yaml:"account" toml:"account"` // 为空时使用 -k 参数
+	GUID    string `json:"guid" yaml:"guid" toml:"guid"`          // 为空时使用 -guid 参数
+}
+
+// Listen 为代理监听地址, 为空时随机选择本机端口
+type Listen struct {
+	HTTP  string `json:"http" yaml:"http" toml:"http"`
+	HTTPS string `json:"https" yaml:"https" toml:"https"`
+
+	// Forward 为同时支持 HTTP 及 CONNECT 的正向代理地址, 可用于 HTTP_PROXY/HTTPS_PROXY, 为空时不启用
+	Forward string `json:"forward" yaml:"forward" toml:"forward"`
+
+	// Transparent 为透明代理地址, 只支持 Linux, 需要配合 iptables/nftables 将流量重定向到该地址
+	Transparent     string `json:"transparent" yaml:"transparent" toml:"transparent"`
+	TransparentMode string `json:"transparent_mode" yaml:"transparent_mode" toml:"transparent_mode"` // redirect(默认) 或 tproxy
+
+	// Socks 为 SOCKS5/SOCKS4a 代理地址, 为空时不启用
+	Socks     string    `json:"socks" yaml:"socks" toml:"socks"`
+	SocksAuth SocksAuth `json:"socks_auth" yaml:"socks_auth" toml:"socks_auth"`
+
+	PAC string `json:"pac" yaml:"pac" toml:"pac"` // 为空时使用 127.0.0.1:44366, "off" 时不提供 PAC
+}
+
+// SocksAuth 为 SOCKS5 用户名密码认证, Username 为空时不需要认证, 设置后不接受 SOCKS4 连接
+type SocksAuth struct {
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+}
+
+// Source 为内容来源, File 优先于 URL
+type Source struct {
+	File string `json:"file" yaml:"file" toml:"file"`
+	URL  string `json:"url" yaml:"url" toml:"url"`
+}
+
+type HtmlNested struct {
+	Path   string            `json:"path" yaml:"path" toml:"path"`
+	Status int               `json:"status" yaml:"status" toml:"status"`
+	Data   string            `json:"data" yaml:"data" toml:"data"`
+	Header map[string]string `json:"header" yaml:"header" toml:"header"`
+}
+
+type URLNested struct {
+	Type      int    `json:"type" yaml:"type" toml:"type"`
+	Path      string `json:"path" yaml:"path" toml:"path"`
+	Title     string `json:"title" yaml:"title" toml:"title"`
+	URL       string `json:"url" yaml:"url" toml:"url"`
+	ScriptURL string `json:"script_url" yaml:"script_url" toml:"script_url"`
+}
+
+// Metrics 为 Prometheus 指标的独立监听地址, internest 端口只允许本机访问
+type Metrics struct {
+	Listen string `json:"listen" yaml:"listen" toml:"listen"` // 如 0.0.0.0:9100, 为空时不单独监听
+	Token  string `json:"token" yaml:"token" toml:"token"`    // 不为空时需要 Authorization: Bearer <token>
+}
+
+type Internest struct {
+	APIPort    int          `json:"api_port" yaml:"api_port" toml:"api_port"` // 为 0 时随机选择端口
+	HtmlNested []HtmlNested `json:"html_nested" yaml:"html_nested" toml:"html_nested"`
+	URLNested  []URLNested  `json:"url_nested" yaml:"url_nested" toml:"url_nested"`
+	Metrics    Metrics      `json:"metrics" yaml:"metrics" toml:"metrics"`
+}
+
+// CA 为签发站点证书使用的证书文件(PEM), 为空时使用内置证书
+type CA struct {
+	Root string `json:"root" yaml:"root" toml:"root"`
+	Cert string `json:"cert" yaml:"cert" toml:"cert"`
+	Key  string `json:"key" yaml:"key" toml:"key"`
+}
+
+// Limits 不为 0 的字段覆盖规则中的同名限制
+type Limits struct {
+	MaxResponseContentLen int64 `json:"max_response_content_len" yaml:"max_response_content_len" toml:"max_response_content_len"`
+}
+
+// Upstream 为上游代理, URL 支持 http://、https://host:port 及 socks5://host:port.
+// 认证信息优先从 CredentialsFile 读取, 其次从环境变量读取, 都未设置时使用 URL 中的用户名密码
+type Upstream struct {
+	Name string `json:"name" yaml:"name" toml:"name"` // 为空时使用 URL
+	URL  string `json:"url" yaml:"url" toml:"url"`
+
+	CredentialsFile string `json:"credentials_file" yaml:"credentials_file" toml:"credentials_file"` // 内容为 username:password
+	UsernameEnv     string `json:"username_env" yaml:"username_env" toml:"username_env"`
+	PasswordEnv     string `json:"password_env" yaml:"password_env" toml:"password_env"`
+}
+
+// Credentials 读取上游代理的用户名密码, 未配置时 exist 为 false
+func (u Upstream) Credentials() (username string, password string, exist bool, err error) {
+	if "" != u.CredentialsFile {
+		data, err := ioutil.ReadFile(u.CredentialsFile)
+		if nil != err {
+			return "", "", false, err
+		}
+
+		username, password, found := strings.Cut(strings.TrimRight(string(data), "\r\n"), ":")
+		if false == found {
+			return "", "", false, errors.New("credentials file " + u.CredentialsFile + " must contain username:password")
+		}
+
+		return username, password, true, nil
+	}
+
+	if "" != u.UsernameEnv {
+		return os.Getenv(u.UsernameEnv), os.Getenv(u.PasswordEnv), true, nil
+	}
+
+	return "", "", false, nil
+}
+
+// UpstreamPool 为上游代理的选择策略及健康检查, 时间以秒为单位, 为 0 时使用默认值
+type UpstreamPool struct {
+	Strategy         string     `json:"strategy" yaml:"strategy" toml:"strategy"` // failover(默认), round-robin, least-latency 或 sticky
+	Proxies          []Upstream `json:"proxies" yaml:"proxies" toml:"proxies"`
+	CheckInterval    int        `json:"check_interval" yaml:"check_interval" toml:"check_interval"`
+	CheckTimeout     int        `json:"check_timeout" yaml:"check_timeout" toml:"check_timeout"`
+	ProbeURL         string     `json:"probe_url" yaml:"probe_url" toml:"probe_url"` // 不为空时通过上游请求该地址检查
+	FailureThreshold int        `json:"failure_threshold" yaml:"failure_threshold" toml:"failure_threshold"`
+	OpenTimeout      int        `json:"open_timeout" yaml:"open_timeout" toml:"open_timeout"`
+}
+
+// DNS 为建立连接时使用的域名解析, 经过上游代理的连接由上游代理解析, 只应用 hosts 覆盖
+type DNS struct {
+	Servers []string          `json:"servers" yaml:"servers" toml:"servers"` // 依次尝试, 支持 udp://、tcp://、tls:// (DoT) 及 https:// (DoH), 为空时使用系统解析
+	Hosts   map[string]string `json:"hosts" yaml:"hosts" toml:"hosts"`       // host -> 地址, 以 . 开头的为模糊匹配, 多个地址以逗号分隔
+	Timeout int               `json:"timeout" yaml:"timeout" toml:"timeout"` // 单次查询超时秒数, 为 0 时使用默认值
+}
+
+// NetworkProfile 为自定义的网络状况, 速度为 0 时不限制
+type NetworkProfile struct {
+	Name         string  `json:"name" yaml:"name" toml:"name"`
+	LatencyMS    int     `json:"latency_ms" yaml:"latency_ms" toml:"latency_ms"`
+	JitterMS     int     `json:"jitter_ms" yaml:"jitter_ms" toml:"jitter_ms"`
+	DownloadKbps int     `json:"download_kbps" yaml:"download_kbps" toml:"download_kbps"`
+	UploadKbps   int     `json:"upload_kbps" yaml:"upload_kbps" toml:"upload_kbps"`
+	ResetRate    float64 `json:"reset_rate" yaml:"reset_rate" toml:"reset_rate"` // 响应被重置的概率, 0 至 1
+}
+
+// Network 为模拟的网络状况, 内置 slow-3g、3g、4g 及 flaky-wifi
+type Network struct {
+	Profile  string           `json:"profile" yaml:"profile" toml:"profile"` // 所有请求使用的网络状况, 为空时不模拟
+	Profiles []NetworkProfile `json:"profiles" yaml:"profiles" toml:"profiles"`
+}
+
+type Redirect struct {
+	Encode    bool   `json:"encode" yaml:"encode" toml:"encode"`
+	Listen    Listen `json:"listen" yaml:"listen" toml:"listen"`
+	Rules     Source `json:"rules" yaml:"rules" toml:"rules"`
+	Upstreams string `json:"upstreams_url" yaml:"upstreams_url" toml:"upstreams_url"` // 上游代理列表地址, 与 upstream_pool 中的代理都为空时直接连接
+	CA        CA     `json:"ca" yaml:"ca" toml:"ca"`
+	Limits    Limits `json:"limits" yaml:"limits" toml:"limits"`
+
+	UpstreamPool UpstreamPool `json:"upstream_pool" yaml:"upstream_pool" toml:"upstream_pool"`
+
+	DNS     DNS     `json:"dns" yaml:"dns" toml:"dns"`
+	Network Network `json:"network" yaml:"network" toml:"network"`
+
+	// ParentProxies 为规则通过 upstream 字段按名称引用的上游代理
+	ParentProxies []Upstream `json:"parent_proxies" yaml:"parent_proxies" toml:"parent_proxies"`
+
+	// NeverIntercept 中的 host 即使存在规则也不解密, 以 . 开头的为模糊匹配
+	NeverIntercept []string `json:"never_intercept" yaml:"never_intercept" toml:"never_intercept"`
+}
+
+type Settings struct {
+	Remote    Remote    `json:"remote" yaml:"remote" toml:"remote"`
+	Redirect  Redirect  `json:"redirect" yaml:"redirect" toml:"redirect"`
+	Internest Internest `json:"internest" yaml:"internest" toml:"internest"`
+}
+
+// RemoteOnly 返回未指定配置文件时使用的设置, 与之前一样所有内容均由远程下发
+func RemoteOnly() *Settings {
+	return &Settings{Remote: Remote{Enable: true}}
+}
+
+// Load 按扩展名解析配置文件, .yaml/.yml 为 YAML, .toml 为 TOML, 其他为 JSON
+func Load(fileName string) (*Settings, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if nil != err {
+		return nil, err
+	}
+
+	setting := &Settings{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, setting)
+	case ".toml":
+		err = toml.Unmarshal(data, setting)
+	default:
+		err = json.Unmarshal(data, setting)
+	}
+
+	if nil != err {
+		return nil, errors.New("parse config " + fileName + " failed: " + err.Error())
+	}
+
+	setting.resolvePaths(filepath.Dir(fileName))
+	return setting, setting.Validate()
+}
+
+// resolvePaths 将相对路径转换为相对于配置文件所在目录的路径
+func (s *Settings) resolvePaths(dir string) {
+	paths := []*string{&s.Redirect.Rules.File, &s.Redirect.CA.Root, &s.Redirect.CA.Cert, &s.Redirect.CA.Key}
+	for i := range s.Redirect.UpstreamPool.Proxies {
+		paths = append(paths, &s.Redirect.UpstreamPool.Proxies[i].CredentialsFile)
+	}
+	for i := range s.Redirect.ParentProxies {
+		paths = append(paths, &s.Redirect.ParentProxies[i].CredentialsFile)
+	}
+
+	for _, path := range paths {
+		if "" != *path && false == filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+}
+
+func (s *Settings) Validate() error {
+	if false == s.Remote.Enable && "" == s.Redirect.Rules.File && "" == s.Redirect.Rules.URL {
+		return errors.New("rules file or url is required when remote settings are disabled")
+	}
+
+	if ("" == s.Redirect.CA.Cert) != ("" == s.Redirect.CA.Key) {
+		return errors.New("ca cert and key must be set together")
+	}
+
+	switch s.Redirect.Listen.TransparentMode {
+	case "", "redirect", "tproxy":
+	default:
+		return errors.New("unknown transparent mode: " + s.Redirect.Listen.TransparentMode)
+	}
+
+	if len(s.Redirect.Listen.SocksAuth.Username) > 255 || len(s.Redirect.Listen.SocksAuth.Password) > 255 {
+		return errors.New("socks username and password must not exceed 255 bytes")
+	}
+
+	switch s.Redirect.UpstreamPool.Strategy {
+	case "", "failover", "round-robin", "least-latency", "sticky":
+	default:
+		return errors.New("unknown upstream strategy: " + s.Redirect.UpstreamPool.Strategy)
+	}
+
+	for _, proxy := range append(append([]Upstream{}, s.Redirect.UpstreamPool.Proxies...), s.Redirect.ParentProxies...) {
+		if proxyURL, err := url.Parse(proxy.URL); nil != err || "" == proxyURL.Host {
+			return errors.New("invalid upstream proxy url: " + proxy.URL)
+		}
+	}
+
+	parentNames := make(map[string]bool)
+	for _, parent := range s.Redirect.ParentProxies {
+		if "" == parent.Name || parentNames[parent.Name] {
+			return errors.New("parent proxy name must be unique and not empty: " + parent.URL)
+		}
+		parentNames[parent.Name] = true
+	}
+
+	for _, server := range s.Redirect.DNS.Servers {
+		if serverURL, err := url.Parse(server); strings.Contains(server, "://") && (nil != err || "" == serverURL.Host) {
+			return errors.New("invalid dns server: " + server)
+		}
+	}
+
+	for host, addresses := range s.Redirect.DNS.Hosts {
+		for _, address := range strings.Split(addresses, ",") {
+			if nil == net.ParseIP(strings.TrimSpace(address)) {
+				return errors.New("invalid dns hosts address for " + host + ": " + address)
+			}
+		}
+	}
+
+	if "" != s.Internest.Metrics.Listen {
+		if _, _, err := net.SplitHostPort(s.Internest.Metrics.Listen); nil != err {
+			return errors.New("invalid metrics listen address: " + s.Internest.Metrics.Listen)
+		}
+	}
+
+	for _, nested := range s.Internest.HtmlNested {
+		if false == strings.HasPrefix(nested.Path, "/") {
+			return errors.New("internest html nested path must start with /: " + nested.Path)
+		}
+	}
+
+	for _, nested := range s.Internest.URLNested {
+		if false == strings.HasPrefix(nested.Path, "/") {
+			return errors.New("internest url nested path must start with /: " + nested.Path)
+		}
+	}
+
+	return nil
+}
+
+// Merge 将远程下发的设置合并到本地设置之上, 远程未设置的内容保持本地值
+func (s *Settings) Merge(remote *config.Settings) {
+	if remote.Redirect.Encode { // 远程配置无法区分未设置及关闭, 只在开启时覆盖
+		s.Redirect.Encode = true
+	}
+
+	if "" != remote.Redirect.RulesURL {
+		s.Redirect.Rules = Source{URL: remote.Redirect.RulesURL}
+	}
+
+	if "" != remote.Redirect.UpstreamsURL {
+		s.Redirect.Upstreams = remote.Redirect.UpstreamsURL
+	}
+
+	if 0 != remote.Internest.APIPort {
+		s.Internest.APIPort = remote.Internest.APIPort
+	}
+
+	for _, nested := range remote.Internest.HtmlNested {
+		s.Internest.HtmlNested = mergeHtmlNested(s.Internest.HtmlNested, HtmlNested{
+			Path:   nested.Path,
+			Status: nested.Status,
+			Data:   nested.Data,
+			Header: nested.Header,
+		})
+	}
+
+	for _, nested := range remote.Internest.URLNested {
+		s.Internest.URLNested = mergeURLNested(s.Internest.URLNested, URLNested{
+			Type:      int(nested.Type),
+			Path:      nested.Path,
+			Title:     nested.Title,
+			URL:       nested.URL,
+			ScriptURL: nested.ScriptURL,
+		})
+	}
+}
+
+// mergeHtmlNested 相同路径的资源由新内容替换
+func mergeHtmlNested(list []HtmlNested, nested HtmlNested) []HtmlNested {
+	for i := range list {
+		if list[i].Path == nested.Path {
+			list[i] = nested
+			return list
+		}
+	}
+
+	return append(list, nested)
+}
+
+func mergeURLNested(list []URLNested, nested URLNested) []URLNested {
+	for i := range list {
+		if list[i].Path == nested.Path {
+			list[i] = nested
+			return list
+		}
+	}
+
+	return append(list, nested)
+}
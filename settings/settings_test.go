@@ -0,0 +1,198 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/fundadore/config"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"config.json", `{"redirect":{"encode":true,"rules":{"file":"rules.json"},"listen":{"socks":"127.0.0.1:1080"},"ca":{"cert":"/etc/ca.pem","key":"ca.key"}},"internest":{"api_port":8080}}`},
+		{"config.yaml", "redirect:\n  encode: true\n  rules:\n    file: rules.json\n  listen:\n    socks: 127.0.0.1:1080\n  ca:\n    cert: /etc/ca.pem\n    key: ca.key\ninternest:\n  api_port: 8080\n"},
+		{"config.YML", "redirect:\n  encode: true\n  rules:\n    file: rules.json\n  listen:\n    socks: 127.0.0.1:1080\n  ca:\n    cert: /etc/ca.pem\n    key: ca.key\ninternest:\n  api_port: 8080\n"},
+		{"config.toml", "[redirect]\nencode = true\n[redirect.rules]\nfile = \"rules.json\"\n[redirect.listen]\nsocks = \"127.0.0.1:1080\"\n[redirect.ca]\ncert = \"/etc/ca.pem\"\nkey = \"ca.key\"\n[internest]\napi_port = 8080\n"},
+	}
+
+	for _, c := range cases {
+		fileName := filepath.Join(dir, c.name)
+		if err := os.WriteFile(fileName, []byte(c.data), 0644); nil != err {
+			t.Fatal(err)
+		}
+
+		setting, err := Load(fileName)
+		if nil != err {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if false == setting.Redirect.Encode || "127.0.0.1:1080" != setting.Redirect.Listen.Socks || 8080 != setting.Internest.APIPort {
+			t.Fatalf("%s: setting = %+v", c.name, setting)
+		}
+
+		if filepath.Join(dir, "rules.json") != setting.Redirect.Rules.File || "/etc/ca.pem" != setting.Redirect.CA.Cert || filepath.Join(dir, "ca.key") != setting.Redirect.CA.Key {
+			t.Fatalf("%s: paths = %+v, %+v", c.name, setting.Redirect.Rules, setting.Redirect.CA)
+		}
+	}
+
+	invalid := map[string]string{
+		"broken.json":   `{"redirect":`,
+		"broken.yaml":   "redirect: [",
+		"broken.toml":   "[redirect",
+		"noRules.json":  `{"redirect":{}}`,
+		"notExist.json": "",
+	}
+
+	for name, data := range invalid {
+		fileName := filepath.Join(dir, name)
+		if "" != data {
+			os.WriteFile(fileName, []byte(data), 0644)
+		}
+
+		if _, err := Load(fileName); nil == err {
+			t.Fatalf("%s: expect error", name)
+		}
+	}
+}
+
+func TestResolvePaths(t *testing.T) {
+	setting := &Settings{}
+	setting.Redirect.Rules.File = "rules.json"
+	setting.Redirect.CA = CA{Root: "ca/root.pem", Cert: "/abs/cert.pem", Key: "ca/key.pem"}
+	setting.Redirect.UpstreamPool.Proxies = []Upstream{{URL: "http://a:8080", CredentialsFile: "a.cred"}, {URL: "http://b:8080"}}
+	setting.Redirect.ParentProxies = []Upstream{{Name: "p", URL: "socks5://p:1080", CredentialsFile: "/abs/p.cred"}}
+
+	setting.resolvePaths("/etc/tracksocks")
+
+	got := []string{
+		setting.Redirect.Rules.File,
+		setting.Redirect.CA.Root,
+		setting.Redirect.CA.Cert,
+		setting.Redirect.CA.Key,
+		setting.Redirect.UpstreamPool.Proxies[0].CredentialsFile,
+		setting.Redirect.UpstreamPool.Proxies[1].CredentialsFile,
+		setting.Redirect.ParentProxies[0].CredentialsFile,
+	}
+
+	want := []string{
+		filepath.Join("/etc/tracksocks", "rules.json"),
+		filepath.Join("/etc/tracksocks", "ca/root.pem"),
+		"/abs/cert.pem",
+		filepath.Join("/etc/tracksocks", "ca/key.pem"),
+		filepath.Join("/etc/tracksocks", "a.cred"),
+		"",
+		"/abs/p.cred",
+	}
+
+	if false == reflect.DeepEqual(want, got) {
+		t.Fatalf("paths = %v, want %v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Settings {
+		setting := &Settings{}
+		setting.Redirect.Rules.File = "rules.json"
+		return setting
+	}
+
+	cases := []struct {
+		name   string
+		modify func(s *Settings)
+		err    string
+	}{
+		{"valid", func(s *Settings) {}, ""},
+		{"remote without rules", func(s *Settings) { s.Redirect.Rules.File, s.Remote.Enable = "", true }, ""},
+		{"no rules", func(s *Settings) { s.Redirect.Rules.File = "" }, "rules file or url"},
+		{"rules url", func(s *Settings) { s.Redirect.Rules = Source{URL: "http://example.com/rules.json"} }, ""},
+		{"ca cert only", func(s *Settings) { s.Redirect.CA.Cert = "cert.pem" }, "ca cert and key"},
+		{"tproxy", func(s *Settings) { s.Redirect.Listen.TransparentMode = "tproxy" }, ""},
+		{"transparent mode", func(s *Settings) { s.Redirect.Listen.TransparentMode = "nat" }, "unknown transparent mode"},
+		{"socks username", func(s *Settings) { s.Redirect.Listen.SocksAuth.Username = strings.Repeat("u", 256) }, "255 bytes"},
+		{"strategy", func(s *Settings) { s.Redirect.UpstreamPool.Strategy = "random" }, "unknown upstream strategy"},
+		{"sticky", func(s *Settings) { s.Redirect.UpstreamPool.Strategy = "sticky" }, ""},
+		{"upstream url", func(s *Settings) { s.Redirect.UpstreamPool.Proxies = []Upstream{{URL: "proxy"}} }, "invalid upstream proxy url"},
+		{"parent url", func(s *Settings) { s.Redirect.ParentProxies = []Upstream{{Name: "p", URL: "::"}} }, "invalid upstream proxy url"},
+		{"parent without name", func(s *Settings) { s.Redirect.ParentProxies = []Upstream{{URL: "http://p:8080"}} }, "parent proxy name"},
+		{"parent duplicate", func(s *Settings) {
+			s.Redirect.ParentProxies = []Upstream{{Name: "p", URL: "http://a:8080"}, {Name: "p", URL: "http://b:8080"}}
+		}, "parent proxy name"},
+		{"dns servers", func(s *Settings) {
+			s.Redirect.DNS.Servers = []string{"8.8.8.8", "tls://1.1.1.1", "https://dns.example.com/dns-query"}
+		}, ""},
+		{"dns server", func(s *Settings) { s.Redirect.DNS.Servers = []string{"udp://"} }, "invalid dns server"},
+		{"dns hosts", func(s *Settings) { s.Redirect.DNS.Hosts = map[string]string{"a.example.com": "10.0.0.1, ::1"} }, ""},
+		{"dns hosts address", func(s *Settings) { s.Redirect.DNS.Hosts = map[string]string{"a.example.com": "10.0.0.1,example"} }, "invalid dns hosts address"},
+		{"metrics listen", func(s *Settings) { s.Internest.Metrics = Metrics{Listen: "0.0.0.0:9100", Token: "scrape"} }, ""},
+		{"metrics listen address", func(s *Settings) { s.Internest.Metrics.Listen = "9100" }, "invalid metrics listen address"},
+		{"html nested path", func(s *Settings) { s.Internest.HtmlNested = []HtmlNested{{Path: "html"}} }, "html nested path"},
+		{"url nested path", func(s *Settings) { s.Internest.URLNested = []URLNested{{Path: "url"}} }, "url nested path"},
+	}
+
+	for _, c := range cases {
+		setting := valid()
+		c.modify(setting)
+
+		err := setting.Validate()
+		if "" == c.err && nil != err {
+			t.Fatalf("%s: unexpected error %v", c.name, err)
+		}
+
+		if "" != c.err && (nil == err || false == strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%s: err = %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	local := func() *Settings {
+		setting := &Settings{}
+		setting.Redirect.Encode = true
+		setting.Redirect.Rules = Source{File: "/etc/rules.json"}
+		setting.Redirect.Upstreams = "http://local/upstreams"
+		setting.Internest.APIPort = 8080
+		setting.Internest.HtmlNested = []HtmlNested{{Path: "/a", Data: "local"}, {Path: "/b", Data: "local"}}
+		setting.Internest.URLNested = []URLNested{{Path: "/u", URL: "http://local"}}
+		return setting
+	}
+
+	setting := local()
+	setting.Merge(&config.Settings{})
+	if false == reflect.DeepEqual(local(), setting) {
+		t.Fatalf("empty remote changed settings: %+v", setting)
+	}
+
+	setting = local()
+	setting.Redirect.Encode = false
+
+	remote := &config.Settings{}
+	remote.Redirect.Encode = true
+	remote.Redirect.RulesURL = "http://remote/rules"
+	remote.Redirect.UpstreamsURL = "http://remote/upstreams"
+	remote.Internest.APIPort = 9090
+	remote.Internest.HtmlNested = []config.HtmlNested{{Path: "/b", Data: "remote"}, {Path: "/c", Data: "remote"}}
+	remote.Internest.URLNested = []config.URLNested{{Type: 1, Path: "/u", URL: "http://remote"}}
+
+	setting.Merge(remote)
+
+	if false == setting.Redirect.Encode || (Source{URL: "http://remote/rules"}) != setting.Redirect.Rules || "http://remote/upstreams" != setting.Redirect.Upstreams || 9090 != setting.Internest.APIPort {
+		t.Fatalf("redirect = %+v, internest = %+v", setting.Redirect, setting.Internest)
+	}
+
+	html := []HtmlNested{{Path: "/a", Data: "local"}, {Path: "/b", Data: "remote"}, {Path: "/c", Data: "remote"}}
+	if false == reflect.DeepEqual(html, setting.Internest.HtmlNested) {
+		t.Fatalf("html nested = %+v", setting.Internest.HtmlNested)
+	}
+
+	if false == reflect.DeepEqual([]URLNested{{Type: 1, Path: "/u", URL: "http://remote"}}, setting.Internest.URLNested) {
+		t.Fatalf("url nested = %+v", setting.Internest.URLNested)
+	}
+}